@@ -0,0 +1,509 @@
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// The Append functions pack a value in the same format as the
+// corresponding Pack function and append it to a byte slice, returning the
+// extended slice.  The Read functions unpack a value from the front of a
+// byte slice and return it along with the remaining bytes; a nil value
+// reads as the zero value.  Together they let generated code marshal
+// without reflection.
+
+// Upper bounds of the packed sizes of values, for estimating buffer sizes.
+const (
+	NIL_SIZE          = 1
+	BOOL_SIZE         = 1
+	INT_SIZE          = 9
+	UINT_SIZE         = 9
+	FLOAT32_SIZE      = 5
+	FLOAT64_SIZE      = 9
+	BYTES_PREFIX_SIZE = 5
+	ARRAY_HEADER_SIZE = 5
+	MAP_HEADER_SIZE   = 5
+)
+
+// Appends a packed nil.
+func AppendNil(b []byte) []byte {
+	return append(b, NIL)
+}
+
+// Appends a packed value.
+func AppendBool(b []byte, value bool) []byte {
+	if value {
+		return append(b, TRUE)
+	}
+	return append(b, FALSE)
+}
+
+// Appends a packed value.
+func AppendUint64(b []byte, value uint64) []byte {
+	switch {
+	case value < REGULAR_UINT7_MAX:
+		return append(b, byte(value))
+	case value < REGULAR_UINT8_MAX:
+		return append(b, UINT8, byte(value))
+	case value < REGULAR_UINT16_MAX:
+		return append(b, UINT16, byte(value>>8), byte(value))
+	case value < REGULAR_UINT32_MAX:
+		return append(b, UINT32, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+	return append(b, UINT64, byte(value>>56), byte(value>>48), byte(value>>40), byte(value>>32), byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+// Appends a packed value.  Non-negative values are packed in the unsigned
+// formats.
+func AppendInt64(b []byte, value int64) []byte {
+	switch {
+	case value >= 0:
+		return AppendUint64(b, uint64(value))
+	case value >= -SPECIAL_INT8:
+		return append(b, byte(value))
+	case value >= math.MinInt8:
+		return append(b, INT8, byte(value))
+	case value >= math.MinInt16:
+		return append(b, INT16, byte(value>>8), byte(value))
+	case value >= math.MinInt32:
+		return append(b, INT32, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+	return append(b, INT64, byte(value>>56), byte(value>>48), byte(value>>40), byte(value>>32), byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+// Appends a packed value.
+func AppendFloat32(b []byte, value float32) []byte {
+	bits := math.Float32bits(value)
+	return append(b, FLOAT, byte(bits>>24), byte(bits>>16), byte(bits>>8), byte(bits))
+}
+
+// Appends a packed value.
+func AppendFloat64(b []byte, value float64) []byte {
+	bits := math.Float64bits(value)
+	return append(b, DOUBLE, byte(bits>>56), byte(bits>>48), byte(bits>>40), byte(bits>>32), byte(bits>>24), byte(bits>>16), byte(bits>>8), byte(bits))
+}
+
+func appendRawHeader(b []byte, length int) []byte {
+	switch {
+	case length < MAXFIXRAW:
+		return append(b, FIXRAW|byte(length))
+	case length < MAX16BIT:
+		return append(b, RAW16, byte(length>>8), byte(length))
+	}
+	return append(b, RAW32, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+}
+
+// Appends a packed value.
+func AppendBytes(b []byte, value []byte) []byte {
+	return append(appendRawHeader(b, len(value)), value...)
+}
+
+// Appends a packed value.
+func AppendString(b []byte, value string) []byte {
+	return append(appendRawHeader(b, len(value)), value...)
+}
+
+// Appends the header of an array with the given number of elements.
+func AppendArrayHeader(b []byte, length int) []byte {
+	switch {
+	case length < MAXFIXARRAY:
+		return append(b, FIXARRAY|byte(length))
+	case length < MAX16BIT:
+		return append(b, ARRAY16, byte(length>>8), byte(length))
+	}
+	return append(b, ARRAY32, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+}
+
+// Appends the header of a map with the given number of entries.
+func AppendMapHeader(b []byte, length int) []byte {
+	switch {
+	case length < MAXFIXMAP:
+		return append(b, FIXMAP|byte(length))
+	case length < MAX16BIT:
+		return append(b, MAP16, byte(length>>8), byte(length))
+	}
+	return append(b, MAP32, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+}
+
+// Appends a value packed by Pack.
+func AppendValue(b []byte, value interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(b)
+	_, err := Pack(buf, value)
+	return buf.Bytes(), err
+}
+
+// Returns whether the next value in b is nil.
+func IsNil(b []byte) bool {
+	return len(b) > 0 && b[0] == NIL
+}
+
+func codeError(c byte, typ reflect.Type) error {
+	return &TypeError{"value with code 0x" + strconv.FormatUint(uint64(c), 16), typ}
+}
+
+// Reads a big-endian integer of n bytes following the first byte of b.
+func readBigEndian(b []byte, n int) (v uint64, rest []byte, err error) {
+	if len(b) < 1+n {
+		return 0, b, io.ErrUnexpectedEOF
+	}
+	for _, c := range b[1 : 1+n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, b[1+n:], nil
+}
+
+// Reads any integer and returns it as the magnitude and whether it is
+// negative.
+func readInteger(b []byte, typ reflect.Type) (v uint64, neg bool, rest []byte, err error) {
+	if len(b) == 0 {
+		return 0, false, b, io.ErrUnexpectedEOF
+	}
+	c := b[0]
+	switch {
+	case c < FIXMAP:
+		return uint64(c), false, b[1:], nil
+	case c >= NEGFIXNUM:
+		return uint64(-int64(int8(c))), true, b[1:], nil
+	}
+	var signed bool
+	switch c {
+	case NIL:
+		return 0, false, b[1:], nil
+	case UINT8:
+		v, rest, err = readBigEndian(b, 1)
+	case UINT16:
+		v, rest, err = readBigEndian(b, 2)
+	case UINT32:
+		v, rest, err = readBigEndian(b, 4)
+	case UINT64:
+		v, rest, err = readBigEndian(b, 8)
+	case INT8:
+		v, rest, err = readBigEndian(b, 1)
+		v, signed = uint64(int8(v)), true
+	case INT16:
+		v, rest, err = readBigEndian(b, 2)
+		v, signed = uint64(int16(v)), true
+	case INT32:
+		v, rest, err = readBigEndian(b, 4)
+		v, signed = uint64(int32(v)), true
+	case INT64:
+		v, rest, err = readBigEndian(b, 8)
+		signed = true
+	default:
+		return 0, false, b, codeError(c, typ)
+	}
+	if err != nil || !signed || int64(v) >= 0 {
+		return v, false, rest, err
+	}
+	return uint64(-int64(v)), true, rest, nil
+}
+
+// Reads an integer that must fit in a signed integer of the given bit size.
+func readInt(b []byte, bits int, typ reflect.Type) (int64, []byte, error) {
+	v, neg, rest, err := readInteger(b, typ)
+	if err != nil {
+		return 0, b, err
+	}
+	if neg {
+		if v > 1<<(bits-1) {
+			return 0, b, &TypeError{"-" + strconv.FormatUint(v, 10), typ}
+		}
+		return -int64(v), rest, nil
+	}
+	if v > 1<<(bits-1)-1 {
+		return 0, b, &TypeError{strconv.FormatUint(v, 10), typ}
+	}
+	return int64(v), rest, nil
+}
+
+// Reads an integer that must fit in an unsigned integer of the given bit
+// size.
+func readUint(b []byte, bits int, typ reflect.Type) (uint64, []byte, error) {
+	v, neg, rest, err := readInteger(b, typ)
+	if err != nil {
+		return 0, b, err
+	}
+	if neg {
+		return 0, b, &TypeError{"-" + strconv.FormatUint(v, 10), typ}
+	}
+	if bits < 64 && v > 1<<bits-1 {
+		return 0, b, &TypeError{strconv.FormatUint(v, 10), typ}
+	}
+	return v, rest, nil
+}
+
+// Reads a packed value.
+func ReadInt8(b []byte) (v int8, rest []byte, err error) {
+	_v, rest, err := readInt(b, 8, reflect.TypeOf(v))
+	return int8(_v), rest, err
+}
+
+// Reads a packed value.
+func ReadInt16(b []byte) (v int16, rest []byte, err error) {
+	_v, rest, err := readInt(b, 16, reflect.TypeOf(v))
+	return int16(_v), rest, err
+}
+
+// Reads a packed value.
+func ReadInt32(b []byte) (v int32, rest []byte, err error) {
+	_v, rest, err := readInt(b, 32, reflect.TypeOf(v))
+	return int32(_v), rest, err
+}
+
+// Reads a packed value.
+func ReadInt64(b []byte) (v int64, rest []byte, err error) {
+	return readInt(b, 64, reflect.TypeOf(v))
+}
+
+// Reads a packed value.
+func ReadInt(b []byte) (v int, rest []byte, err error) {
+	_v, rest, err := readInt(b, strconv.IntSize, reflect.TypeOf(v))
+	return int(_v), rest, err
+}
+
+// Reads a packed value.
+func ReadUint8(b []byte) (v uint8, rest []byte, err error) {
+	_v, rest, err := readUint(b, 8, reflect.TypeOf(v))
+	return uint8(_v), rest, err
+}
+
+// Reads a packed value.
+func ReadUint16(b []byte) (v uint16, rest []byte, err error) {
+	_v, rest, err := readUint(b, 16, reflect.TypeOf(v))
+	return uint16(_v), rest, err
+}
+
+// Reads a packed value.
+func ReadUint32(b []byte) (v uint32, rest []byte, err error) {
+	_v, rest, err := readUint(b, 32, reflect.TypeOf(v))
+	return uint32(_v), rest, err
+}
+
+// Reads a packed value.
+func ReadUint64(b []byte) (v uint64, rest []byte, err error) {
+	return readUint(b, 64, reflect.TypeOf(v))
+}
+
+// Reads a packed value.
+func ReadUint(b []byte) (v uint, rest []byte, err error) {
+	_v, rest, err := readUint(b, strconv.IntSize, reflect.TypeOf(v))
+	return uint(_v), rest, err
+}
+
+// Reads a packed value.
+func ReadBool(b []byte) (v bool, rest []byte, err error) {
+	if len(b) == 0 {
+		return false, b, io.ErrUnexpectedEOF
+	}
+	switch b[0] {
+	case NIL, FALSE:
+		return false, b[1:], nil
+	case TRUE:
+		return true, b[1:], nil
+	}
+	return false, b, codeError(b[0], reflect.TypeOf(v))
+}
+
+// Reads a packed value.  Integers are converted to float64.
+func ReadFloat64(b []byte) (v float64, rest []byte, err error) {
+	if len(b) == 0 {
+		return 0, b, io.ErrUnexpectedEOF
+	}
+	switch b[0] {
+	case FLOAT:
+		bits, rest, err := readBigEndian(b, 4)
+		return float64(math.Float32frombits(uint32(bits))), rest, err
+	case DOUBLE:
+		bits, rest, err := readBigEndian(b, 8)
+		return math.Float64frombits(bits), rest, err
+	}
+	i, neg, rest, err := readInteger(b, reflect.TypeOf(v))
+	if err != nil {
+		return 0, b, err
+	}
+	if neg {
+		return -float64(i), rest, nil
+	}
+	return float64(i), rest, nil
+}
+
+// Reads a packed value.  Integers are converted to float32, and finite
+// values beyond its range are a TypeError, as in Decode.
+func ReadFloat32(b []byte) (v float32, rest []byte, err error) {
+	_v, rest, err := ReadFloat64(b)
+	if err == nil && overflowFloat32(_v) {
+		return 0, b, &TypeError{strconv.FormatFloat(_v, 'g', -1, 64), reflect.TypeOf(v)}
+	}
+	return float32(_v), rest, err
+}
+
+// Reads the length of a raw value and returns it along with the bytes
+// following the header.
+func readRawHeader(b []byte, typ reflect.Type) (length int, rest []byte, err error) {
+	if len(b) == 0 {
+		return 0, b, io.ErrUnexpectedEOF
+	}
+	c := b[0]
+	var l uint64
+	switch {
+	case c >= FIXRAW && c <= FIXRAWMAX:
+		l, rest = uint64(lowfive(c)), b[1:]
+	case c == RAW16:
+		l, rest, err = readBigEndian(b, 2)
+	case c == RAW32:
+		l, rest, err = readBigEndian(b, 4)
+	case c == NIL:
+		return 0, b[1:], nil
+	default:
+		return 0, b, codeError(c, typ)
+	}
+	if err == nil && l > uint64(len(rest)) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, b, err
+	}
+	return int(l), rest, nil
+}
+
+// Reads a packed value.  The returned slice is a copy.
+func ReadBytes(b []byte) (v []byte, rest []byte, err error) {
+	if IsNil(b) {
+		return nil, b[1:], nil
+	}
+	length, rest, err := readRawHeader(b, reflect.TypeOf(v))
+	if err != nil {
+		return nil, b, err
+	}
+	return append(Bytes{}, rest[:length]...), rest[length:], nil
+}
+
+// Reads a packed value.
+func ReadString(b []byte) (v string, rest []byte, err error) {
+	length, rest, err := readRawHeader(b, reflect.TypeOf(v))
+	if err != nil {
+		return "", b, err
+	}
+	return string(rest[:length]), rest[length:], nil
+}
+
+// Reads the header of an array and returns the number of elements.  A nil
+// value reads as an empty array.
+func ReadArrayHeader(b []byte) (length int, rest []byte, err error) {
+	return readContainerHeader(b, FIXARRAY, FIXARRAYMAX, ARRAY16, ARRAY32, 1, reflect.TypeOf([]interface{}(nil)))
+}
+
+// Reads the header of a map and returns the number of entries.  A nil
+// value reads as an empty map.
+func ReadMapHeader(b []byte) (length int, rest []byte, err error) {
+	return readContainerHeader(b, FIXMAP, FIXMAPMAX, MAP16, MAP32, 2, reflect.TypeOf(map[interface{}]interface{}(nil)))
+}
+
+// Reads the header of an array or map.  Every element takes at least one
+// byte, so lengths exceeding the remaining bytes are rejected before
+// anything is allocated for them.
+func readContainerHeader(b []byte, fix byte, fixmax byte, code16 byte, code32 byte, width uint64, typ reflect.Type) (length int, rest []byte, err error) {
+	if len(b) == 0 {
+		return 0, b, io.ErrUnexpectedEOF
+	}
+	c := b[0]
+	var l uint64
+	switch {
+	case c >= fix && c <= fixmax:
+		l, rest = uint64(c-fix), b[1:]
+	case c == code16:
+		l, rest, err = readBigEndian(b, 2)
+	case c == code32:
+		l, rest, err = readBigEndian(b, 4)
+	case c == NIL:
+		return 0, b[1:], nil
+	default:
+		return 0, b, codeError(c, typ)
+	}
+	if err == nil && width*l > uint64(len(rest)) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, b, err
+	}
+	return int(l), rest, nil
+}
+
+// Skips the next value in b and returns the bytes following it.
+func SkipValue(b []byte) (rest []byte, err error) {
+	rest = b
+	// Arrays and maps add their elements to the values left to skip
+	for pending := uint64(1); pending > 0; pending-- {
+		if len(rest) == 0 {
+			return b, io.ErrUnexpectedEOF
+		}
+		c := rest[0]
+		header, length := 1, uint64(0) // length of the data after the header
+		switch {
+		case c < FIXMAP || c >= NEGFIXNUM:
+		case c <= FIXMAPMAX:
+			pending += 2 * uint64(c-FIXMAP)
+		case c <= FIXARRAYMAX:
+			pending += uint64(c - FIXARRAY)
+		case c <= FIXRAWMAX:
+			length = uint64(c - FIXRAW)
+		default:
+			switch c {
+			case NIL, FALSE, TRUE:
+			case UINT8, INT8:
+				length = 1
+			case UINT16, INT16:
+				length = 2
+			case FLOAT, UINT32, INT32:
+				length = 4
+			case DOUBLE, UINT64, INT64:
+				length = 8
+			case FIXEXT1, FIXEXT2, FIXEXT4, FIXEXT8, FIXEXT16:
+				length = 1 + 1<<(c-FIXEXT1)
+			case EXT8, EXT16, EXT32, RAW16, RAW32, ARRAY16, ARRAY32, MAP16, MAP32:
+				size := 2
+				switch c {
+				case EXT8:
+					size = 1
+				case EXT32, RAW32, ARRAY32, MAP32:
+					size = 4
+				}
+				l, _, err := readBigEndian(rest, size)
+				if err != nil {
+					return b, err
+				}
+				header += size
+				switch c {
+				case ARRAY16, ARRAY32:
+					pending += l
+				case MAP16, MAP32:
+					pending += 2 * l
+				case RAW16, RAW32:
+					length = l
+				default:
+					length = 1 + l
+				}
+			default:
+				return b, ErrUnsupportedCode
+			}
+		}
+		if uint64(len(rest)-header) < length {
+			return b, io.ErrUnexpectedEOF
+		}
+		rest = rest[header+int(length):]
+	}
+	return rest, nil
+}
+
+// Reads the next value in b with Decode and stores it in the value pointed
+// to by v.
+func ReadValue(b []byte, v interface{}) (rest []byte, err error) {
+	reader := bytes.NewReader(b)
+	if _, err := Decode(reader, v); err != nil {
+		return b, err
+	}
+	return b[len(b)-reader.Len():], nil
+}
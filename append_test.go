@@ -0,0 +1,105 @@
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	for _, i := range []int64{0, 1, 127, 128, 255, 256, 65535, 65536, math.MaxUint32, math.MaxUint32 + 1, math.MaxInt64, -1, -32, -33, -128, -129, -32768, -32769, math.MinInt32, math.MinInt32 - 1, math.MinInt64} {
+		b := &bytes.Buffer{}
+		PackInt64(b, i)
+		if _b := AppendInt64(nil, i); !bytes.Equal(_b, b.Bytes()) {
+			t.Errorf("AppendInt64(%d) = %v, PackInt64 wrote %v", i, _b, b.Bytes())
+		}
+		v, rest, err := ReadInt64(b.Bytes())
+		if err != nil || v != i || len(rest) != 0 {
+			t.Errorf("ReadInt64(%v) = %d, %v, %v", b.Bytes(), v, rest, err)
+		}
+	}
+	for _, i := range []float64{0, 1.5, -2.25, math.Inf(1)} {
+		b := &bytes.Buffer{}
+		PackFloat64(b, i)
+		PackFloat32(b, float32(i))
+		if _b := AppendFloat32(AppendFloat64(nil, i), float32(i)); !bytes.Equal(_b, b.Bytes()) {
+			t.Errorf("AppendFloat64(%v) = %v, PackFloat64 wrote %v", i, _b, b.Bytes())
+		}
+	}
+	b := &bytes.Buffer{}
+	PackNil(b)
+	PackBool(b, true)
+	PackBytes(b, Bytes("abc"))
+	packArrayHeader(b, 20)
+	packMapHeader(b, 3)
+	_b := AppendMapHeader(AppendArrayHeader(AppendString(AppendBool(AppendNil(nil), true), "abc"), 20), 3)
+	if !bytes.Equal(_b, b.Bytes()) {
+		t.Errorf("%v != %v", _b, b.Bytes())
+	}
+	_b, err := AppendValue(Bytes{NIL}, map[string]int{"a": 1})
+	if err != nil || !bytes.Equal(_b, Bytes{NIL, 0x81, 0xa1, 'a', 1}) {
+		t.Error("wrong output", _b, err)
+	}
+}
+
+func TestRead(t *testing.T) {
+	b := AppendInt64(nil, 200)
+	if v, _, err := ReadUint8(b); err != nil || v != 200 {
+		t.Error("ReadUint8", v, err)
+	}
+	if _, _, err := ReadInt8(b); err == nil {
+		t.Error("ReadInt8 of 200 did not fail")
+	}
+	if _, _, err := ReadUint64(AppendInt64(nil, -1)); err == nil {
+		t.Error("ReadUint64 of -1 did not fail")
+	}
+	if v, _, err := ReadInt8(AppendInt64(nil, -128)); err != nil || v != -128 {
+		t.Error("ReadInt8", v, err)
+	}
+	if v, _, err := ReadFloat64(b); err != nil || v != 200 {
+		t.Error("ReadFloat64", v, err)
+	}
+	if _, _, err := ReadFloat32(AppendFloat64(nil, 1e300)); err == nil {
+		t.Error("ReadFloat32 of 1e300 did not fail")
+	}
+	if v, _, err := ReadFloat32(AppendFloat64(nil, math.Inf(-1))); err != nil || !math.IsInf(float64(v), -1) {
+		t.Error("ReadFloat32 of -Inf", v, err)
+	}
+	if _, _, err := ReadString(b); err == nil {
+		t.Error("ReadString of an integer did not fail")
+	}
+	if v, rest, err := ReadInt(Bytes{NIL, 1}); err != nil || v != 0 || len(rest) != 1 {
+		t.Error("ReadInt of nil", v, rest, err)
+	}
+	if _, _, err := ReadInt32(Bytes{INT32, 1}); err != io.ErrUnexpectedEOF {
+		t.Error("ReadInt32 of a short buffer", err)
+	}
+	if _, _, err := ReadArrayHeader(Bytes{ARRAY32, 0xff, 0xff, 0xff, 0xff}); err != io.ErrUnexpectedEOF {
+		t.Error("ReadArrayHeader of a long array", err)
+	}
+
+	b = AppendString(AppendMapHeader(nil, 1), "key")
+	b = AppendBytes(AppendArrayHeader(b, 1), Bytes{1, 2})
+	b = AppendBool(b, true)
+	n, rest, err := ReadMapHeader(b)
+	if err != nil || n != 1 {
+		t.Fatal("ReadMapHeader", n, err)
+	}
+	s, rest, err := ReadString(rest)
+	if err != nil || s != "key" {
+		t.Fatal("ReadString", s, err)
+	}
+	rest, err = SkipValue(rest)
+	if err != nil {
+		t.Fatal("SkipValue", err)
+	}
+	if v, rest, err := ReadBool(rest); err != nil || !v || len(rest) != 0 {
+		t.Error("ReadBool", v, rest, err)
+	}
+	var m map[string][]Bytes
+	rest, err = ReadValue(b, &m)
+	if err != nil || len(m["key"]) != 1 || !bytes.Equal(m["key"][0], Bytes{1, 2}) || len(rest) != 1 {
+		t.Error("ReadValue", m, rest, err)
+	}
+}
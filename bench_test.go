@@ -0,0 +1,275 @@
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type benchRecord struct {
+	ID     int64
+	Name   string
+	Scores []float64
+	Tags   map[string]string
+	Counts []int32
+}
+
+var benchValue = benchRecord{
+	ID:     12345,
+	Name:   "benchmark record",
+	Scores: []float64{1.5, 2.25, 3.125, 4.0625, 5.03125, 6.015625, 7.0078125, 8.00390625},
+	Tags:   map[string]string{"a": "alpha", "b": "beta", "c": "gamma", "d": "delta"},
+	Counts: []int32{1, -2, 300, -40000, 5000000, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+}
+
+// Packs a value by looking at its type anew for every value, as PackValue
+// did before encoders were compiled and cached.  It is the baseline of the
+// "uncached" benchmarks.
+func packUncached(enc *Encoder, value reflect.Value) (n int, err error) {
+	writer := enc.writer
+	if !value.IsValid() || (value.Kind() == reflect.Ptr && value.IsNil()) {
+		return PackNil(writer)
+	}
+	if codec := extCodecForGoType(value.Type()); codec != nil {
+		return packExtCodec(writer, codec, value)
+	}
+	if value.Kind() != reflect.Interface {
+		for _, typ := range []reflect.Type{marshalerType, binaryMarshalerType, textMarshalerType} {
+			if _, ok := valueAs(value, typ); ok {
+				return enc.PackValue(value)
+			}
+		}
+	}
+	var _n int
+	switch value.Kind() {
+	case reflect.Bool:
+		return PackBool(writer, value.Bool())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return PackUint64(writer, value.Uint())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return enc.packInt64(value.Int())
+	case reflect.Float32:
+		return PackFloat32(writer, float32(value.Float()))
+	case reflect.Float64:
+		return enc.packFloat64(value.Float())
+	case reflect.String:
+		return PackBytes(writer, Bytes(value.String()))
+	case reflect.Slice, reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return enc.PackValue(value)
+		}
+		n, err = packArrayHeader(writer, value.Len())
+		for i := 0; i < value.Len() && err == nil; i++ {
+			_n, err = packUncached(enc, value.Index(i))
+			n += _n
+		}
+		return n, err
+	case reflect.Map:
+		n, err = packMapHeader(writer, value.Len())
+		for _, k := range value.MapKeys() {
+			if err != nil {
+				break
+			}
+			_n, err = packUncached(enc, k)
+			n += _n
+			if err == nil {
+				_n, err = packUncached(enc, value.MapIndex(k))
+				n += _n
+			}
+		}
+		return n, err
+	case reflect.Ptr, reflect.Interface:
+		return packUncached(enc, value.Elem())
+	case reflect.Struct:
+		fields := structFields(value.Type())
+		n, err = packMapHeader(writer, len(fields))
+		for _, f := range fields {
+			if err != nil {
+				break
+			}
+			_n, err = enc.Pack(f.name)
+			n += _n
+			if err == nil {
+				_n, err = packUncached(enc, value.Field(f.index))
+				n += _n
+			}
+		}
+		return n, err
+	}
+	return enc.PackValue(value)
+}
+
+// Decodes a value by looking at the type of dst anew for every value, as
+// Decode did before decoders were compiled and cached.
+func decodeUncached(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+	if c == NIL {
+		dst.Set(reflect.Zero(dst.Type()))
+		return 0, nil
+	}
+	if dst.Kind() != reflect.Ptr && dst.CanAddr() {
+		for _, typ := range []reflect.Type{unmarshalerType, binaryUnmarshalerType, textUnmarshalerType} {
+			if dst.Addr().Type().Implements(typ) {
+				return decoderFor(dst.Type())(dec, c, dst)
+			}
+		}
+	}
+	switch dst.Kind() {
+	case reflect.Ptr:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return decodeUncached(dec, c, dst.Elem())
+	case reflect.Slice, reflect.Array:
+		if isArrayCode(c) {
+			return dec.decodeArray(c, dst, decodeUncached)
+		}
+	case reflect.Map:
+		if isMapCode(c) {
+			return dec.decodeMap(c, dst, decodeUncached, decodeUncached)
+		}
+	case reflect.Struct:
+		if isMapCode(c) {
+			fields := structFields(dst.Type())
+			byName := make(map[string]int, len(fields))
+			decs := make([]decoderFunc, len(fields))
+			for i, f := range fields {
+				byName[f.name] = i
+				decs[i] = decodeUncached
+			}
+			return dec.decodeStruct(c, dst, fields, byName, decs)
+		}
+	}
+	return dec.decodeScalar(c, dst)
+}
+
+// Runs the "cached" benchmark with PackValue and the "uncached" one with
+// packUncached, so that benchstat shows the gain of the compiled encoders.
+func benchmarkPackValue(b *testing.B, v interface{}) {
+	value := reflect.ValueOf(v)
+	enc := NewEncoder(io.Discard)
+	for _, bench := range []struct {
+		name string
+		pack func(enc *Encoder, value reflect.Value) (n int, err error)
+	}{
+		{"cached", (*Encoder).PackValue},
+		{"uncached", packUncached},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bench.pack(enc, value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPackStruct(b *testing.B) {
+	benchmarkPackValue(b, benchValue)
+}
+
+func BenchmarkPackInt32Slice(b *testing.B) {
+	benchmarkPackValue(b, benchValue.Counts)
+}
+
+func BenchmarkPackFloat64Slice(b *testing.B) {
+	benchmarkPackValue(b, benchValue.Scores)
+}
+
+func BenchmarkPackStringMap(b *testing.B) {
+	benchmarkPackValue(b, benchValue.Tags)
+}
+
+func BenchmarkDecodeStruct(b *testing.B) {
+	buf := &bytes.Buffer{}
+	if _, err := Pack(buf, benchValue); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	for _, bench := range []struct {
+		name   string
+		decode decoderFunc
+	}{
+		{"cached", decoderFor(reflect.TypeOf(benchValue))},
+		{"uncached", decodeUncached},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			reader := bytes.NewReader(data)
+			dec := NewDecoder(reader)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				reader.Reset(data)
+				var v benchRecord
+				if _, err := dec.decodeElem(reflect.ValueOf(&v).Elem(), bench.decode); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// The baselines must pack and decode like the cached path for the
+// comparison to be fair.
+func TestUncachedBaseline(t *testing.T) {
+	for _, v := range []interface{}{benchValue, benchValue.Counts, benchValue.Scores, benchValue.Tags} {
+		cached, uncached := &bytes.Buffer{}, &bytes.Buffer{}
+		if _, err := NewEncoder(cached).PackValue(reflect.ValueOf(v)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := packUncached(NewEncoder(uncached), reflect.ValueOf(v)); err != nil {
+			t.Fatal(err)
+		}
+		var expected, got interface{}
+		Decode(cached, &expected)
+		Decode(uncached, &got)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("packUncached(%T) = %v, want %v", v, got, expected)
+		}
+	}
+	data, _ := Marshal(benchValue)
+	dec := NewDecoder(bytes.NewReader(data))
+	var v benchRecord
+	if _, err := dec.decodeElem(reflect.ValueOf(&v).Elem(), decodeUncached); err != nil || !reflect.DeepEqual(v, benchValue) {
+		t.Errorf("decodeUncached = %v, %v", v, err)
+	}
+}
+
+// Compares Marshal with packing into a new buffer each time, which is what
+// the pooled scratch buffers save.
+func BenchmarkMarshal(b *testing.B) {
+	for _, bench := range []struct {
+		name    string
+		marshal func(value interface{}) ([]byte, error)
+	}{
+		{"pooled", Marshal},
+		{"unpooled", func(value interface{}) ([]byte, error) {
+			buf := &bytes.Buffer{}
+			_, err := Pack(buf, value)
+			return buf.Bytes(), err
+		}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := bench.marshal(benchValue); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	data, err := Marshal(benchValue)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Get(data, "Tags", "d"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package msgpack
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/big"
+	"reflect"
+	"time"
+)
+
+// Extension types of the built-in codecs below.  The codecs are opt-in:
+// nothing is packed as these types until the codec is passed to
+// RegisterExt.  Peers that use other numbers can register a copy of a
+// codec with its Type changed.
+const (
+	// *big.Int, as a big-endian two's complement integer of the minimal
+	// length (zero is a single 0x00 byte).
+	BIGINT_EXT = 0x10
+	// *big.Float, in the format of big.Float.GobEncode.
+	BIGFLOAT_EXT = 0x11
+	// *big.Rat, as the length of the numerator in a 4 byte big-endian
+	// integer, the numerator as in BIGINT_EXT and the denominator as an
+	// unsigned big-endian integer.
+	BIGRAT_EXT = 0x12
+	// time.Duration, as a 8 byte big-endian count of nanoseconds.
+	DURATION_EXT = 0x13
+	// complex64 and complex128, as the real part followed by the
+	// imaginary part, each a big-endian IEEE 754 float of the
+	// corresponding width.  Named complex types use the codec of their
+	// kind.
+	COMPLEX64_EXT  = 0x14
+	COMPLEX128_EXT = 0x15
+)
+
+var (
+	ErrInvalidExt = errors.New("invalid extension payload")
+	// Returned when packing a complex number without a registered codec
+	// for its kind, such as Complex128Ext.
+	ErrNoComplexExt = errors.New("no extension codec registered for complex numbers")
+)
+
+var (
+	BigIntExt = &ExtCodec{
+		Type:   BIGINT_EXT,
+		GoType: reflect.TypeOf((*big.Int)(nil)),
+		Encode: func(value reflect.Value) ([]byte, error) {
+			return encodeBigInt(value.Interface().(*big.Int)), nil
+		},
+		Decode: func(data []byte) (reflect.Value, error) {
+			if len(data) == 0 {
+				return reflect.Value{}, ErrInvalidExt
+			}
+			return reflect.ValueOf(decodeBigInt(data)), nil
+		},
+	}
+
+	BigFloatExt = &ExtCodec{
+		Type:   BIGFLOAT_EXT,
+		GoType: reflect.TypeOf((*big.Float)(nil)),
+		Encode: func(value reflect.Value) ([]byte, error) {
+			return value.Interface().(*big.Float).GobEncode()
+		},
+		Decode: func(data []byte) (reflect.Value, error) {
+			x := new(big.Float)
+			if err := x.GobDecode(data); err != nil {
+				return reflect.Value{}, err
+			}
+			return reflect.ValueOf(x), nil
+		},
+	}
+
+	BigRatExt = &ExtCodec{
+		Type:   BIGRAT_EXT,
+		GoType: reflect.TypeOf((*big.Rat)(nil)),
+		Encode: func(value reflect.Value) ([]byte, error) {
+			x := value.Interface().(*big.Rat)
+			num := encodeBigInt(x.Num())
+			length := len(num)
+			data := append(Bytes{byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)}, num...)
+			return append(data, x.Denom().Bytes()...), nil
+		},
+		Decode: func(data []byte) (reflect.Value, error) {
+			if len(data) < 4 {
+				return reflect.Value{}, ErrInvalidExt
+			}
+			length := uint(data[0])<<24 | uint(data[1])<<16 | uint(data[2])<<8 | uint(data[3])
+			data = data[4:]
+			if length == 0 || length >= uint(len(data)) {
+				return reflect.Value{}, ErrInvalidExt
+			}
+			denom := new(big.Int).SetBytes(data[length:])
+			if denom.Sign() == 0 {
+				return reflect.Value{}, ErrInvalidExt
+			}
+			return reflect.ValueOf(new(big.Rat).SetFrac(decodeBigInt(data[:length]), denom)), nil
+		},
+	}
+
+	DurationExt = &ExtCodec{
+		Type:   DURATION_EXT,
+		GoType: reflect.TypeOf(time.Duration(0)),
+		Encode: func(value reflect.Value) ([]byte, error) {
+			d := uint64(value.Int())
+			return Bytes{byte(d >> 56), byte(d >> 48), byte(d >> 40), byte(d >> 32), byte(d >> 24), byte(d >> 16), byte(d >> 8), byte(d)}, nil
+		},
+		Decode: func(data []byte) (reflect.Value, error) {
+			if len(data) != 8 {
+				return reflect.Value{}, ErrInvalidExt
+			}
+			d := uint64(data[0])<<56 | uint64(data[1])<<48 | uint64(data[2])<<40 | uint64(data[3])<<32 | uint64(data[4])<<24 | uint64(data[5])<<16 | uint64(data[6])<<8 | uint64(data[7])
+			return reflect.ValueOf(time.Duration(d)), nil
+		},
+	}
+
+	Complex64Ext = &ExtCodec{
+		Type:   COMPLEX64_EXT,
+		GoType: complex64Type,
+		Encode: func(value reflect.Value) ([]byte, error) {
+			x := complex64(value.Complex())
+			r, i := math.Float32bits(real(x)), math.Float32bits(imag(x))
+			return Bytes{byte(r >> 24), byte(r >> 16), byte(r >> 8), byte(r), byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)}, nil
+		},
+		Decode: func(data []byte) (reflect.Value, error) {
+			if len(data) != 8 {
+				return reflect.Value{}, ErrInvalidExt
+			}
+			r := uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+			i := uint32(data[4])<<24 | uint32(data[5])<<16 | uint32(data[6])<<8 | uint32(data[7])
+			return reflect.ValueOf(complex(math.Float32frombits(r), math.Float32frombits(i))), nil
+		},
+	}
+
+	Complex128Ext = &ExtCodec{
+		Type:   COMPLEX128_EXT,
+		GoType: complex128Type,
+		Encode: func(value reflect.Value) ([]byte, error) {
+			x := value.Complex()
+			r, i := math.Float64bits(real(x)), math.Float64bits(imag(x))
+			return Bytes{byte(r >> 56), byte(r >> 48), byte(r >> 40), byte(r >> 32), byte(r >> 24), byte(r >> 16), byte(r >> 8), byte(r), byte(i >> 56), byte(i >> 48), byte(i >> 40), byte(i >> 32), byte(i >> 24), byte(i >> 16), byte(i >> 8), byte(i)}, nil
+		},
+		Decode: func(data []byte) (reflect.Value, error) {
+			if len(data) != 16 {
+				return reflect.Value{}, ErrInvalidExt
+			}
+			r := uint64(data[0])<<56 | uint64(data[1])<<48 | uint64(data[2])<<40 | uint64(data[3])<<32 | uint64(data[4])<<24 | uint64(data[5])<<16 | uint64(data[6])<<8 | uint64(data[7])
+			data = data[8:]
+			i := uint64(data[0])<<56 | uint64(data[1])<<48 | uint64(data[2])<<40 | uint64(data[3])<<32 | uint64(data[4])<<24 | uint64(data[5])<<16 | uint64(data[6])<<8 | uint64(data[7])
+			return reflect.ValueOf(complex(math.Float64frombits(r), math.Float64frombits(i))), nil
+		},
+	}
+)
+
+var (
+	complex64Type  = reflect.TypeOf(complex64(0))
+	complex128Type = reflect.TypeOf(complex128(0))
+)
+
+func encodeBigInt(x *big.Int) []byte {
+	if x.Sign() >= 0 {
+		data := x.Bytes()
+		if len(data) == 0 || data[0]&0x80 != 0 {
+			data = append(Bytes{0}, data...)
+		}
+		return data
+	}
+	// -x-1 has the same bits as x inverted; one more byte keeps the sign
+	length := (new(big.Int).Not(x).BitLen() + 8) / 8
+	y := new(big.Int).Lsh(big.NewInt(1), uint(8*length))
+	return y.Add(y, x).Bytes()
+}
+
+func decodeBigInt(data []byte) *big.Int {
+	x := new(big.Int).SetBytes(data)
+	if data[0]&0x80 != 0 {
+		x.Sub(x, new(big.Int).Lsh(big.NewInt(1), uint(8*len(data))))
+	}
+	return x
+}
+
+// Packs a complex number with the codec registered for complex64, and
+// writes it into the specified writer.
+func PackComplex64(writer io.Writer, value complex64) (n int, err error) {
+	return packComplex(writer, reflect.ValueOf(value))
+}
+
+// Packs a complex number with the codec registered for complex128, and
+// writes it into the specified writer.
+func PackComplex128(writer io.Writer, value complex128) (n int, err error) {
+	return packComplex(writer, reflect.ValueOf(value))
+}
+
+// Returns the codec registered for the kind of a complex type, or nil.
+func complexCodec(typ reflect.Type) *ExtCodec {
+	if typ.Kind() == reflect.Complex64 {
+		return extCodecForGoType(complex64Type)
+	}
+	return extCodecForGoType(complex128Type)
+}
+
+func packComplex(writer io.Writer, value reflect.Value) (n int, err error) {
+	codec := complexCodec(value.Type())
+	if codec == nil {
+		return 0, ErrNoComplexExt
+	}
+	return packExtCodec(writer, codec, value.Convert(codec.GoType))
+}
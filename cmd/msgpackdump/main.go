@@ -0,0 +1,78 @@
+// Command msgpackdump prints packed values in the diagnostic notation of
+// msgpack.Dumper, which shows the format of every value.
+//
+// Usage:
+//
+//	msgpackdump [-indent string] [-offsets] [-hex] [file ...]
+//
+// The values in each file, or standard input if there are none, are
+// printed one after another.  With -hex the input is read as hex digits,
+// ignoring white space, as printed by test failures and hexdump -ve
+// '1/1 "%02x"'.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/msgpack/msgpack-go"
+)
+
+func main() {
+	indent := flag.String("indent", "  ", "indentation of nested values, or empty for one line per value")
+	offsets := flag.Bool("offsets", false, "prefix values with their offsets in the input")
+	hexInput := flag.Bool("hex", false, "read the input as hex digits")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: msgpackdump [-indent string] [-offsets] [-hex] [file ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	dumper := &msgpack.Dumper{Indent: *indent, Offsets: *offsets}
+	status := 0
+	if flag.NArg() == 0 {
+		if err := dump(dumper, os.Stdin, *hexInput); err != nil {
+			fmt.Fprintln(os.Stderr, "msgpackdump:", err)
+			status = 1
+		}
+	}
+	for _, name := range flag.Args() {
+		file, err := os.Open(name)
+		if err == nil {
+			err = dump(dumper, file, *hexInput)
+			file.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "msgpackdump: %s: %v\n", name, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+// Prints the values read from the reader and returns the error in their
+// data, if any.
+func dump(dumper *msgpack.Dumper, reader io.Reader, hexInput bool) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	if hexInput {
+		if data, err = hex.DecodeString(strings.Join(strings.Fields(string(data)), "")); err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	fmt.Println(dumper.Format(data))
+	for rest := data; len(rest) > 0; {
+		if rest, err = msgpack.SkipValue(rest); err != nil {
+			return fmt.Errorf("value at offset %d: %w", len(data)-len(rest), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,747 @@
+// Command msgpackgen generates reflection-free msgpack methods for struct
+// types.
+//
+// Usage:
+//
+//	msgpackgen [-o output.go] [-tests=false] file.go
+//
+// Every struct type in file.go whose doc comment contains the line
+//
+//	//msgpack:gen
+//
+// gets MarshalMsgpack, UnmarshalMsgpack and Msgsize methods, written to
+// file_msgpack.go next to the input unless -o is given.  Round-trip tests
+// and benchmarks for the types go to file_msgpack_test.go.  The methods
+// produce the same encoding as Pack: a map from field names (or their
+// "msgpack" tags) to values.  Fields of bool, string, []byte, integer and
+// float types, slices and string-or-number keyed maps of such types,
+// pointers, and other generated types are handled directly; any other
+// field type goes through msgpack.AppendValue and msgpack.ReadValue.
+//
+// It is meant to be run by go generate:
+//
+//	//go:generate msgpackgen $GOFILE
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	IMPORT_PATH = "github.com/msgpack/msgpack-go"
+	ANNOTATION  = "//msgpack:gen"
+)
+
+func main() {
+	output := flag.String("o", "", "output file (default: input file with _msgpack.go suffix)")
+	tests := flag.Bool("tests", true, "generate round-trip tests and benchmarks")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: msgpackgen [-o output.go] [-tests=false] file.go")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	input := flag.Arg(0)
+	if *output == "" {
+		*output = strings.TrimSuffix(input, ".go") + "_msgpack.go"
+	}
+	src, err := os.ReadFile(input)
+	if err != nil {
+		fatal(err)
+	}
+	code, test, err := generate(input, src)
+	if err != nil {
+		fatal(err)
+	}
+	if err := os.WriteFile(*output, code, 0644); err != nil {
+		fatal(err)
+	}
+	if *tests {
+		if err := os.WriteFile(strings.TrimSuffix(*output, ".go")+"_test.go", test, 0644); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "msgpackgen:", err)
+	os.Exit(1)
+}
+
+// How a field type is marshaled.
+type kind int
+
+const (
+	PRIM  kind = iota // bool, string, number or []byte
+	SLICE             // slice of a supported type
+	MAP               // map with a PRIM key
+	PTR               // pointer to a supported type
+	GEN               // struct type generated in the same file
+	VALUE             // anything else, via the reflective path
+)
+
+type fieldType struct {
+	kind kind
+	expr string     // Go type expression
+	prim string     // for PRIM, the suffix of the Read function
+	key  *fieldType // for MAP
+	elem *fieldType // for SLICE, MAP and PTR
+}
+
+type field struct {
+	name string // Go field name
+	key  string // packed key
+	typ  *fieldType
+}
+
+type structType struct {
+	name   string
+	fields []field
+}
+
+// The builtin types handled as PRIM, by the suffix of their Read function.
+var prims = map[string]string{
+	"bool":    "Bool",
+	"string":  "String",
+	"int":     "Int",
+	"int8":    "Int8",
+	"int16":   "Int16",
+	"int32":   "Int32",
+	"rune":    "Int32",
+	"int64":   "Int64",
+	"uint":    "Uint",
+	"uint8":   "Uint8",
+	"byte":    "Uint8",
+	"uint16":  "Uint16",
+	"uint32":  "Uint32",
+	"uint64":  "Uint64",
+	"float32": "Float32",
+	"float64": "Float64",
+}
+
+// Parses src and returns the generated code and tests for its annotated
+// types.
+func generate(filename string, src []byte) (code []byte, test []byte, err error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, nil, err
+	}
+	var specs []*ast.TypeSpec
+	generated := make(map[string]bool)
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if _, ok := ts.Type.(*ast.StructType); !ok || ts.TypeParams != nil {
+				continue
+			}
+			if annotated(ts.Doc) || (len(gen.Specs) == 1 && annotated(gen.Doc)) {
+				specs = append(specs, ts)
+				generated[ts.Name.Name] = true
+			}
+		}
+	}
+	if len(specs) == 0 {
+		return nil, nil, fmt.Errorf("%s: no types annotated with %s", filename, ANNOTATION)
+	}
+	g := &generator{src: src, fset: fset, generated: generated}
+	var types []structType
+	for _, ts := range specs {
+		types = append(types, g.structType(ts))
+	}
+	code, err = g.code(file.Name.Name, types)
+	if err != nil {
+		return nil, nil, err
+	}
+	test, err = g.test(filename, file.Name.Name, types)
+	return code, test, err
+}
+
+func annotated(doc *ast.CommentGroup) bool {
+	if doc == nil {
+		return false
+	}
+	for _, c := range doc.List {
+		if strings.TrimSpace(c.Text) == ANNOTATION {
+			return true
+		}
+	}
+	return false
+}
+
+type generator struct {
+	src       []byte
+	fset      *token.FileSet
+	generated map[string]bool
+}
+
+func (g *generator) structType(ts *ast.TypeSpec) structType {
+	st := structType{name: ts.Name.Name}
+	for _, f := range ts.Type.(*ast.StructType).Fields.List {
+		var tag reflect.StructTag
+		if f.Tag != nil {
+			s, _ := strconv.Unquote(f.Tag.Value)
+			tag = reflect.StructTag(s)
+		}
+		key := tag.Get("msgpack")
+		if key == "-" {
+			continue
+		}
+		typ := g.fieldType(f.Type)
+		// Embedded fields are packed under their type name like by Pack
+		names := f.Names
+		if len(names) == 0 {
+			names = []*ast.Ident{embeddedName(f.Type)}
+		}
+		for _, name := range names {
+			if name == nil || !name.IsExported() {
+				continue
+			}
+			k := key
+			if k == "" {
+				k = name.Name
+			}
+			st.fields = append(st.fields, field{name.Name, k, typ})
+		}
+	}
+	return st
+}
+
+func embeddedName(expr ast.Expr) *ast.Ident {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return e
+	case *ast.StarExpr:
+		return embeddedName(e.X)
+	case *ast.SelectorExpr:
+		return e.Sel
+	}
+	return nil
+}
+
+func (g *generator) fieldType(expr ast.Expr) *fieldType {
+	ft := &fieldType{kind: VALUE, expr: string(g.src[g.fset.Position(expr.Pos()).Offset:g.fset.Position(expr.End()).Offset])}
+	switch e := expr.(type) {
+	case *ast.Ident:
+		if prim, ok := prims[e.Name]; ok {
+			ft.kind, ft.prim = PRIM, prim
+		} else if g.generated[e.Name] {
+			ft.kind = GEN
+		}
+	case *ast.ArrayType:
+		if e.Len != nil {
+			break
+		}
+		if id, ok := e.Elt.(*ast.Ident); ok && (id.Name == "byte" || id.Name == "uint8") {
+			ft.kind, ft.prim = PRIM, "Bytes"
+		} else if elem := g.fieldType(e.Elt); elem.kind != VALUE {
+			ft.kind, ft.elem = SLICE, elem
+		}
+	case *ast.MapType:
+		key, elem := g.fieldType(e.Key), g.fieldType(e.Value)
+		if key.kind == PRIM && key.prim != "Bytes" && elem.kind != VALUE {
+			ft.kind, ft.key, ft.elem = MAP, key, elem
+		}
+	case *ast.StarExpr:
+		if elem := g.fieldType(e.X); elem.kind != VALUE && elem.kind != PTR {
+			ft.kind, ft.elem = PTR, elem
+		}
+	}
+	return ft
+}
+
+// Generates the methods of the given types.
+func (g *generator) code(pkg string, types []structType) ([]byte, error) {
+	var body bytes.Buffer
+	for _, st := range types {
+		g.methods(&body, st)
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by msgpackgen. DO NOT EDIT.\n\npackage %s\n\nimport %q\n", pkg, IMPORT_PATH)
+	buf.Write(body.Bytes())
+	return format.Source(buf.Bytes())
+}
+
+func (g *generator) methods(w *bytes.Buffer, st structType) {
+	fmt.Fprintf(w, `
+// MarshalMsgpack implements msgpack.Marshaler.
+func (z *%[1]s) MarshalMsgpack() ([]byte, error) {
+	size, err := z.Msgsize()
+	if err != nil {
+		return nil, err
+	}
+	return z.appendMsgpack(make([]byte, 0, size))
+}
+
+// UnmarshalMsgpack implements msgpack.Unmarshaler.
+func (z *%[1]s) UnmarshalMsgpack(b []byte) error {
+	_, err := z.readMsgpack(b)
+	return err
+}
+
+// Msgsize returns an upper bound of the packed size of z, or the error
+// packing a field would fail with.
+func (z *%[1]s) Msgsize() (s int, err error) {
+	s = msgpack.MAP_HEADER_SIZE
+`, st.name)
+	for _, f := range st.fields {
+		fmt.Fprintf(w, "s += %d\n", len(f.key)+5)
+		g.size(w, "z."+f.name, f.typ, 0)
+	}
+	fmt.Fprintf(w, `	return s, nil
+}
+
+func (z *%s) appendMsgpack(b []byte) (_ []byte, err error) {
+	b = msgpack.AppendMapHeader(b, %d)
+`, st.name, len(st.fields))
+	for _, f := range st.fields {
+		fmt.Fprintf(w, "b = msgpack.AppendString(b, %q)\n", f.key)
+		g.append(w, "z."+f.name, f.typ, 0)
+	}
+	fmt.Fprintf(w, `	return b, nil
+}
+
+func (z *%[1]s) readMsgpack(b []byte) (_ []byte, err error) {
+	if msgpack.IsNil(b) {
+		*z = %[1]s{}
+		return b[1:], nil
+	}
+	var n int
+	n, b, err = msgpack.ReadMapHeader(b)
+	if err != nil {
+		return b, err
+	}
+	for i := 0; i < n; i++ {
+		var key string
+		if key, b, err = msgpack.ReadString(b); err != nil {
+			// Pack never writes other keys; skip them like Decode
+			if b, err = msgpack.SkipValue(b); err != nil {
+				return b, err
+			}
+			key = ""
+		}
+		switch key {
+`, st.name)
+	for _, f := range st.fields {
+		fmt.Fprintf(w, "case %q:\n", f.key)
+		g.read(w, "z."+f.name, f.typ, 0)
+	}
+	fmt.Fprintf(w, `		default:
+			if b, err = msgpack.SkipValue(b); err != nil {
+				return b, err
+			}
+		}
+	}
+	return b, nil
+}
+`)
+}
+
+var fixedSizes = map[string]string{
+	"Bool":    "msgpack.BOOL_SIZE",
+	"Int":     "msgpack.INT_SIZE",
+	"Int8":    "msgpack.INT_SIZE",
+	"Int16":   "msgpack.INT_SIZE",
+	"Int32":   "msgpack.INT_SIZE",
+	"Int64":   "msgpack.INT_SIZE",
+	"Uint":    "msgpack.UINT_SIZE",
+	"Uint8":   "msgpack.UINT_SIZE",
+	"Uint16":  "msgpack.UINT_SIZE",
+	"Uint32":  "msgpack.UINT_SIZE",
+	"Uint64":  "msgpack.UINT_SIZE",
+	"Float32": "msgpack.FLOAT32_SIZE",
+	"Float64": "msgpack.FLOAT64_SIZE",
+}
+
+// Returns the size of values of a type if it does not depend on the value.
+func fixedSize(ft *fieldType) (string, bool) {
+	if ft.kind != PRIM {
+		return "", false
+	}
+	size, ok := fixedSizes[ft.prim]
+	return size, ok
+}
+
+// Writes statements adding the size of x to s.
+func (g *generator) size(w *bytes.Buffer, x string, ft *fieldType, depth int) {
+	k, v := fmt.Sprint("k", depth), fmt.Sprint("v", depth)
+	switch ft.kind {
+	case PRIM:
+		if size, ok := fixedSize(ft); ok {
+			fmt.Fprintf(w, "s += %s\n", size)
+		} else {
+			fmt.Fprintf(w, "s += msgpack.BYTES_PREFIX_SIZE + len(%s)\n", x)
+		}
+	case SLICE:
+		fmt.Fprintf(w, "s += msgpack.ARRAY_HEADER_SIZE\n")
+		if size, ok := fixedSize(ft.elem); ok {
+			fmt.Fprintf(w, "s += len(%s) * %s\n", x, size)
+			return
+		}
+		fmt.Fprintf(w, "for _, %s := range %s {\n", v, x)
+		g.size(w, v, ft.elem, depth+1)
+		fmt.Fprintf(w, "}\n")
+	case MAP:
+		fmt.Fprintf(w, "s += msgpack.MAP_HEADER_SIZE\n")
+		ksize, kfixed := fixedSize(ft.key)
+		vsize, vfixed := fixedSize(ft.elem)
+		if kfixed && vfixed {
+			fmt.Fprintf(w, "s += len(%s) * (%s + %s)\n", x, ksize, vsize)
+			return
+		}
+		if kfixed {
+			fmt.Fprintf(w, "s += len(%s) * %s\n", x, ksize)
+			k = "_"
+		}
+		if vfixed {
+			fmt.Fprintf(w, "s += len(%s) * %s\n", x, vsize)
+			v = "_"
+		}
+		if v == "_" {
+			fmt.Fprintf(w, "for %s := range %s {\n", k, x)
+		} else {
+			fmt.Fprintf(w, "for %s, %s := range %s {\n", k, v, x)
+		}
+		if !kfixed {
+			g.size(w, k, ft.key, depth+1)
+		}
+		if !vfixed {
+			g.size(w, v, ft.elem, depth+1)
+		}
+		fmt.Fprintf(w, "}\n")
+	case PTR:
+		fmt.Fprintf(w, "if %s == nil {\ns += msgpack.NIL_SIZE\n} else {\n", x)
+		g.size(w, "(*"+x+")", ft.elem, depth)
+		fmt.Fprintf(w, "}\n")
+	case GEN:
+		fmt.Fprintf(w, "if n, err := %s.Msgsize(); err != nil {\nreturn 0, err\n} else {\ns += n\n}\n", x)
+	case VALUE:
+		fmt.Fprintf(w, "if n, err := msgpack.EncodedSize(%s); err != nil {\nreturn 0, err\n} else {\ns += n\n}\n", x)
+	}
+}
+
+var appendFuncs = map[string]string{
+	"Bool":    "AppendBool(b, %s)",
+	"String":  "AppendString(b, %s)",
+	"Bytes":   "AppendBytes(b, %s)",
+	"Int":     "AppendInt64(b, int64(%s))",
+	"Int8":    "AppendInt64(b, int64(%s))",
+	"Int16":   "AppendInt64(b, int64(%s))",
+	"Int32":   "AppendInt64(b, int64(%s))",
+	"Int64":   "AppendInt64(b, %s)",
+	"Uint":    "AppendUint64(b, uint64(%s))",
+	"Uint8":   "AppendUint64(b, uint64(%s))",
+	"Uint16":  "AppendUint64(b, uint64(%s))",
+	"Uint32":  "AppendUint64(b, uint64(%s))",
+	"Uint64":  "AppendUint64(b, %s)",
+	"Float32": "AppendFloat32(b, %s)",
+	"Float64": "AppendFloat64(b, %s)",
+}
+
+// Writes statements appending x to b.
+func (g *generator) append(w *bytes.Buffer, x string, ft *fieldType, depth int) {
+	k, v := fmt.Sprint("k", depth), fmt.Sprint("v", depth)
+	switch ft.kind {
+	case PRIM:
+		fmt.Fprintf(w, "b = msgpack."+appendFuncs[ft.prim]+"\n", x)
+	case SLICE:
+		fmt.Fprintf(w, "b = msgpack.AppendArrayHeader(b, len(%s))\nfor _, %s := range %[1]s {\n", x, v)
+		g.append(w, v, ft.elem, depth+1)
+		fmt.Fprintf(w, "}\n")
+	case MAP:
+		fmt.Fprintf(w, "b = msgpack.AppendMapHeader(b, len(%s))\nfor %s, %s := range %[1]s {\n", x, k, v)
+		g.append(w, k, ft.key, depth+1)
+		g.append(w, v, ft.elem, depth+1)
+		fmt.Fprintf(w, "}\n")
+	case PTR:
+		fmt.Fprintf(w, "if %s == nil {\nb = msgpack.AppendNil(b)\n} else {\n", x)
+		g.append(w, "(*"+x+")", ft.elem, depth)
+		fmt.Fprintf(w, "}\n")
+	case GEN:
+		fmt.Fprintf(w, "if b, err = %s.appendMsgpack(b); err != nil {\nreturn b, err\n}\n", x)
+	case VALUE:
+		fmt.Fprintf(w, "if b, err = msgpack.AppendValue(b, %s); err != nil {\nreturn b, err\n}\n", x)
+	}
+}
+
+// Writes statements reading b into x.
+func (g *generator) read(w *bytes.Buffer, x string, ft *fieldType, depth int) {
+	i, n, k, v := fmt.Sprint("i", depth), fmt.Sprint("n", depth), fmt.Sprint("k", depth), fmt.Sprint("v", depth)
+	switch ft.kind {
+	case PRIM:
+		fmt.Fprintf(w, "if %s, b, err = msgpack.Read%s(b); err != nil {\nreturn b, err\n}\n", x, ft.prim)
+	case SLICE:
+		fmt.Fprintf(w, `if msgpack.IsNil(b) {
+	%[1]s, b = nil, b[1:]
+} else {
+	var %[2]s int
+	if %[2]s, b, err = msgpack.ReadArrayHeader(b); err != nil {
+		return b, err
+	}
+	%[1]s = make(%[3]s, %[2]s)
+	for %[4]s := range %[1]s {
+`, x, n, ft.expr, i)
+		g.read(w, x+"["+i+"]", ft.elem, depth+1)
+		fmt.Fprintf(w, "}\n}\n")
+	case MAP:
+		fmt.Fprintf(w, `if msgpack.IsNil(b) {
+	%[1]s, b = nil, b[1:]
+} else {
+	var %[2]s int
+	if %[2]s, b, err = msgpack.ReadMapHeader(b); err != nil {
+		return b, err
+	}
+	if %[1]s == nil {
+		%[1]s = make(%[3]s, %[2]s)
+	}
+	for %[4]s := 0; %[4]s < %[2]s; %[4]s++ {
+		var %[5]s %[6]s
+		var %[7]s %[8]s
+`, x, n, ft.expr, i, k, ft.key.expr, v, ft.elem.expr)
+		g.read(w, k, ft.key, depth+1)
+		g.read(w, v, ft.elem, depth+1)
+		fmt.Fprintf(w, "%s[%s] = %s\n}\n}\n", x, k, v)
+	case PTR:
+		fmt.Fprintf(w, `if msgpack.IsNil(b) {
+	%[1]s, b = nil, b[1:]
+} else {
+	if %[1]s == nil {
+		%[1]s = new(%[2]s)
+	}
+`, x, ft.elem.expr)
+		g.read(w, "(*"+x+")", ft.elem, depth)
+		fmt.Fprintf(w, "}\n")
+	case GEN:
+		fmt.Fprintf(w, "if b, err = %s.readMsgpack(b); err != nil {\nreturn b, err\n}\n", x)
+	case VALUE:
+		fmt.Fprintf(w, "if b, err = msgpack.ReadValue(b, &%s); err != nil {\nreturn b, err\n}\n", x)
+	}
+}
+
+// Returns the name of the function the tests generated for a file use to
+// pack values by reflection, which is distinct for every input file of a
+// package.
+func plainFunc(filename string) string {
+	name := []rune("plain")
+	upper := true
+	for _, c := range strings.TrimSuffix(filepath.Base(filename), ".go") {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			upper = true
+			continue
+		}
+		if upper {
+			c = unicode.ToUpper(c)
+			upper = false
+		}
+		name = append(name, c)
+	}
+	return string(name)
+}
+
+// Builds Go expressions for populated values of the generated types.
+type sampler struct {
+	types map[string]structType
+	// The generated types being built, which are left empty when nested
+	// in themselves
+	building map[string]bool
+	n        int
+}
+
+// Returns an expression for a populated value of a field type, or "" if
+// its values are unknown.  Every value differs from the others and maps
+// get a single entry, so that iteration order cannot change the packed
+// bytes.
+func (s *sampler) value(ft *fieldType) string {
+	s.n++
+	switch ft.kind {
+	case PRIM:
+		switch ft.prim {
+		case "Bool":
+			return "true"
+		case "String":
+			return strconv.Quote(fmt.Sprint("s", s.n))
+		case "Bytes":
+			return fmt.Sprintf("%s{1, 2, %d}", ft.expr, s.n)
+		case "Int8", "Int16", "Int32", "Int", "Int64":
+			return "-" + s.integer(ft.prim)
+		case "Float32", "Float64":
+			return fmt.Sprint(s.n, ".5")
+		}
+		return s.integer(ft.prim)
+	case SLICE:
+		return ft.expr + "{" + s.value(ft.elem) + "}"
+	case MAP:
+		return ft.expr + "{" + s.value(ft.key) + ": " + s.value(ft.elem) + "}"
+	case PTR:
+		if ft.elem.kind == GEN {
+			return "&" + s.value(ft.elem)
+		}
+		return fmt.Sprintf("func() %s { v := %s(%s); return &v }()", ft.expr, ft.elem.expr, s.value(ft.elem))
+	case GEN:
+		return ft.expr + "{" + s.fields(ft.expr, ", ") + "}"
+	}
+	return ""
+}
+
+// Returns an unsigned integer that needs the width of a type to be packed.
+func (s *sampler) integer(prim string) string {
+	switch strings.TrimPrefix(strings.TrimPrefix(prim, "Int"), "Uint") {
+	case "8":
+		return fmt.Sprint(s.n % 100)
+	case "16":
+		return fmt.Sprint(300 + s.n)
+	case "64":
+		return fmt.Sprint(1<<40 + s.n)
+	}
+	// int and uint may have 32 bits
+	return fmt.Sprint(70000 + s.n)
+}
+
+// Returns the populated fields of a generated type as composite literal
+// elements separated by sep.
+func (s *sampler) fields(name string, sep string) string {
+	if s.building[name] {
+		return ""
+	}
+	s.building[name] = true
+	defer delete(s.building, name)
+	var elems []string
+	for _, f := range s.types[name].fields {
+		if v := s.value(f.typ); v != "" {
+			elems = append(elems, f.name+": "+v)
+		}
+	}
+	return strings.Join(elems, sep)
+}
+
+// Generates round-trip tests and benchmarks of the given types, read from
+// filename.  Each type is tested with its zero value and a populated one,
+// whose packed bytes must be those Pack writes.
+func (g *generator) test(filename string, pkg string, types []structType) ([]byte, error) {
+	plain := plainFunc(filename)
+	s := &sampler{types: make(map[string]structType), building: make(map[string]bool)}
+	for _, st := range types {
+		s.types[st.name] = st
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `// Code generated by msgpackgen. DO NOT EDIT.
+
+package %s
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	%q
+)
+
+// Returns a copy of v, a struct, as a value of an unnamed struct type with
+// the same exported fields.  It has none of the generated methods, not even
+// those of embedded fields, so Pack packs it by reflection.
+func %s(v interface{}) interface{} {
+	value := reflect.ValueOf(v)
+	var fields []reflect.StructField
+	var values []reflect.Value
+	for i := 0; i < value.NumField(); i++ {
+		if f := value.Type().Field(i); f.IsExported() {
+			f.Anonymous = false
+			fields = append(fields, f)
+			values = append(values, value.Field(i))
+		}
+	}
+	p := reflect.New(reflect.StructOf(fields)).Elem()
+	for i, v := range values {
+		p.Field(i).Set(v)
+	}
+	return p.Interface()
+}
+`, pkg, IMPORT_PATH, plain)
+	for _, st := range types {
+		literal := "{}"
+		if fields := s.fields(st.name, ",\n"); fields != "" {
+			literal = "{\n" + fields + ",\n}"
+		}
+		fmt.Fprintf(&buf, `
+func TestMarshalUnmarshal%[1]s(t *testing.T) {
+	for _, v := range []%[1]s{{}, %[2]s} {
+		b, err := v.MarshalMsgpack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size, err := v.Msgsize(); err != nil || len(b) > size {
+			t.Errorf("Msgsize() = %%d, %%v; packed %%d bytes", size, err, len(b))
+		}
+		var buf bytes.Buffer
+		if _, err := msgpack.Pack(&buf, %[3]s(v)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), b) {
+			t.Errorf("MarshalMsgpack() = %%v, Pack wrote %%v", b, buf.Bytes())
+		}
+		p := reflect.New(reflect.TypeOf(%[3]s(v)))
+		if _, err := msgpack.Decode(bytes.NewReader(b), p.Interface()); err != nil {
+			t.Fatal(err)
+		}
+		buf.Reset()
+		if _, err := msgpack.Pack(&buf, p.Elem().Interface()); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), b) {
+			t.Errorf("Decode() changed %%v to %%v", b, buf.Bytes())
+		}
+		var _v %[1]s
+		if err := _v.UnmarshalMsgpack(b); err != nil {
+			t.Fatal(err)
+		}
+		_b, err := _v.MarshalMsgpack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(_b, b) {
+			t.Errorf("round trip changed %%v to %%v", b, _b)
+		}
+		rest, err := msgpack.SkipValue(append(b, msgpack.NIL))
+		if err != nil || len(rest) != 1 {
+			t.Errorf("SkipValue() = %%v, %%v", rest, err)
+		}
+	}
+}
+
+func BenchmarkMarshal%[1]s(b *testing.B) {
+	v := %[1]s{}
+	for i := 0; i < b.N; i++ {
+		v.MarshalMsgpack()
+	}
+}
+
+func BenchmarkUnmarshal%[1]s(b *testing.B) {
+	v := %[1]s{}
+	data, _ := v.MarshalMsgpack()
+	for i := 0; i < b.N; i++ {
+		v.UnmarshalMsgpack(data)
+	}
+}
+`, st.name, literal, plain)
+	}
+	return format.Source(buf.Bytes())
+}
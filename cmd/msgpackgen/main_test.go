@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+func TestGenerate(t *testing.T) {
+	src, err := os.ReadFile("testdata/types.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, test, err := generate("types.go", src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []struct {
+		golden string
+		output []byte
+	}{{"testdata/types_msgpack.go.golden", code}, {"testdata/types_msgpack_test.go.golden", test}} {
+		if *update {
+			if err := os.WriteFile(i.golden, i.output, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := os.ReadFile(i.golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(i.output, expected) {
+			t.Errorf("output differs from %s; run go test -update to see the changes", i.golden)
+		}
+	}
+}
+
+// Builds the golden code in a GOPATH of its own and runs the golden tests,
+// which compare the generated methods with Pack.
+func TestGoldenTests(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go test")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go not found:", err)
+	}
+	root, err := filepath.Abs("../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gopath := t.TempDir()
+	lib := filepath.Join(gopath, "src", filepath.FromSlash(IMPORT_PATH))
+	if err := os.MkdirAll(filepath.Dir(lib), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, lib); err != nil {
+		t.Skip("cannot link the package into GOPATH:", err)
+	}
+	pkg := filepath.Join(gopath, "src", "example")
+	if err := os.MkdirAll(pkg, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for src, dst := range map[string]string{
+		"testdata/types.go":                     "types.go",
+		"testdata/types_msgpack.go.golden":      "types_msgpack.go",
+		"testdata/types_msgpack_test.go.golden": "types_msgpack_test.go",
+		"testdata/errors_test.go":               "errors_test.go",
+	} {
+		data, err := os.ReadFile(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(pkg, dst), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(goTool, "test", "-count=1", ".")
+	cmd.Dir = pkg
+	cmd.Env = append(os.Environ(), "GOPATH="+gopath, "GO111MODULE=off", "GOFLAGS=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("go test: %v\n%s", err, out)
+	}
+}
+
+func TestGenerateUnannotated(t *testing.T) {
+	_, _, err := generate("plain.go", []byte("package plain\n\ntype T struct{}\n"))
+	if err == nil {
+		t.Error("err == nil")
+	}
+}
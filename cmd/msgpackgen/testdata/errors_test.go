@@ -0,0 +1,28 @@
+package example
+
+import (
+	"testing"
+
+	"github.com/msgpack/msgpack-go"
+)
+
+// A field that cannot be packed fails Msgsize and MarshalMsgpack alike,
+// also when it is nested in a generated type.
+func TestMarshalError(t *testing.T) {
+	v := Person{Friend: &Person{Any: complex64(1)}}
+	if size, err := v.Msgsize(); err != msgpack.ErrNoComplexExt {
+		t.Errorf("Msgsize() = %d, %v", size, err)
+	}
+	if b, err := v.MarshalMsgpack(); err != msgpack.ErrNoComplexExt {
+		t.Errorf("MarshalMsgpack() = %v, %v", b, err)
+	}
+}
+
+// A float32 field rejects a float64 beyond its range, as Decode does.
+func TestUnmarshalFloat32Overflow(t *testing.T) {
+	b := msgpack.AppendFloat64(msgpack.AppendString(msgpack.AppendMapHeader(nil, 1), "Ratio"), 1e300)
+	var v Person
+	if err := v.UnmarshalMsgpack(b); err == nil {
+		t.Errorf("UnmarshalMsgpack() = %v, want an error", v.Ratio)
+	}
+}
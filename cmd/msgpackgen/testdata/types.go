@@ -0,0 +1,34 @@
+package example
+
+import "time"
+
+//go:generate msgpackgen $GOFILE
+
+//msgpack:gen
+type Person struct {
+	Name    string `msgpack:"name"`
+	Age     int8
+	Score   float64
+	Ratio   float32
+	Tags    []string
+	Data    []byte
+	Counts  map[string]uint32
+	ByID    map[int64][]int
+	Friend  *Person
+	Friends []Person
+	Home    *Address
+	When    time.Time
+	Any     interface{}
+	Fixed   [2]int
+	private int
+	Skip    bool `msgpack:"-"`
+	Address
+}
+
+//msgpack:gen
+type Address struct {
+	Street string
+	Number uint16
+	Coords map[string]float64
+	Ptrs   []*Address
+}
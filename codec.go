@@ -0,0 +1,589 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Packs a value of the type the function was compiled for.
+type encoderFunc func(enc *Encoder, value reflect.Value) (n int, err error)
+
+// Decodes the rest of a value whose first byte c has already been read into
+// dst, whose type is the one the function was compiled for.
+type decoderFunc func(dec *Decoder, c byte, dst reflect.Value) (n int, err error)
+
+// The compiled encoders and sizers, which depend on the registered
+// extension codecs and types.  Changing those replaces the whole set, so
+// that functions still being compiled from the old registrations are
+// stored in a set nobody uses any more.
+type encoderCaches struct {
+	encoders sync.Map // reflect.Type -> encoderFunc
+	sizers   sync.Map // reflect.Type -> sizerFunc
+}
+
+var (
+	currentEncoderCaches atomic.Value // *encoderCaches
+	decoderCache         sync.Map     // reflect.Type -> decoderFunc
+)
+
+func init() {
+	currentEncoderCaches.Store(&encoderCaches{})
+}
+
+// Drops all compiled encoders and sizers.  This is called with the lock of
+// a registry held, after changing it.
+func resetEncoderCache() {
+	currentEncoderCaches.Store(&encoderCaches{})
+}
+
+func loadEncoderCaches() *encoderCaches {
+	return currentEncoderCaches.Load().(*encoderCaches)
+}
+
+// Returns the encoder for typ, compiling it on first use.
+func encoderFor(typ reflect.Type) encoderFunc {
+	cache := &loadEncoderCaches().encoders
+	if f, ok := cache.Load(typ); ok {
+		return f.(encoderFunc)
+	}
+	// A recursive type reaches here again while it is being compiled.
+	// Hand out an indirect function that waits for the real one.
+	var wg sync.WaitGroup
+	var f encoderFunc
+	wg.Add(1)
+	fi, loaded := cache.LoadOrStore(typ, encoderFunc(func(enc *Encoder, value reflect.Value) (n int, err error) {
+		wg.Wait()
+		return f(enc, value)
+	}))
+	if loaded {
+		return fi.(encoderFunc)
+	}
+	f = compileEncoder(typ)
+	wg.Done()
+	cache.Store(typ, f)
+	return f
+}
+
+// Returns the decoder for typ, compiling it on first use.
+func decoderFor(typ reflect.Type) decoderFunc {
+	if f, ok := decoderCache.Load(typ); ok {
+		return f.(decoderFunc)
+	}
+	var wg sync.WaitGroup
+	var f decoderFunc
+	wg.Add(1)
+	fi, loaded := decoderCache.LoadOrStore(typ, decoderFunc(func(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+		wg.Wait()
+		return f(dec, c, dst)
+	}))
+	if loaded {
+		return fi.(decoderFunc)
+	}
+	f = compileDecoder(typ)
+	wg.Done()
+	decoderCache.Store(typ, f)
+	return f
+}
+
+func implements(typ reflect.Type, iface reflect.Type) bool {
+	return typ.Implements(iface) || reflect.PtrTo(typ).Implements(iface)
+}
+
+func compileEncoder(typ reflect.Type) encoderFunc {
+	if codec := extCodecForGoType(typ); codec != nil {
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return packExtCodec(enc.writer, codec, value)
+		}
+	}
+	if typ == extType {
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return PackExt(enc.writer, int8(value.Field(0).Int()), value.Field(1).Bytes())
+		}
+	}
+	var f encoderFunc
+	if name, ok := nameForType(typ); ok {
+		if typ.Kind() == reflect.Ptr {
+			f = compileStructEncoder(typ.Elem(), name)
+		} else {
+			f = compileStructEncoder(typ, name)
+		}
+	}
+	switch {
+	case typ.Kind() == reflect.Interface:
+		return encodeInterface
+	case implements(typ, marshalerType):
+		f = encodeMarshaler
+	case implements(typ, binaryMarshalerType):
+		f = encodeBinaryMarshaler
+	case implements(typ, textMarshalerType):
+		f = encodeTextMarshaler
+	case f != nil && typ.Kind() == reflect.Ptr:
+		structf := f
+		f = func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return structf(enc, value.Elem())
+		}
+	case f == nil:
+		f = compileKindEncoder(typ)
+	}
+	if typ.Kind() == reflect.Ptr {
+		nonnil := f
+		f = func(enc *Encoder, value reflect.Value) (n int, err error) {
+			if value.IsNil() {
+				return PackNil(enc.writer)
+			}
+			return nonnil(enc, value)
+		}
+	}
+	return f
+}
+
+func encodeInterface(enc *Encoder, value reflect.Value) (n int, err error) {
+	if value.IsNil() {
+		return PackNil(enc.writer)
+	}
+	return enc.PackValue(value.Elem())
+}
+
+func encodeMarshaler(enc *Encoder, value reflect.Value) (n int, err error) {
+	m, _ := valueAs(value, marshalerType)
+	data, err := m.(Marshaler).MarshalMsgpack()
+	if err != nil {
+		return 0, err
+	}
+	return enc.writer.Write(data)
+}
+
+func encodeBinaryMarshaler(enc *Encoder, value reflect.Value) (n int, err error) {
+	m, _ := valueAs(value, binaryMarshalerType)
+	data, err := m.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	return PackBytes(enc.writer, data)
+}
+
+func encodeTextMarshaler(enc *Encoder, value reflect.Value) (n int, err error) {
+	m, _ := valueAs(value, textMarshalerType)
+	data, err := m.(encoding.TextMarshaler).MarshalText()
+	if err != nil {
+		return 0, err
+	}
+	return PackBytes(enc.writer, data)
+}
+
+var (
+	int32SliceType     = reflect.TypeOf([]int32(nil))
+	int64SliceType     = reflect.TypeOf([]int64(nil))
+	intSliceType       = reflect.TypeOf([]int(nil))
+	float64SliceType   = reflect.TypeOf([]float64(nil))
+	stringSliceType    = reflect.TypeOf([]string(nil))
+	stringMapType      = reflect.TypeOf(map[string]string(nil))
+	interfaceMapType   = reflect.TypeOf(map[string]interface{}(nil))
+	interfaceSliceType = reflect.TypeOf([]interface{}(nil))
+)
+
+func compileKindEncoder(typ reflect.Type) encoderFunc {
+	switch typ.Kind() {
+	case reflect.Bool:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return PackBool(enc.writer, value.Bool())
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return PackUint64(enc.writer, value.Uint())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return enc.packInt64(value.Int())
+		}
+	case reflect.Float32:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return PackFloat32(enc.writer, float32(value.Float()))
+		}
+	case reflect.Float64:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return enc.packFloat64(value.Float())
+		}
+	case reflect.Complex64, reflect.Complex128:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return packComplex(enc.writer, value)
+		}
+	case reflect.String:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return PackBytes(enc.writer, Bytes(value.String()))
+		}
+	case reflect.Slice, reflect.Array:
+		return compileArrayEncoder(typ)
+	case reflect.Map:
+		return compileMapEncoder(typ)
+	case reflect.Ptr:
+		elemf := encoderFor(typ.Elem())
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return elemf(enc, value.Elem())
+		}
+	case reflect.Struct:
+		return compileStructEncoder(typ, "")
+	}
+	return func(enc *Encoder, value reflect.Value) (n int, err error) {
+		panic("unsupported type: " + typ.String())
+	}
+}
+
+// Writes b, built in the scratch buffer of the encoder, which is kept for
+// the next slice unless it grew too large.
+func (enc *Encoder) writeScratch(b []byte) (n int, err error) {
+	if cap(b) <= MAX_POOLED_BUFFER {
+		enc.scratch = b
+	}
+	return enc.writer.Write(b)
+}
+
+func compileArrayEncoder(typ reflect.Type) encoderFunc {
+	if typ.Elem().Kind() == reflect.Uint8 {
+		return encodeBytes
+	}
+	elemf := encoderFor(typ.Elem())
+	generic := func(enc *Encoder, value reflect.Value) (n int, err error) {
+		return encodeArray(enc, value, elemf)
+	}
+	// Fast paths for common types, skipping reflection on the elements and
+	// writing them at once
+	switch typ {
+	case int32SliceType:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			if enc.SignedInts {
+				return generic(enc, value)
+			}
+			b := AppendArrayHeader(enc.scratch[:0], value.Len())
+			for _, i := range value.Interface().([]int32) {
+				b = AppendInt64(b, int64(i))
+			}
+			return enc.writeScratch(b)
+		}
+	case int64SliceType:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			if enc.SignedInts {
+				return generic(enc, value)
+			}
+			b := AppendArrayHeader(enc.scratch[:0], value.Len())
+			for _, i := range value.Interface().([]int64) {
+				b = AppendInt64(b, i)
+			}
+			return enc.writeScratch(b)
+		}
+	case intSliceType:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			if enc.SignedInts {
+				return generic(enc, value)
+			}
+			b := AppendArrayHeader(enc.scratch[:0], value.Len())
+			for _, i := range value.Interface().([]int) {
+				b = AppendInt64(b, int64(i))
+			}
+			return enc.writeScratch(b)
+		}
+	case float64SliceType:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			if enc.CompactFloats {
+				return generic(enc, value)
+			}
+			b := AppendArrayHeader(enc.scratch[:0], value.Len())
+			for _, i := range value.Interface().([]float64) {
+				b = AppendFloat64(b, i)
+			}
+			return enc.writeScratch(b)
+		}
+	case stringSliceType:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			s := value.Interface().([]string)
+			n, err = packArrayHeader(enc.writer, len(s))
+			if err != nil {
+				return n, err
+			}
+			for _, i := range s {
+				_n, err := PackBytes(enc.writer, Bytes(i))
+				n += _n
+				if err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+	case interfaceSliceType:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			s := value.Interface().([]interface{})
+			n, err = packArrayHeader(enc.writer, len(s))
+			if err != nil {
+				return n, err
+			}
+			for _, i := range s {
+				_n, err := enc.Pack(i)
+				n += _n
+				if err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+	}
+	return generic
+}
+
+func encodeBytes(enc *Encoder, value reflect.Value) (n int, err error) {
+	if value.Kind() == reflect.Array {
+		data := make(Bytes, value.Len())
+		reflect.Copy(reflect.ValueOf(data), value)
+		return PackBytes(enc.writer, data)
+	}
+	return PackBytes(enc.writer, value.Bytes())
+}
+
+func encodeArray(enc *Encoder, value reflect.Value, elemf encoderFunc) (n int, err error) {
+	n, err = packArrayHeader(enc.writer, value.Len())
+	if err != nil {
+		return n, err
+	}
+	for i := 0; i < value.Len(); i++ {
+		_n, err := elemf(enc, value.Index(i))
+		n += _n
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func compileMapEncoder(typ reflect.Type) encoderFunc {
+	switch typ {
+	case stringMapType:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			m := value.Interface().(map[string]string)
+			n, err = packMapHeader(enc.writer, len(m))
+			if err != nil {
+				return n, err
+			}
+			for k, v := range m {
+				_n, err := PackBytes(enc.writer, Bytes(k))
+				n += _n
+				if err != nil {
+					return n, err
+				}
+				_n, err = PackBytes(enc.writer, Bytes(v))
+				n += _n
+				if err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+	case interfaceMapType:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			m := value.Interface().(map[string]interface{})
+			n, err = packMapHeader(enc.writer, len(m))
+			if err != nil {
+				return n, err
+			}
+			for k, v := range m {
+				_n, err := PackBytes(enc.writer, Bytes(k))
+				n += _n
+				if err != nil {
+					return n, err
+				}
+				_n, err = enc.Pack(v)
+				n += _n
+				if err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+	}
+	keyf, elemf := encoderFor(typ.Key()), encoderFor(typ.Elem())
+	return func(enc *Encoder, value reflect.Value) (n int, err error) {
+		return encodeMap(enc, value, keyf, elemf)
+	}
+}
+
+func encodeMap(enc *Encoder, value reflect.Value, keyf encoderFunc, elemf encoderFunc) (n int, err error) {
+	n, err = packMapHeader(enc.writer, value.Len())
+	if err != nil {
+		return n, err
+	}
+	iter := value.MapRange()
+	for iter.Next() {
+		_n, err := keyf(enc, iter.Key())
+		n += _n
+		if err != nil {
+			return n, err
+		}
+		_n, err = elemf(enc, iter.Value())
+		n += _n
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Compiles an encoder that packs a struct as a map from field names to
+// values, preceded by the type name if it is not empty.  The keys are
+// packed once here.
+func compileStructEncoder(typ reflect.Type, typeName string) encoderFunc {
+	fields := structFields(typ)
+	length := len(fields)
+	var header bytes.Buffer
+	if typeName != "" {
+		length++
+	}
+	packMapHeader(&header, length)
+	if typeName != "" {
+		PackBytes(&header, Bytes(TYPE_KEY))
+		PackBytes(&header, Bytes(typeName))
+	}
+	keys := make([][]byte, len(fields))
+	encs := make([]encoderFunc, len(fields))
+	for i, f := range fields {
+		var key bytes.Buffer
+		PackBytes(&key, Bytes(f.name))
+		keys[i] = key.Bytes()
+		encs[i] = encoderFor(typ.Field(f.index).Type)
+	}
+	return func(enc *Encoder, value reflect.Value) (n int, err error) {
+		n, err = enc.writer.Write(header.Bytes())
+		if err != nil {
+			return n, err
+		}
+		for i, f := range fields {
+			_n, err := enc.writer.Write(keys[i])
+			n += _n
+			if err != nil {
+				return n, err
+			}
+			_n, err = encs[i](enc, value.Field(f.index))
+			n += _n
+			if err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	}
+}
+
+func compileDecoder(typ reflect.Type) decoderFunc {
+	kindf := compileKindDecoder(typ)
+	ptr := reflect.PtrTo(typ)
+	unmarshaler := typ.Kind() != reflect.Ptr && ptr.Implements(unmarshalerType)
+	var rawf decoderFunc
+	if typ.Kind() != reflect.Ptr && ptr.Implements(binaryUnmarshalerType) {
+		rawf = decodeBinaryUnmarshaler
+	} else if typ.Kind() != reflect.Ptr && ptr.Implements(textUnmarshalerType) {
+		rawf = decodeTextUnmarshaler
+	}
+	return func(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+		if c == NIL {
+			dst.Set(reflect.Zero(dst.Type()))
+			return 0, nil
+		}
+		if unmarshaler {
+			return decodeUnmarshaler(dec, c, dst)
+		}
+		if isExtCode(c) {
+			return dec.decodeScalar(c, dst)
+		}
+		if rawf != nil && isRawCode(c) {
+			return rawf(dec, c, dst)
+		}
+		return kindf(dec, c, dst)
+	}
+}
+
+func decodeUnmarshaler(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+	data, n, e := dec.readRawCode(c)
+	if e != nil {
+		return n, e
+	}
+	return n, dst.Addr().Interface().(Unmarshaler).UnmarshalMsgpack(data)
+}
+
+func decodeBinaryUnmarshaler(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+	data, n, e := dec.readRaw(c)
+	if e != nil {
+		return n, e
+	}
+	return n, dst.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+}
+
+func decodeTextUnmarshaler(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+	data, n, e := dec.readRaw(c)
+	if e != nil {
+		return n, e
+	}
+	return n, dst.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(data)
+}
+
+// Reads the payload of a raw value whose first byte c has already been
+// read.  Unlike unpackCode it returns the bytes even when Normalize is set.
+func (dec *Decoder) readRaw(c byte) (data []byte, n int, err error) {
+	length, n, e := dec.readLength(c, FIXRAW, RAW16, RAW32)
+	if e != nil {
+		return nil, n, e
+	}
+	data, _n, e := readBytes(dec.reader, uint64(length))
+	return data, n + _n, e
+}
+
+func compileKindDecoder(typ reflect.Type) decoderFunc {
+	switch typ.Kind() {
+	case reflect.Ptr:
+		elemf := decoderFor(typ.Elem())
+		return func(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+			if dst.IsNil() {
+				dst.Set(reflect.New(dst.Type().Elem()))
+			}
+			return elemf(dec, c, dst.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		elemf := decoderFor(typ.Elem())
+		return func(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+			if isArrayCode(c) {
+				return dec.decodeArray(c, dst, elemf)
+			}
+			return dec.decodeScalar(c, dst)
+		}
+	case reflect.Map:
+		keyf, elemf := decoderFor(typ.Key()), decoderFor(typ.Elem())
+		return func(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+			if isMapCode(c) {
+				return dec.decodeMap(c, dst, keyf, elemf)
+			}
+			return dec.decodeScalar(c, dst)
+		}
+	case reflect.Struct:
+		fields := structFields(typ)
+		byName := make(map[string]int, len(fields))
+		decs := make([]decoderFunc, len(fields))
+		for i, f := range fields {
+			byName[f.name] = i
+			decs[i] = decoderFor(typ.Field(f.index).Type)
+		}
+		return func(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+			if isMapCode(c) {
+				return dec.decodeStruct(c, dst, fields, byName, decs)
+			}
+			return dec.decodeScalar(c, dst)
+		}
+	case reflect.Interface:
+		return func(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+			if (isMapCode(c) || isArrayCode(c)) && haveRegisteredTypes() {
+				return dec.decodeInterface(c, dst)
+			}
+			return dec.decodeScalar(c, dst)
+		}
+	}
+	return func(dec *Decoder, c byte, dst reflect.Value) (n int, err error) {
+		return dec.decodeScalar(c, dst)
+	}
+}
@@ -0,0 +1,316 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The msgpack-test-suite vectors, as described in testdata/README.
+const conformanceFile = "testdata/msgpack-test-suite.json"
+
+// A test vector from the msgpack-test-suite.  The file maps the name of
+// each group to a list of entries, each holding a value under a key naming
+// its kind and all of its encodings under "msgpack", as hex bytes
+// separated by dashes.  The first encoding is the shortest one.
+type conformanceVector struct {
+	name    string
+	value   interface{} // as produced by a normalizing decoder
+	msgpack [][]byte
+}
+
+// Reports whether an encoding uses a format of the current msgpack spec
+// that this package does not implement: str8 or the bin formats.
+func isNewSpecEncoding(data []byte) bool {
+	return len(data) > 0 && (data[0] == 0xd9 || (data[0] >= 0xc4 && data[0] <= 0xc6))
+}
+
+func loadConformanceVectors(t *testing.T) []conformanceVector {
+	data, err := os.ReadFile(conformanceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var groups map[string][]map[string]interface{}
+	if err := dec.Decode(&groups); err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var vectors []conformanceVector
+	for _, group := range names {
+		for i, entry := range groups[group] {
+			vector := conformanceVector{name: group + "#" + strconv.Itoa(i)}
+			for _, s := range entry["msgpack"].([]interface{}) {
+				data, err := hex.DecodeString(strings.ReplaceAll(s.(string), "-", ""))
+				if err != nil {
+					t.Fatalf("%s: %v", vector.name, err)
+				}
+				if !isNewSpecEncoding(data) {
+					vector.msgpack = append(vector.msgpack, data)
+				}
+			}
+			if len(vector.msgpack) == 0 {
+				continue
+			}
+			skip := false
+			for kind, value := range entry {
+				switch kind {
+				case "msgpack":
+				case "nil", "bool", "number", "string", "array", "map":
+					vector.value = vectorValue(value)
+				case "bignum":
+					vector.value = vectorValue(json.Number(value.(string)))
+				case "ext":
+					ext := value.([]interface{})
+					typ, _ := ext[0].(json.Number).Int64()
+					data, err := hex.DecodeString(strings.ReplaceAll(ext[1].(string), "-", ""))
+					if err != nil {
+						t.Fatalf("%s: %v", vector.name, err)
+					}
+					vector.value = Ext{int8(typ), data}
+				case "timestamp":
+					// Not implemented here; unpacked as Ext
+					skip = true
+				default:
+					t.Fatalf("%s: unknown kind %q", vector.name, kind)
+				}
+			}
+			if !skip {
+				vectors = append(vectors, vector)
+			}
+		}
+	}
+	return vectors
+}
+
+// Converts a value decoded from JSON to the types of a normalizing decoder.
+func vectorValue(value interface{}) interface{} {
+	switch _value := value.(type) {
+	case json.Number:
+		if i, err := _value.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(_value.String(), 10, 64); err == nil {
+			return u
+		}
+		f, _ := _value.Float64()
+		return f
+	case []interface{}:
+		elems := make([]interface{}, len(_value))
+		for i, elem := range _value {
+			elems[i] = vectorValue(elem)
+		}
+		return elems
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(_value))
+		for k, elem := range _value {
+			m[k] = vectorValue(elem)
+		}
+		return m
+	}
+	return value
+}
+
+// Compares an unpacked value with the value of a vector.  Numbers are
+// compared by value, since the vectors list the float encodings of
+// integers too.
+func vectorEqual(v interface{}, expected interface{}) bool {
+	switch _expected := expected.(type) {
+	case int64, uint64, float64:
+		return numberValue(v) == numberValue(expected)
+	case []interface{}:
+		elems, ok := v.([]interface{})
+		if !ok || len(elems) != len(_expected) {
+			return false
+		}
+		for i := range elems {
+			if !vectorEqual(elems[i], _expected[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		m, ok := v.(map[string]interface{})
+		if !ok || len(m) != len(_expected) {
+			return false
+		}
+		for k, elem := range _expected {
+			if _, ok := m[k]; !ok || !vectorEqual(m[k], elem) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(v, expected)
+}
+
+func numberValue(v interface{}) interface{} {
+	switch _v := v.(type) {
+	case int64:
+		if _v >= 0 {
+			return uint64(_v)
+		}
+	case float64:
+		if _v >= -1<<63 && _v < 1<<63 && _v == float64(int64(_v)) {
+			return numberValue(int64(_v))
+		}
+		if _v >= 0 && _v < 1<<64 && _v == float64(uint64(_v)) {
+			return uint64(_v)
+		}
+	}
+	return v
+}
+
+func TestConformanceUnpack(t *testing.T) {
+	for _, vector := range loadConformanceVectors(t) {
+		for _, data := range vector.msgpack {
+			dec := NewDecoder(bytes.NewReader(data))
+			dec.Normalize = true
+			v, n, err := dec.Unpack()
+			if err != nil || n != len(data) || !vectorEqual(valueInterface(v), vector.value) {
+				t.Errorf("%s: Unpack(%x) = %v, %d, %v", vector.name, data, valueInterface(v), n, err)
+			}
+			if n, err := Skip(bytes.NewReader(data)); err != nil || n != len(data) {
+				t.Errorf("%s: Skip(%x) = %d, %v", vector.name, data, n, err)
+			}
+		}
+	}
+}
+
+func TestConformancePack(t *testing.T) {
+	for _, vector := range loadConformanceVectors(t) {
+		data, err := Marshal(vector.value)
+		if err != nil {
+			t.Errorf("%s: %v", vector.name, err)
+			continue
+		}
+		expected := vector.msgpack[0]
+		if _, ok := vector.value.(float64); ok {
+			// Pack keeps floats in double precision unless CompactFloats
+			// is set, which picks the shortest encoding
+			b := &bytes.Buffer{}
+			enc := Encoder{CompactFloats: true}
+			enc.Reset(b)
+			if _, err := enc.Pack(vector.value); err != nil || !bytes.Equal(b.Bytes(), expected) {
+				t.Errorf("%s: Pack with CompactFloats = %x, %v, want %x", vector.name, b.Bytes(), err, expected)
+			}
+			for _, encoding := range vector.msgpack {
+				if encoding[0] == DOUBLE {
+					expected = encoding
+				}
+			}
+		}
+		if m, ok := vector.value.(map[string]interface{}); ok && len(m) > 1 {
+			// The order of the entries is not defined, so only the length
+			// is compared before unpacking the result
+			dec := NewDecoder(bytes.NewReader(data))
+			dec.Normalize = true
+			if v, _, err := dec.Unpack(); len(data) != len(expected) || err != nil || !vectorEqual(v.Interface(), vector.value) {
+				t.Errorf("%s: Pack = %x, want %x", vector.name, data, expected)
+			}
+			continue
+		}
+		if !bytes.Equal(data, expected) {
+			t.Errorf("%s: Pack = %x, want %x", vector.name, data, expected)
+		}
+	}
+}
+
+// The vectors have no values at the length boundaries of the raw, array
+// and ext formats.  The headers here are written out from the spec: the
+// first one is what Pack produces, and all of them unpack.
+func TestConformanceLengths(t *testing.T) {
+	raw := func(length int) interface{} { return strings.Repeat("x", length) }
+	array := func(length int) interface{} { return make([]interface{}, length) }
+	ext := func(length int) interface{} { return Ext{1, make([]byte, length)} }
+	for _, test := range []struct {
+		value   func(length int) interface{}
+		length  int
+		headers []Bytes
+		elem    byte // of the data following the header
+	}{
+		{raw, 0, []Bytes{{0xa0}, {RAW16, 0, 0}, {RAW32, 0, 0, 0, 0}}, 'x'},
+		{raw, 31, []Bytes{{0xbf}, {RAW16, 0, 31}, {RAW32, 0, 0, 0, 31}}, 'x'},
+		{raw, 32, []Bytes{{RAW16, 0, 32}, {RAW32, 0, 0, 0, 32}}, 'x'},
+		{raw, 300, []Bytes{{RAW16, 0x01, 0x2c}, {RAW32, 0, 0, 0x01, 0x2c}}, 'x'},
+		{raw, 65535, []Bytes{{RAW16, 0xff, 0xff}, {RAW32, 0, 0, 0xff, 0xff}}, 'x'},
+		{raw, 65536, []Bytes{{RAW32, 0, 1, 0, 0}}, 'x'},
+		{array, 0, []Bytes{{0x90}, {ARRAY16, 0, 0}, {ARRAY32, 0, 0, 0, 0}}, NIL},
+		{array, 15, []Bytes{{0x9f}, {ARRAY16, 0, 15}, {ARRAY32, 0, 0, 0, 15}}, NIL},
+		{array, 16, []Bytes{{ARRAY16, 0, 16}, {ARRAY32, 0, 0, 0, 16}}, NIL},
+		{array, 300, []Bytes{{ARRAY16, 0x01, 0x2c}, {ARRAY32, 0, 0, 0x01, 0x2c}}, NIL},
+		{array, 65535, []Bytes{{ARRAY16, 0xff, 0xff}, {ARRAY32, 0, 0, 0xff, 0xff}}, NIL},
+		{array, 65536, []Bytes{{ARRAY32, 0, 1, 0, 0}}, NIL},
+		{ext, 0, []Bytes{{EXT8, 0, 1}, {EXT16, 0, 0, 1}, {EXT32, 0, 0, 0, 0, 1}}, 0},
+		{ext, 1, []Bytes{{FIXEXT1, 1}, {EXT8, 1, 1}}, 0},
+		{ext, 2, []Bytes{{FIXEXT2, 1}, {EXT8, 2, 1}}, 0},
+		{ext, 3, []Bytes{{EXT8, 3, 1}, {EXT16, 0, 3, 1}}, 0},
+		{ext, 4, []Bytes{{FIXEXT4, 1}, {EXT8, 4, 1}}, 0},
+		{ext, 8, []Bytes{{FIXEXT8, 1}, {EXT8, 8, 1}}, 0},
+		{ext, 16, []Bytes{{FIXEXT16, 1}, {EXT8, 16, 1}}, 0},
+		{ext, 255, []Bytes{{EXT8, 0xff, 1}, {EXT16, 0, 0xff, 1}}, 0},
+		{ext, 256, []Bytes{{EXT16, 0x01, 0x00, 1}, {EXT32, 0, 0, 0x01, 0x00, 1}}, 0},
+		{ext, 65535, []Bytes{{EXT16, 0xff, 0xff, 1}, {EXT32, 0, 0, 0xff, 0xff, 1}}, 0},
+		{ext, 65536, []Bytes{{EXT32, 0, 1, 0, 0, 1}}, 0},
+	} {
+		value := test.value(test.length)
+		elems := bytes.Repeat([]byte{test.elem}, test.length)
+		name := fmt.Sprintf("%x/%d", test.headers[0][0], test.length)
+		data, err := Marshal(value)
+		if expected := append(append(Bytes{}, test.headers[0]...), elems...); err != nil || !bytes.Equal(data, expected) {
+			t.Errorf("%s: Pack = %.16x..., %v, want %.16x...", name, data, err, expected)
+		}
+		for _, header := range test.headers {
+			data := append(append(Bytes{}, header...), elems...)
+			dec := NewDecoder(bytes.NewReader(data))
+			dec.Normalize = true
+			v, n, err := dec.Unpack()
+			if err != nil || n != len(data) || !reflect.DeepEqual(valueInterface(v), value) {
+				t.Errorf("%s: Unpack(%x...) = %d, %v", name, header, n, err)
+			}
+			if n, err := Skip(bytes.NewReader(data)); err != nil || n != len(data) {
+				t.Errorf("%s: Skip(%x...) = %d, %v", name, header, n, err)
+			}
+		}
+	}
+}
+
+// The boundaries of map16 and map32 have too many distinct keys for a
+// table.
+func TestConformanceMapLengths(t *testing.T) {
+	for _, length := range []int{MAX16BIT - 1, MAX16BIT} {
+		m := make(map[string]interface{}, length)
+		for i := 0; i < length; i++ {
+			m[strconv.Itoa(i)] = nil
+		}
+		data, err := Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := Bytes{MAP16, 0xff, 0xff}
+		if length == MAX16BIT {
+			header = Bytes{MAP32, 0, 1, 0, 0}
+		}
+		if !bytes.HasPrefix(data, header) {
+			t.Errorf("Pack(map of %d entries) = %x...", length, data[:8])
+		}
+		dec := NewDecoder(bytes.NewReader(data))
+		dec.Normalize = true
+		v, n, err := dec.Unpack()
+		if err != nil || n != len(data) || !reflect.DeepEqual(v.Interface(), m) {
+			t.Errorf("Unpack(map of %d entries) = %d, %v", length, n, err)
+		}
+	}
+}
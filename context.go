@@ -0,0 +1,112 @@
+package msgpack
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// Returns a new decoder that reads from the specified reader until ctx is
+// done.  The decoder checks ctx before every value, including the elements
+// of arrays and maps, and a read blocked on the reader returns as soon as
+// ctx is done.  In either case the decoder fails with ctx.Err().  Readers
+// with a SetReadDeadline method, such as net.Conn, are interrupted through
+// their deadline; other readers are read from a separate goroutine, which
+// stays blocked in the reader until it returns.  The decoder buffers its
+// input, so it may read past the last value it returns.
+func NewDecoderContext(ctx context.Context, reader io.Reader) *Decoder {
+	contextReader := &contextReader{ctx: ctx, reader: reader}
+	counter := &countingReader{reader: bufio.NewReader(contextReader)}
+	return &Decoder{reader: counter, ctx: ctx, counter: counter, contextReader: contextReader}
+}
+
+// Sets the read deadline of a reader with a SetReadDeadline method, such as
+// net.Conn, that a decoder returned by NewDecoderContext reads from.  The
+// decoder restores this deadline after interrupting a read when its context
+// is done; deadlines set on the reader directly are replaced by no deadline.
+// Returns os.ErrNoDeadline for other readers and decoders.
+func (dec *Decoder) SetReadDeadline(t time.Time) error {
+	if dec.contextReader == nil {
+		return os.ErrNoDeadline
+	}
+	reader, ok := dec.contextReader.reader.(deadlineReader)
+	if !ok {
+		return os.ErrNoDeadline
+	}
+	if err := reader.SetReadDeadline(t); err != nil {
+		return err
+	}
+	dec.contextReader.deadline = t
+	return nil
+}
+
+func (dec *Decoder) checkContext() error {
+	if dec.ctx == nil {
+		return nil
+	}
+	return dec.ctx.Err()
+}
+
+type deadlineReader interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
+// A reader whose reads return ctx.Err() once ctx is done.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+	// The deadline to restore after interrupting a read
+	deadline time.Time
+	// Read into by the goroutine of readers without deadlines.  Once ctx
+	// is done no read reaches that goroutine again, so a read still
+	// blocked then is the only one writing to it.
+	buf []byte
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (r *contextReader) Read(p []byte) (n int, err error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if r.ctx.Done() == nil {
+		return r.reader.Read(p)
+	}
+	if reader, ok := r.reader.(deadlineReader); ok {
+		interrupted := make(chan struct{})
+		stop := context.AfterFunc(r.ctx, func() {
+			reader.SetReadDeadline(time.Now())
+			close(interrupted)
+		})
+		n, err = reader.Read(p)
+		if !stop() {
+			// The deadline may have interrupted the read
+			<-interrupted
+			reader.SetReadDeadline(r.deadline)
+			return n, r.ctx.Err()
+		}
+		return n, err
+	}
+	// The read may finish after ctx is done, so it must not write to p
+	if len(r.buf) < len(p) {
+		r.buf = make([]byte, len(p))
+	}
+	buf := r.buf[:len(p)]
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := r.reader.Read(buf)
+		done <- readResult{n, err}
+	}()
+	select {
+	case result := <-done:
+		return copy(p, buf[:result.n]), result.err
+	case <-r.ctx.Done():
+		return 0, r.ctx.Err()
+	}
+}
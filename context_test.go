@@ -0,0 +1,104 @@
+package msgpack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDecoderContext(t *testing.T) {
+	for _, pipe := range []func() (io.Reader, io.WriteCloser){
+		func() (io.Reader, io.WriteCloser) { return io.Pipe() },
+		func() (io.Reader, io.WriteCloser) { return net.Pipe() },
+	} {
+		r, w := pipe()
+		// Deliver the start of an array and never the rest of it
+		go w.Write(Bytes{0x93, 1})
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+		done := make(chan error, 1)
+		go func() {
+			_, _, err := NewDecoderContext(ctx, r).Unpack()
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("%T: err != context.Canceled: %v", r, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%T: decoder not cancelled", r)
+		}
+		w.Close()
+	}
+}
+
+func TestDecoderContextDeadline(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	dec := NewDecoderContext(ctx, r)
+	deadline := time.Now().Add(time.Second)
+	if err := dec.SetReadDeadline(deadline); err != nil {
+		t.Fatal("SetReadDeadline", err)
+	}
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, _, err := dec.Unpack(); err != context.Canceled {
+		t.Fatal("err != context.Canceled", err)
+	}
+
+	// The connection is usable until the deadline, and no longer
+	go w.Write(Bytes{0x92, 1, 2})
+	v, _, err := NewDecoder(r).Unpack()
+	if err != nil || v.Len() != 2 {
+		t.Error("Unpack after cancellation", v, err)
+	}
+	if _, err := r.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) || time.Now().Before(deadline) {
+		t.Error("deadline not restored", err)
+	}
+
+	if err := NewDecoder(r).SetReadDeadline(deadline); err != os.ErrNoDeadline {
+		t.Error("err != os.ErrNoDeadline", err)
+	}
+}
+
+func TestDecoderContextBetweenElements(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dec := NewDecoderContext(ctx, bytes.NewReader(Bytes{0x92, 1, 2, 0x92, 1, 2}))
+	var v []int
+	if _, err := dec.Decode(&v); err != nil || len(v) != 2 {
+		t.Error("Decode", v, err)
+	}
+	cancel()
+	if _, err := dec.Decode(&v); err != context.Canceled {
+		t.Error("err != context.Canceled", err)
+	}
+	if _, err := dec.Skip(); err != context.Canceled {
+		t.Error("err != context.Canceled", err)
+	}
+
+	// A value arriving in full still fails once the context is done
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	v = nil
+	dec = NewDecoderContext(ctx, &cancellingReader{bytes.NewReader(Bytes{0x93, 1, 2, 3}), cancel})
+	if _, err := dec.Decode(&v); !errors.Is(err, context.Canceled) {
+		t.Error("err != context.Canceled", v, err)
+	}
+}
+
+// Cancels a context after the first read.
+type cancellingReader struct {
+	reader io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(p []byte) (n int, err error) {
+	defer r.cancel()
+	return r.reader.Read(p)
+}
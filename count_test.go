@@ -0,0 +1,148 @@
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Returns a random value of the kinds Pack supports, nested up to depth
+// levels, with lengths around the boundaries of the fixed formats.
+func randomValue(r *rand.Rand, depth int) interface{} {
+	kinds := 20
+	if depth <= 0 {
+		kinds = 16
+	}
+	shift := uint(r.Intn(64))
+	switch r.Intn(kinds) {
+	case 0:
+		return nil
+	case 1:
+		return r.Intn(2) == 0
+	case 2:
+		return uint8(r.Uint64() >> shift)
+	case 3:
+		return uint16(r.Uint64() >> shift)
+	case 4:
+		return uint32(r.Uint64() >> shift)
+	case 5:
+		return r.Uint64() >> shift
+	case 6:
+		return int8(r.Int63() >> shift * int64(1-2*r.Intn(2)))
+	case 7:
+		return int16(r.Int63() >> shift * int64(1-2*r.Intn(2)))
+	case 8:
+		return int32(r.Int63() >> shift * int64(1-2*r.Intn(2)))
+	case 9:
+		return r.Int63() >> shift * int64(1-2*r.Intn(2))
+	case 10:
+		return float32(r.NormFloat64())
+	case 11:
+		return r.NormFloat64() * math.Pow(2, float64(r.Intn(200)-100))
+	case 12:
+		return strings.Repeat("x", r.Intn(300))
+	case 13:
+		return make([]byte, r.Intn(300))
+	case 14:
+		return complex(r.Float32(), r.Float32())
+	case 15:
+		// Outside the types of the built-in codecs
+		return Ext{int8(0x20 + r.Intn(100)), make([]byte, r.Intn(300))}
+	case 16:
+		s := make([]int16, r.Intn(20))
+		for i := range s {
+			s[i] = int16(r.Int63() >> (shift + 48))
+		}
+		return s
+	case 17:
+		s := make([]uint32, r.Intn(20))
+		for i := range s {
+			s[i] = uint32(r.Uint64() >> (shift + 32))
+		}
+		return s
+	case 18:
+		s := make([]interface{}, r.Intn(20))
+		for i := range s {
+			s[i] = randomValue(r, depth-1)
+		}
+		return s
+	}
+	m := make(map[string]interface{})
+	for i := r.Intn(20); i > 0; i-- {
+		m[strings.Repeat("k", r.Intn(10))+string(rune('a'+i))] = randomValue(r, depth-1)
+	}
+	return m
+}
+
+func TestPackByteCounts(t *testing.T) {
+	registerComplexExt(t)
+	r := rand.New(rand.NewSource(1))
+	for _, options := range []Encoder{{}, {CompactFloats: true}, {SignedInts: true}} {
+		for i := 0; i < 500; i++ {
+			value := randomValue(r, 3)
+			b := &bytes.Buffer{}
+			enc := options
+			enc.Reset(b)
+			if n, err := enc.Pack(value); err != nil || n != b.Len() {
+				t.Fatalf("Pack(%T %.40v) = %d, %v; wrote %d bytes", value, value, n, err, b.Len())
+			}
+		}
+	}
+}
+
+func TestUnpackByteCounts(t *testing.T) {
+	registerComplexExt(t)
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 500; i++ {
+		value := randomValue(r, 3)
+		data, err := Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every prefix of the data as well as the whole, so that the
+		// counts are checked on the error paths too
+		for length := len(data); length >= 0 && length > len(data)-50; length-- {
+			check := func(name string, read func(reader io.Reader) (n int, err error)) {
+				reader := bytes.NewReader(data[:length])
+				n, err := read(reader)
+				if consumed := length - reader.Len(); n != consumed {
+					t.Fatalf("%s(%x) = %d, %v; consumed %d bytes", name, data[:length], n, err, consumed)
+				}
+				if length == len(data) && err != nil {
+					t.Fatalf("%s(%x): %v", name, data, err)
+				}
+			}
+			check("Unpack", func(reader io.Reader) (n int, err error) {
+				_, n, err = NewDecoder(reader).Unpack()
+				return n, err
+			})
+			check("UnpackNode", func(reader io.Reader) (n int, err error) {
+				_, n, err = NewDecoder(reader).UnpackNode()
+				return n, err
+			})
+			check("Skip", Skip)
+			check("Decode", func(reader io.Reader) (n int, err error) {
+				var v interface{}
+				return Decode(reader, &v)
+			})
+		}
+	}
+}
+
+func TestDecodeByteCounts(t *testing.T) {
+	data, err := Marshal(benchValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for length := len(data); length >= 0; length-- {
+		reader := bytes.NewReader(data[:length])
+		var v benchRecord
+		n, err := Decode(reader, &v)
+		if consumed := length - reader.Len(); n != consumed || (length == len(data) && err != nil) {
+			t.Fatalf("Decode(%x) = %d, %v; consumed %d bytes", data[:length], n, err, consumed)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package msgpack
+
+import (
+	"encoding"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+)
+
+// An Unmarshaler unpacks itself from a msgpack value.  The data passed to
+// UnmarshalMsgpack is the complete packed value.
+type Unmarshaler interface {
+	UnmarshalMsgpack(data []byte) error
+}
+
+// A TypeError describes an unpacked value that cannot be stored in a Go
+// value of a specific type.
+type TypeError struct {
+	Value string       // description of the unpacked value
+	Type  reflect.Type // type of the Go value it could not be stored in
+}
+
+func (e *TypeError) Error() string {
+	return "cannot unpack " + e.Value + " into Go value of type " + e.Type.String()
+}
+
+var ErrInvalidDecodeTarget = errors.New("Decode target must be a non-nil pointer")
+
+var (
+	unmarshalerType       = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+	textUnmarshalerType   = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Reads a value from the decoder's reader and stores it in the value
+// pointed to by v.  Arrays and maps are unpacked element by element into
+// slices, arrays and maps of v's type, and maps into structs by field name;
+// a map stored in an interface becomes a value of the registered type named
+// under TYPE_KEY, if that is its first key, as Pack writes it.  Scalars are converted to v's type when that can
+// be done without overflow.  A nil value sets the target to its zero value.
+// Types implementing Unmarshaler receive the packed value; otherwise types
+// implementing encoding.BinaryUnmarshaler or encoding.TextUnmarshaler
+// receive the contents of a raw value.
+func (dec *Decoder) Decode(v interface{}) (n int, err error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return 0, ErrInvalidDecodeTarget
+	}
+	start := dec.begin()
+	n, err = dec.decodeValue(rv.Elem())
+	return n, dec.wrapError(start, err)
+}
+
+// Reads a value from the reader and stores it in the value pointed to by v.
+func Decode(reader io.Reader, v interface{}) (n int, err error) {
+	return NewDecoder(reader).Decode(v)
+}
+
+func (dec *Decoder) decodeValue(dst reflect.Value) (n int, err error) {
+	if e := dec.checkContext(); e != nil {
+		return 0, e
+	}
+	c, e := readByte(dec.reader)
+	if e != nil {
+		return 0, e
+	}
+	dec.code, dec.typ = c, dst.Type()
+	n, err = dec.decodeCode(c, dst)
+	return 1 + n, err
+}
+
+// Decodes the rest of a value whose first byte c has already been read.
+// The decoder for each type is built once and cached.
+func (dec *Decoder) decodeCode(c byte, dst reflect.Value) (n int, err error) {
+	return decoderFor(dst.Type())(dec, c, dst)
+}
+
+func (dec *Decoder) decodeScalar(c byte, dst reflect.Value) (n int, err error) {
+	v, n, e := dec.unpackCode(c, false)
+	if e != nil {
+		return n, e
+	}
+	return n, assign(dst, v)
+}
+
+func (dec *Decoder) decodeArray(c byte, dst reflect.Value, elemf decoderFunc) (n int, err error) {
+	length, n, e := dec.readLength(c, FIXARRAY, ARRAY16, ARRAY32)
+	if e != nil {
+		return n, e
+	}
+	if e := dec.enter(); e != nil {
+		return n, e
+	}
+	defer dec.leave()
+	if dst.Kind() == reflect.Slice {
+		// Longer slices grow as their elements arrive
+		dst.Set(reflect.MakeSlice(dst.Type(), preallocLen(length), preallocLen(length)))
+	}
+	var i uint
+	for i = 0; i < length; i++ {
+		var _n int
+		dec.pushIndex(int(i))
+		if dst.Kind() == reflect.Slice && int(i) == dst.Len() {
+			dst.Set(reflect.Append(dst, reflect.Zero(dst.Type().Elem())))
+		}
+		if int(i) < dst.Len() {
+			_n, e = dec.decodeElem(dst.Index(int(i)), elemf)
+		} else {
+			_n, e = dec.skip()
+		}
+		n += _n
+		if e != nil {
+			return n, e
+		}
+		dec.pop()
+	}
+	for i := int(length); i < dst.Len(); i++ {
+		dst.Index(i).Set(reflect.Zero(dst.Type().Elem()))
+	}
+	return n, nil
+}
+
+func (dec *Decoder) decodeMap(c byte, dst reflect.Value, keyf decoderFunc, elemf decoderFunc) (n int, err error) {
+	length, n, e := dec.readLength(c, FIXMAP, MAP16, MAP32)
+	if e != nil {
+		return n, e
+	}
+	if e := dec.enter(); e != nil {
+		return n, e
+	}
+	defer dec.leave()
+	if dst.IsNil() {
+		dst.Set(reflect.MakeMap(dst.Type()))
+	}
+	var i uint
+	for i = 0; i < length; i++ {
+		k := reflect.New(dst.Type().Key()).Elem()
+		_n, e := dec.decodeElem(k, keyf)
+		n += _n
+		if e != nil {
+			return n, e
+		}
+		v := reflect.New(dst.Type().Elem()).Elem()
+		dec.pushKey(k)
+		_n, e = dec.decodeElem(v, elemf)
+		n += _n
+		if e != nil {
+			return n, e
+		}
+		dec.pop()
+		dst.SetMapIndex(k, v)
+	}
+	return n, nil
+}
+
+// Reads a value and decodes it into dst with the decoder of its type.
+func (dec *Decoder) decodeElem(dst reflect.Value, f decoderFunc) (n int, err error) {
+	if e := dec.checkContext(); e != nil {
+		return 0, e
+	}
+	c, e := readByte(dec.reader)
+	if e != nil {
+		return 0, e
+	}
+	dec.code, dec.typ = c, dst.Type()
+	n, err = f(dec, c, dst)
+	return 1 + n, err
+}
+
+// Reads the length of an array or map whose first byte c has already been
+// read.
+func (dec *Decoder) readLength(c byte, fix byte, code16 byte, code32 byte) (length uint, n int, err error) {
+	switch c {
+	case code16:
+		l, n, e := readUint16(dec.reader)
+		return uint(l), n, e
+	case code32:
+		l, n, e := readUint32(dec.reader)
+		return uint(l), n, e
+	}
+	return uint(c - fix), 0, nil
+}
+
+// Stores an unpacked value in dst, converting it to dst's type.
+func assign(dst reflect.Value, v reflect.Value) error {
+	if !v.IsValid() {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	if v.Type().AssignableTo(dst.Type()) {
+		dst.Set(v)
+		return nil
+	}
+	switch dst.Kind() {
+	case reflect.Bool:
+		if v.Kind() == reflect.Bool {
+			dst.SetBool(v.Bool())
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch v.Kind() {
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if !dst.OverflowInt(v.Int()) {
+				dst.SetInt(v.Int())
+				return nil
+			}
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if v.Uint() <= math.MaxInt64 && !dst.OverflowInt(int64(v.Uint())) {
+				dst.SetInt(int64(v.Uint()))
+				return nil
+			}
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch v.Kind() {
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.Int() >= 0 && !dst.OverflowUint(uint64(v.Int())) {
+				dst.SetUint(uint64(v.Int()))
+				return nil
+			}
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if !dst.OverflowUint(v.Uint()) {
+				dst.SetUint(v.Uint())
+				return nil
+			}
+		}
+	case reflect.Float32, reflect.Float64:
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			if f := v.Float(); dst.Kind() == reflect.Float64 || !overflowFloat32(f) {
+				dst.SetFloat(f)
+				return nil
+			}
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			dst.SetFloat(float64(v.Int()))
+			return nil
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			dst.SetFloat(float64(v.Uint()))
+			return nil
+		}
+	case reflect.Complex64, reflect.Complex128:
+		switch v.Kind() {
+		case reflect.Complex64, reflect.Complex128:
+			x := v.Complex()
+			if dst.Kind() == reflect.Complex128 || !(overflowFloat32(real(x)) || overflowFloat32(imag(x))) {
+				dst.SetComplex(x)
+				return nil
+			}
+		}
+	case reflect.String:
+		if b, ok := rawBytes(v); ok {
+			dst.SetString(string(b))
+			return nil
+		}
+	case reflect.Slice:
+		if b, ok := rawBytes(v); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes(b)
+			return nil
+		}
+	case reflect.Array:
+		if b, ok := rawBytes(v); ok && dst.Type().Elem().Kind() == reflect.Uint8 && len(b) == dst.Len() {
+			reflect.Copy(dst, reflect.ValueOf(b))
+			return nil
+		}
+	}
+	return &TypeError{v.Type().String(), dst.Type()}
+}
+
+// Reports whether a finite f is beyond the range of float32, the type of
+// the parts of complex64.  Infinities and NaN convert as they are.
+func overflowFloat32(f float64) bool {
+	return !math.IsInf(f, 0) && math.Abs(f) > math.MaxFloat32
+}
+
+// Returns the bytes of an unpacked raw value, which is a string when the
+// decoder normalizes.
+func rawBytes(v reflect.Value) ([]byte, bool) {
+	switch v.Kind() {
+	case reflect.String:
+		return []byte(v.String()), true
+	case reflect.Slice:
+		b, ok := v.Interface().([]byte)
+		return b, ok
+	}
+	return nil, false
+}
+
+func isRawCode(c byte) bool {
+	return (c >= FIXRAW && c <= FIXRAWMAX) || c == RAW16 || c == RAW32
+}
+
+func isArrayCode(c byte) bool {
+	return (c >= FIXARRAY && c <= FIXARRAYMAX) || c == ARRAY16 || c == ARRAY32
+}
+
+func isMapCode(c byte) bool {
+	return (c >= FIXMAP && c <= FIXMAPMAX) || c == MAP16 || c == MAP32
+}
+
+func isExtCode(c byte) bool {
+	return (c >= FIXEXT1 && c <= FIXEXT16) || (c >= EXT8 && c <= EXT32)
+}
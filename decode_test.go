@@ -0,0 +1,289 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type point struct {
+	x, y int8
+}
+
+func (p point) MarshalMsgpack() ([]byte, error) {
+	return []byte{0x92, byte(p.x), byte(p.y)}, nil
+}
+
+func (p *point) UnmarshalMsgpack(data []byte) error {
+	var v []int8
+	if _, err := Decode(bytes.NewReader(data), &v); err != nil {
+		return err
+	}
+	p.x, p.y = v[0], v[1]
+	return nil
+}
+
+func TestDecode(t *testing.T) {
+	b := bytes.NewBuffer([]byte{0x93, 0x01, 0xcc, 0xff, 0xc0, 0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0xd1, 0xff, 0x00, 0xa3, 'a', 'b', 'c', 0xcb, 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x92, 0x01, 0x02})
+	var ints []uint16
+	var m map[string]int
+	var s string
+	var f float32
+	var p *[2]int64
+	for _, i := range []struct {
+		v        interface{}
+		expected interface{}
+	}{
+		{&ints, []uint16{1, 255, 0}},
+		{&m, map[string]int{"a": 1, "b": -256}},
+		{&s, "abc"},
+		{&f, float32(1.5)},
+		{&p, &[2]int64{1, 2}},
+	} {
+		_, e := Decode(b, i.v)
+		if e != nil {
+			t.Error("err != nil", e)
+		}
+		if !reflect.DeepEqual(reflect.ValueOf(i.v).Elem().Interface(), i.expected) {
+			t.Errorf("%#v != %#v", reflect.ValueOf(i.v).Elem().Interface(), i.expected)
+		}
+	}
+}
+
+func TestDecodeTypeError(t *testing.T) {
+	var i int8
+	_, e := Decode(bytes.NewBuffer([]byte{0xcc, 0xff}), &i)
+	var typeError *TypeError
+	if !errors.As(e, &typeError) {
+		t.Error("err is not a *TypeError", e)
+	}
+	var f float32
+	_, e = Decode(bytes.NewBuffer([]byte{0xcb, 0x7e, 0x37, 0xe4, 0x3c, 0x88, 0x00, 0x75, 0x9c}), &f) // 1e300
+	if !errors.As(e, &typeError) || f != 0 {
+		t.Error("err is not a *TypeError", f, e)
+	}
+	_, e = Decode(bytes.NewBuffer([]byte{0xcb, 0x7f, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}), &f)
+	if e != nil || !math.IsInf(float64(f), 1) {
+		t.Error("infinity not decoded into float32", f, e)
+	}
+	_, e = Decode(bytes.NewBuffer([]byte{0x00}), i)
+	if e != ErrInvalidDecodeTarget {
+		t.Error("err != ErrInvalidDecodeTarget", e)
+	}
+}
+
+func TestMarshalerFallback(t *testing.T) {
+	addr := netip.MustParseAddr("192.0.2.1")
+	ip := net.ParseIP("2001:db8::1")
+	x := big.NewInt(-42)
+	b := &bytes.Buffer{}
+	for _, i := range [](interface{}){addr, ip, x, point{1, -1}, map[netip.Addr]bool{addr: true}} {
+		_, err := Pack(b, i)
+		if err != nil {
+			t.Error("err != nil")
+		}
+	}
+	if bytes.Compare(b.Bytes(), []byte{0xa4, 0xc0, 0x00, 0x02, 0x01, 0xab, '2', '0', '0', '1', ':', 'd', 'b', '8', ':', ':', '1', 0xa3, '-', '4', '2', 0x92, 0x01, 0xff, 0x81, 0xa4, 0xc0, 0x00, 0x02, 0x01, 0xc3}) != 0 {
+		t.Error("wrong output", b.Bytes())
+	}
+
+	var _addr netip.Addr
+	var _ip net.IP
+	_x := new(big.Int)
+	var _p point
+	var _m map[netip.Addr]bool
+	for _, i := range []struct {
+		v        interface{}
+		expected interface{}
+	}{
+		{&_addr, addr},
+		{&_ip, ip},
+		{&_x, x},
+		{&_p, point{1, -1}},
+		{&_m, map[netip.Addr]bool{addr: true}},
+	} {
+		_, e := Decode(b, i.v)
+		if e != nil {
+			t.Error("err != nil", e)
+		}
+		if !reflect.DeepEqual(reflect.ValueOf(i.v).Elem().Interface(), i.expected) {
+			t.Errorf("%#v != %#v", reflect.ValueOf(i.v).Elem().Interface(), i.expected)
+		}
+	}
+}
+
+// Normalize turns unpacked raws into strings, which must not change what
+// typed destinations receive.
+func TestDecodeNormalize(t *testing.T) {
+	type named []byte
+	type record struct {
+		Data  []byte
+		Named named
+		Fixed [2]byte
+		Text  string
+	}
+	addr := netip.MustParseAddr("192.0.2.1")
+	x := big.NewInt(-42)
+	in := record{[]byte{0, 0xff}, named("n"), [2]byte{1, 2}, "t"}
+	b := &bytes.Buffer{}
+	for _, i := range []interface{}{addr, x, in, []byte("raw")} {
+		if _, err := Pack(b, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dec := NewDecoder(b)
+	dec.Normalize = true
+	var _addr netip.Addr
+	_x := new(big.Int)
+	var out record
+	var data []byte
+	for _, i := range []struct {
+		v        interface{}
+		expected interface{}
+	}{
+		{&_addr, addr},
+		{_x, *x},
+		{&out, in},
+		{&data, []byte("raw")},
+	} {
+		if _, err := dec.Decode(i.v); err != nil {
+			t.Errorf("Decode(%T): %v", i.v, err)
+			continue
+		}
+		if v := reflect.ValueOf(i.v).Elem().Interface(); !reflect.DeepEqual(v, i.expected) {
+			t.Errorf("%#v != %#v", v, i.expected)
+		}
+	}
+}
+
+type shape interface {
+	area() float64
+}
+
+type circle struct {
+	R float64 `msgpack:"r"`
+}
+
+func (c circle) area() float64 {
+	return 3 * c.R * c.R
+}
+
+type rect struct {
+	W, H   int
+	hidden int
+}
+
+func (r *rect) area() float64 {
+	return float64(r.W * r.H)
+}
+
+type drawing struct {
+	Name   string
+	Main   shape
+	Shapes []shape
+	Skip   int `msgpack:"-"`
+}
+
+func TestDecodeRegisteredTypes(t *testing.T) {
+	t.Cleanup(func() {
+		UnregisterType("circle")
+		UnregisterType("rect")
+	})
+	var wg sync.WaitGroup
+	for _, i := range []struct {
+		name  string
+		value interface{}
+	}{{"circle", circle{}}, {"rect", &rect{}}} {
+		wg.Add(1)
+		go func(name string, value interface{}) {
+			RegisterType(name, value)
+			wg.Done()
+		}(i.name, i.value)
+	}
+	wg.Wait()
+
+	b := &bytes.Buffer{}
+	d := drawing{"d", circle{1}, []shape{&rect{2, 3, 4}, circle{2}}, 5}
+	_, err := Pack(b, d)
+	if err != nil {
+		t.Error("err != nil", err)
+	}
+	node, _, e := UnpackNode(bytes.NewReader(b.Bytes()))
+	if e != nil || node.Len() != 3 || node.Get("Main").Get(TYPE_KEY).Str() != "circle" || node.Get("Main").Get("r").Float() != 1 || node.Get("Shapes").Index(0).Get("W").Int() != 2 {
+		t.Error("wrong output", b.Bytes())
+	}
+
+	var _d drawing
+	_, e = Decode(b, &_d)
+	if e != nil {
+		t.Error("err != nil", e)
+	}
+	expected := drawing{"d", circle{1}, []shape{&rect{2, 3, 0}, circle{2}}, 0}
+	if !reflect.DeepEqual(_d, expected) {
+		t.Errorf("%#v != %#v", _d, expected)
+	}
+
+	// Registered types are found in untyped maps and arrays too
+	b.Reset()
+	Pack(b, map[string]interface{}{"main": circle{3}, "shapes": []interface{}{&rect{4, 5, 0}, map[string]interface{}{"c": circle{6}}}})
+	var v interface{}
+	_, e = Decode(b, &v)
+	expectedMap := map[interface{}]interface{}{"main": circle{3}, "shapes": []interface{}{&rect{4, 5, 0}, map[interface{}]interface{}{"c": circle{6}}}}
+	if e != nil || !reflect.DeepEqual(v, expectedMap) {
+		t.Errorf("%#v != %#v", v, expectedMap)
+	}
+
+	UnregisterType("circle")
+	data, err := Marshal(circle{1})
+	node, _, e = UnpackNode(bytes.NewReader(data))
+	if err != nil || e != nil || node.Len() != 1 || node.Get(TYPE_KEY) != nil {
+		t.Error("wrong output", data)
+	}
+}
+
+type tree struct {
+	Value    int
+	Children []*tree
+}
+
+func TestCodecCache(t *testing.T) {
+	b := &bytes.Buffer{}
+	tr := tree{1, []*tree{{2, []*tree{}}, {3, []*tree{{4, []*tree{}}}}}}
+	_, err := Pack(b, tr)
+	if err != nil {
+		t.Error("err != nil", err)
+	}
+	var _tr tree
+	_, e := Decode(b, &_tr)
+	if e != nil {
+		t.Error("err != nil", e)
+	}
+	if !reflect.DeepEqual(_tr, tr) {
+		t.Errorf("%#v != %#v", _tr, tr)
+	}
+
+	b.Reset()
+	_, err = Pack(b, [3]byte{1, 2, 3})
+	if err != nil || !bytes.Equal(b.Bytes(), []byte{0xa3, 1, 2, 3}) {
+		t.Error("wrong output", b.Bytes())
+	}
+
+	// Registering a codec replaces the cached encoder of its type
+	type celsius float64
+	b.Reset()
+	Pack(b, celsius(1))
+	RegisterExt(&ExtCodec{Type: 0x40, GoType: reflect.TypeOf(celsius(0)), Encode: func(reflect.Value) ([]byte, error) {
+		return []byte{0}, nil
+	}})
+	defer UnregisterExt(0x40)
+	Pack(b, celsius(1))
+	if !bytes.Equal(b.Bytes(), []byte{0xcb, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0, FIXEXT1, 0x40, 0}) {
+		t.Error("wrong output", b.Bytes())
+	}
+}
@@ -0,0 +1,386 @@
+package msgpack
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// The kinds of differences reported by Diff.
+type DiffKind int
+
+const (
+	DIFF_CHANGED DiffKind = iota // scalars of the same type with different values
+	DIFF_TYPE                    // values of different types
+	DIFF_REMOVED                 // an element or map entry only in the first value
+	DIFF_ADDED                   // an element or map entry only in the second value
+)
+
+// A Difference between two values found by Diff.
+type Difference struct {
+	Kind DiffKind
+	Path string // location of the values, such as $.items[3].name
+	A    []byte // the packed value in the first input, or nil if it was added
+	B    []byte // the packed value in the second input, or nil if it was removed
+}
+
+// Returns the difference with the values written by Format.
+func (d Difference) String() string {
+	switch d.Kind {
+	case DIFF_REMOVED:
+		return d.Path + ": removed " + Format(d.A)
+	case DIFF_ADDED:
+		return d.Path + ": added " + Format(d.B)
+	case DIFF_TYPE:
+		return d.Path + ": type changed from " + Format(d.A) + " to " + Format(d.B)
+	}
+	return d.Path + ": changed from " + Format(d.A) + " to " + Format(d.B)
+}
+
+// A Differ compares packed values.
+type Differ struct {
+	// Compares integers of any width and signedness by their values, and
+	// float32 and float64 values likewise, instead of reporting the
+	// different types.
+	IgnoreWidths bool
+	// The maximum number of arrays and maps a value may be nested in, with
+	// values nested deeper failing with ErrMaxDepth.  Zero means
+	// DEFAULT_MAX_DEPTH.
+	MaxDepth int
+}
+
+// Compares the first value in each of a and b and returns the differences
+// between them, or nil if they are equal.  Containers are walked in place
+// and only scalars are unpacked.  Maps are compared as unordered sets of
+// entries, and floats are equal if both are NaN.
+func (d *Differ) Diff(a []byte, b []byte) ([]Difference, error) {
+	restA, err := SkipValue(a)
+	if err != nil {
+		return nil, err
+	}
+	restB, err := SkipValue(b)
+	if err != nil {
+		return nil, err
+	}
+	a, b = a[:len(a)-len(restA)], b[:len(b)-len(restB)]
+	diff := &differ{Differ: d}
+	if diff.a, err = d.index(a); err != nil {
+		return nil, err
+	}
+	if diff.b, err = d.index(b); err != nil {
+		return nil, err
+	}
+	if err := diff.diff(a, b); err != nil {
+		return nil, err
+	}
+	return diff.differences, nil
+}
+
+// Compares packed values with the default Differ, which reports values of
+// different widths as differences.
+func Diff(a []byte, b []byte) ([]Difference, error) {
+	return (&Differ{}).Diff(a, b)
+}
+
+type differ struct {
+	*Differ
+	// The bounds of the values in the inputs of a and b
+	a, b        *valueIndex
+	path        []pathElem
+	differences []Difference
+	// Only reports whether values are equal, for matching map keys
+	quiet bool
+	equal bool
+}
+
+func (d *differ) report(kind DiffKind, a []byte, b []byte) {
+	d.equal = false
+	if !d.quiet {
+		d.differences = append(d.differences, Difference{kind, formatPath(d.path), a, b})
+	}
+}
+
+// Reports whether a and b are equal without recording the differences.
+func (d *differ) equals(a []byte, b []byte) (bool, error) {
+	_d := &differ{Differ: d.Differ, a: d.a, b: d.b, quiet: true, equal: true}
+	err := _d.diff(a, b)
+	return _d.equal, err
+}
+
+// The offsets of the values packed in an input of Diff, including all
+// the nested ones, in the order they start in.
+type valueIndex struct {
+	cap    int // of the input, which its subslices are located by
+	starts []int
+	ends   []int
+}
+
+// Indexes the value in b, which SkipValue has checked, in a single pass,
+// so that containers are split without skipping their elements at every
+// level.
+func (d *Differ) index(b []byte) (*valueIndex, error) {
+	maxDepth := d.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DEFAULT_MAX_DEPTH
+	}
+	idx := &valueIndex{cap: cap(b)}
+	// The containers being read, by their index and the values left in them
+	type open struct{ value, pending int }
+	var stack []open
+	rest := b
+	for {
+		i := len(idx.starts)
+		idx.starts = append(idx.starts, len(b)-len(rest))
+		idx.ends = append(idx.ends, 0)
+		c, n := rest[0], 0
+		switch {
+		case isArrayCode(c):
+			n, rest, _ = ReadArrayHeader(rest)
+		case isMapCode(c):
+			n, rest, _ = ReadMapHeader(rest)
+			n *= 2
+		default:
+			rest, _ = SkipValue(rest)
+		}
+		if isArrayCode(c) || isMapCode(c) {
+			if len(stack) >= maxDepth {
+				return nil, ErrMaxDepth
+			}
+			if n > 0 {
+				stack = append(stack, open{i, n})
+				continue
+			}
+		}
+		// The value ends, along with the containers it is last in
+		idx.ends[i] = len(b) - len(rest)
+		for len(stack) > 0 {
+			top := &stack[len(stack)-1]
+			if top.pending--; top.pending > 0 {
+				break
+			}
+			idx.ends[top.value] = len(b) - len(rest)
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			return idx, nil
+		}
+	}
+}
+
+// Splits the n packed values at the front of b, a subslice of the indexed
+// input.
+func (idx *valueIndex) split(b []byte, n int) [][]byte {
+	values := make([][]byte, n)
+	offset := idx.cap - cap(b)
+	for i := range values {
+		j := sort.SearchInts(idx.starts, offset)
+		length := idx.ends[j] - offset
+		values[i], b = b[:length], b[length:]
+		offset += length
+	}
+	return values
+}
+
+func unpackScalar(b []byte) (*Node, error) {
+	node, _, err := UnpackNode(bytes.NewReader(b))
+	return node, err
+}
+
+// Compares the packed values a and b.
+func (d *differ) diff(a []byte, b []byte) error {
+	switch {
+	case isArrayCode(a[0]) && isArrayCode(b[0]):
+		lengthA, elemsA, _ := ReadArrayHeader(a)
+		lengthB, elemsB, _ := ReadArrayHeader(b)
+		return d.diffArray(d.a.split(elemsA, lengthA), d.b.split(elemsB, lengthB))
+	case isMapCode(a[0]) && isMapCode(b[0]):
+		return d.diffMap(a, b)
+	case isArrayCode(a[0]) || isMapCode(a[0]) || isArrayCode(b[0]) || isMapCode(b[0]):
+		d.report(DIFF_TYPE, a, b)
+		return nil
+	}
+	nodeA, err := unpackScalar(a)
+	if err != nil {
+		return err
+	}
+	nodeB, err := unpackScalar(b)
+	if err != nil {
+		return err
+	}
+	if !d.sameType(nodeA, nodeB) {
+		d.report(DIFF_TYPE, a, b)
+	} else if nodeA.kind != NIL_NODE && !d.sameValue(nodeA, nodeB) {
+		d.report(DIFF_CHANGED, a, b)
+	}
+	return nil
+}
+
+func (d *differ) diffArray(a [][]byte, b [][]byte) error {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if !d.quiet {
+			d.path = append(d.path, pathElem{index: i})
+		}
+		switch {
+		case i >= len(b):
+			d.report(DIFF_REMOVED, a[i], nil)
+		case i >= len(a):
+			d.report(DIFF_ADDED, nil, b[i])
+		default:
+			if err := d.diff(a[i], b[i]); err != nil {
+				return err
+			}
+		}
+		if !d.quiet {
+			d.path = d.path[:len(d.path)-1]
+		}
+		if d.quiet && !d.equal {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Reports whether the scalars a and b have the same type, or are numbers
+// of the same kind if IgnoreWidths is set.
+func (d *differ) sameType(a *Node, b *Node) bool {
+	if d.IgnoreWidths && isNumberNode(a) && isNumberNode(b) {
+		return (a.kind == FLOAT_NODE) == (b.kind == FLOAT_NODE)
+	}
+	if a.kind != b.kind {
+		return false
+	}
+	if a.kind == NIL_NODE {
+		return true
+	}
+	return a.value.Type() == b.value.Type()
+}
+
+func isNumberNode(node *Node) bool {
+	return node.kind == INT_NODE || node.kind == UINT_NODE || node.kind == FLOAT_NODE
+}
+
+// Compares scalars of the same type, or numbers of any width if
+// IgnoreWidths is set.
+func (d *differ) sameValue(a *Node, b *Node) bool {
+	switch a.kind {
+	case BOOL_NODE:
+		return a.value.Bool() == b.value.Bool()
+	case INT_NODE, UINT_NODE:
+		return nodeKey(a) == nodeKey(b)
+	case FLOAT_NODE:
+		fa, fb := a.value.Float(), b.value.Float()
+		if a.value.Type().Bits() == 32 || b.value.Type().Bits() == 32 {
+			// A float32 value is compared with a float64 at its precision
+			fa, fb = float64(float32(fa)), float64(float32(fb))
+		}
+		return fa == fb || (math.IsNaN(fa) && math.IsNaN(fb))
+	case RAW_NODE:
+		return bytes.Equal(a.value.Bytes(), b.value.Bytes())
+	case EXT_NODE:
+		if ea, ok := a.value.Interface().(Ext); ok {
+			eb := b.value.Interface().(Ext)
+			return ea.Type == eb.Type && bytes.Equal(ea.Data, eb.Data)
+		}
+	}
+	return fmt.Sprint(a.value.Interface()) == fmt.Sprint(b.value.Interface())
+}
+
+// Returns a string that is the same for map keys that may be equal, so
+// that the entries of large maps are not compared pairwise.
+func nodeKey(node *Node) string {
+	switch node.kind {
+	case INT_NODE:
+		return "i" + strconv.FormatInt(node.value.Int(), 10)
+	case UINT_NODE:
+		// Matches the keys of int nodes with the same value
+		return "i" + strconv.FormatUint(node.value.Uint(), 10)
+	case RAW_NODE:
+		return "r" + string(node.value.Bytes())
+	case BOOL_NODE:
+		return "b" + strconv.FormatBool(node.value.Bool())
+	}
+	return node.kind.String()
+}
+
+// Returns the string nodeKey returns for a packed map key.
+func packedKey(key []byte) (string, error) {
+	if isArrayCode(key[0]) {
+		return ARRAY_NODE.String(), nil
+	}
+	if isMapCode(key[0]) {
+		return MAP_NODE.String(), nil
+	}
+	node, err := unpackScalar(key)
+	if err != nil {
+		return "", err
+	}
+	return nodeKey(node), nil
+}
+
+func (d *differ) diffMap(a []byte, b []byte) error {
+	lengthA, entriesA, _ := ReadMapHeader(a)
+	lengthB, entriesB, _ := ReadMapHeader(b)
+	// Keys and values alternate
+	valuesA, valuesB := d.a.split(entriesA, 2*lengthA), d.b.split(entriesB, 2*lengthB)
+	// The unmatched entries of b by the keys of their keys
+	entries := make(map[string][]int, lengthB)
+	for j := 0; j < lengthB; j++ {
+		k, err := packedKey(valuesB[2*j])
+		if err != nil {
+			return err
+		}
+		entries[k] = append(entries[k], j)
+	}
+	matched := make([]bool, lengthB)
+	for i := 0; i < lengthA; i++ {
+		key := valuesA[2*i]
+		if !d.quiet {
+			d.path = append(d.path, pathElem{packed: key, isKey: true})
+		}
+		k, err := packedKey(key)
+		if err != nil {
+			return err
+		}
+		j := -1
+		for n, _j := range entries[k] {
+			equal, err := d.equals(key, valuesB[2*_j])
+			if err != nil {
+				return err
+			}
+			if equal {
+				j = _j
+				entries[k] = append(entries[k][:n:n], entries[k][n+1:]...)
+				break
+			}
+		}
+		if j < 0 {
+			d.report(DIFF_REMOVED, valuesA[2*i+1], nil)
+		} else {
+			matched[j] = true
+			if err := d.diff(valuesA[2*i+1], valuesB[2*j+1]); err != nil {
+				return err
+			}
+		}
+		if !d.quiet {
+			d.path = d.path[:len(d.path)-1]
+		}
+		if d.quiet && !d.equal {
+			return nil
+		}
+	}
+	for j := 0; j < lengthB; j++ {
+		if matched[j] {
+			continue
+		}
+		if !d.quiet {
+			d.path = append(d.path, pathElem{packed: valuesB[2*j], isKey: true})
+		}
+		d.report(DIFF_ADDED, nil, valuesB[2*j+1])
+		if !d.quiet {
+			d.path = d.path[:len(d.path)-1]
+		}
+	}
+	return nil
+}
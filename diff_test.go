@@ -0,0 +1,130 @@
+package msgpack
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	for _, test := range []struct {
+		a, b         interface{}
+		ignoreWidths bool
+		expected     []string
+	}{
+		{map[string]interface{}{"a": 1, "b": []int{1, 2}, "c": nil}, map[string]interface{}{"c": nil, "b": []int{1, 2}, "a": 1}, false, nil},
+		{"x", "y", false, []string{`$: changed from "x" to "y"`}},
+		{[]byte{0xff}, []byte{0xfe}, false, []string{`$: changed from h'ff' to h'fe'`}},
+		{1, 300, false, []string{`$: type changed from 1 to uint16(300)`}},
+		{1, "1", false, []string{`$: type changed from 1 to "1"`}},
+		{int16(-300), uint16(300), true, []string{`$: changed from int16(-300) to uint16(300)`}},
+		{200, int64(200), true, nil},
+		{float32(1.1), 1.1, true, nil},
+		{float32(1.1), 1.1, false, []string{`$: type changed from float32(1.1) to float64(1.1)`}},
+		{math.NaN(), math.NaN(), false, nil},
+		{1, 1.0, true, []string{`$: type changed from 1 to float64(1)`}},
+		{[]int{1, 2, 3}, []int{1, 5}, false, []string{
+			`$[1]: changed from 2 to 5`,
+			`$[2]: removed 3`,
+		}},
+		{[]interface{}{}, []interface{}{[]string{"x"}, map[string]bool{}}, false, []string{
+			`$[0]: added ["x"]`,
+			`$[1]: added {}`,
+		}},
+		{map[string]interface{}{"a": map[string]int{"b": 1}, "gone": true}, map[string]interface{}{"a": map[string]int{"b": 2}, "new key": Ext{1, []byte{2}}}, false, []string{
+			`$.a.b: changed from 1 to 2`,
+			`$.gone: removed true`,
+			`$["new key"]: added ext(1, h'02')`,
+		}},
+		{map[[2]int]int{{1, 2}: 3}, map[[2]int]int{{1, 2}: 4}, false, []string{
+			`$[[1, 2]]: changed from 3 to 4`,
+		}},
+	} {
+		a, err := Marshal(test.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Marshal(test.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff, err := (&Differ{IgnoreWidths: test.ignoreWidths}).Diff(a, b)
+		if err != nil {
+			t.Errorf("Diff(%s, %s): %v", Format(a), Format(b), err)
+			continue
+		}
+		var differences []string
+		for _, d := range diff {
+			differences = append(differences, d.String())
+		}
+		// The entries of maps are packed in any order
+		if !sameStrings(differences, test.expected) {
+			t.Errorf("Diff(%s, %s) = %q, want %q", Format(a), Format(b), differences, test.expected)
+		}
+	}
+}
+
+func TestDiffKinds(t *testing.T) {
+	a, _ := Marshal(map[string]interface{}{"a": 1, "b": true})
+	b, _ := Marshal(map[string]interface{}{"a": 2, "b": "x", "c": nil})
+	diff, err := Diff(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]DiffKind)
+	for _, d := range diff {
+		kinds[d.Path] = d.Kind
+		if (d.A == nil) != (d.Kind == DIFF_ADDED) || (d.B == nil) != (d.Kind == DIFF_REMOVED) {
+			t.Errorf("%v: A = %v, B = %v", d, d.A, d.B)
+		}
+	}
+	if !reflect.DeepEqual(kinds, map[string]DiffKind{"$.a": DIFF_CHANGED, "$.b": DIFF_TYPE, "$.c": DIFF_ADDED}) {
+		t.Error("kinds =", kinds)
+	}
+
+	// Keys of different widths match only with IgnoreWidths
+	a, b = Bytes{0x81, UINT8, 0x05, 0x01}, Bytes{0x81, 0x05, 0x01}
+	if diff, err := (&Differ{IgnoreWidths: true}).Diff(a, b); err != nil || diff != nil {
+		t.Errorf("Diff = %v, %v", diff, err)
+	}
+	diff, err = Diff(a, b)
+	if err != nil || len(diff) != 2 || diff[0].String() != "$[5]: removed 1" || diff[1].String() != "$[5]: added 1" {
+		t.Errorf("Diff = %v, %v", diff, err)
+	}
+
+	// The values are the packed bytes, written as by Format
+	diff, err = Diff(Bytes{0x91, RAW16, 0, 1, 'x'}, Bytes{0x91, 0xa1, 'y'})
+	if err != nil || len(diff) != 1 || !bytes.Equal(diff[0].A, Bytes{RAW16, 0, 1, 'x'}) || diff[0].String() != `$[0]: changed from raw16("x") to "y"` {
+		t.Errorf("Diff = %v, %v", diff, err)
+	}
+
+	// Keys that are not valid Go map keys appear in paths as they are
+	diff, err = Diff(Bytes{0x81, 0x91, 0x01, 0x02}, Bytes{0x81, 0x91, 0x01, 0x03})
+	if err != nil || len(diff) != 1 || diff[0].Path != "$[[1]]" {
+		t.Errorf("Diff = %v, %v", diff, err)
+	}
+
+	if _, err := Diff(a, a[:len(a)-1]); err == nil {
+		t.Error("compared truncated data")
+	}
+
+	// Nested values are split once, and nesting deeper than the limit
+	// fails instead of overflowing the stack
+	deep := func(n int, leaf byte) []byte {
+		return append(bytes.Repeat([]byte{0x81, 0x01, 0x91}, n), leaf)
+	}
+	diff, err = Diff(deep(3000, 1), deep(3000, 2))
+	if err != nil || len(diff) != 1 || !bytes.Equal(diff[0].A, Bytes{1}) || len(diff[0].Path) != len("$")+3000*len("[1][0]") {
+		t.Errorf("Diff = %d differences, %v", len(diff), err)
+	}
+	if _, err := Diff(deep(1000000, 1), deep(1000000, 1)); err != ErrMaxDepth {
+		t.Error("err != ErrMaxDepth", err)
+	}
+	if _, err := (&Differ{MaxDepth: 2}).Diff(Bytes{0x91, 0x91, 0x90}, Bytes{0x90}); err != ErrMaxDepth {
+		t.Error("err != ErrMaxDepth", err)
+	}
+	if diff, err := (&Differ{MaxDepth: 2}).Diff(Bytes{0x91, 0x90}, Bytes{0x91, 0x90}); err != nil || diff != nil {
+		t.Errorf("Diff = %v, %v", diff, err)
+	}
+}
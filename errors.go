@@ -0,0 +1,184 @@
+package msgpack
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A DecodeError describes where unpacking or decoding a value failed.
+type DecodeError struct {
+	Offset int64        // bytes read by the decoder when the error occurred
+	Path   string       // location of the failing value, such as $.items[3].name
+	Code   byte         // first byte of the failing value, or the last one read
+	Type   reflect.Type // Go type being decoded into, or nil when unpacking
+	Err    error        // underlying cause
+}
+
+func (e *DecodeError) Error() string {
+	s := "msgpack: " + e.Err.Error() + " at offset " + strconv.FormatInt(e.Offset, 10) + " (" + e.Path + ", code 0x" + strconv.FormatUint(uint64(e.Code), 16)
+	if e.Type != nil {
+		s += ", decoding into " + e.Type.String()
+	}
+	return s + ")"
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// An element of the path to the value being unpacked: an array index, or
+// the key of a map entry or struct field.  Keys of skipped maps are kept
+// packed, and unpacked only when the path is formatted.
+type pathElem struct {
+	index  int
+	key    interface{}
+	packed []byte
+	isKey  bool
+}
+
+func (dec *Decoder) pushIndex(index int) {
+	dec.path = append(dec.path, pathElem{index: index})
+}
+
+func (dec *Decoder) pushKey(key reflect.Value) {
+	var k interface{}
+	if s, ok := keyString(key); ok {
+		k = s
+	} else if key.IsValid() {
+		k = key.Interface()
+	}
+	dec.path = append(dec.path, pathElem{key: k, isKey: true})
+}
+
+func (dec *Decoder) pop() {
+	dec.path = dec.path[:len(dec.path)-1]
+}
+
+// Appends the bytes read through it to buf, for the keys on the path.
+type keyRecorder struct {
+	reader io.Reader
+	buf    []byte
+}
+
+func (r *keyRecorder) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+// A map key on a path that has no simpler form, such as an array, in the
+// notation of Format.
+type formattedKey string
+
+// Returns a packed map key as it appears in paths: raws as strings,
+// integers, booleans and nil as themselves, and other keys, which may not
+// be valid Go map keys, in the notation of Format.
+func pathKey(packed []byte) interface{} {
+	node, _, err := UnpackNode(bytes.NewReader(packed))
+	if err != nil {
+		return formattedKey(Format(packed))
+	}
+	switch node.kind {
+	case NIL_NODE:
+		return nil
+	case RAW_NODE:
+		return node.Str()
+	case BOOL_NODE, INT_NODE, UINT_NODE:
+		return node.value.Interface()
+	}
+	return formattedKey(Format(packed))
+}
+
+// Returns the path as a string like $.items[3].name.
+func formatPath(path []pathElem) string {
+	var b strings.Builder
+	b.WriteString("$")
+	for _, elem := range path {
+		if elem.packed != nil {
+			elem.key = pathKey(elem.packed)
+		}
+		switch key := elem.key.(type) {
+		case nil:
+			if elem.isKey {
+				b.WriteString("[nil]")
+			} else {
+				b.WriteString("[" + strconv.Itoa(elem.index) + "]")
+			}
+		case string:
+			if isIdentifier(key) {
+				b.WriteString("." + key)
+			} else {
+				b.WriteString("[" + strconv.Quote(key) + "]")
+			}
+		default:
+			fmt.Fprintf(&b, "[%v]", key)
+		}
+	}
+	return b.String()
+}
+
+func isIdentifier(s string) bool {
+	for i, c := range s {
+		if !(c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Counts the bytes read through it, for the offsets of decode errors.
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (r *countingReader) Read(p []byte) (n int, err error) {
+	n, err = r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (dec *Decoder) offset() int64 {
+	if dec.counter == nil {
+		return 0
+	}
+	return dec.counter.n
+}
+
+// Prepares the decoder for reading a value with one of the exported
+// methods and returns the current offset.
+func (dec *Decoder) begin() int64 {
+	dec.path = dec.path[:0]
+	dec.keys.buf = dec.keys.buf[:0]
+	dec.typ = nil
+	dec.depth = 0
+	return dec.offset()
+}
+
+// Wraps an error from reading a value that began at offset start in a
+// DecodeError.  The path is left as it was when the error occurred, since
+// elements are only popped after they were read successfully.  Errors
+// before the first byte of the value, such as io.EOF at the end of the
+// stream, are returned as is.  io.EOF within the value becomes
+// io.ErrUnexpectedEOF.
+func (dec *Decoder) wrapError(start int64, err error) error {
+	path := dec.path
+	dec.path = dec.path[:0]
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*DecodeError); ok {
+		return err
+	}
+	if dec.offset() == start {
+		return err
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return &DecodeError{dec.offset(), formatPath(path), dec.code, dec.typ, err}
+}
@@ -0,0 +1,125 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type errorItem struct {
+	Name int `msgpack:"name"`
+}
+
+type errorRecord struct {
+	Items []errorItem `msgpack:"items"`
+}
+
+func TestDecodeError(t *testing.T) {
+	b := &bytes.Buffer{}
+	Pack(b, map[string]interface{}{"items": []interface{}{map[string]int{"name": 1}, map[string]int{"name": 2}, map[string]int{"name": 3}, map[string]string{"name": "x"}}})
+	data := b.Bytes()
+
+	var r errorRecord
+	_, err := Decode(bytes.NewReader(data), &r)
+	var decodeError *DecodeError
+	var typeError *TypeError
+	if !errors.As(err, &decodeError) || !errors.As(err, &typeError) {
+		t.Fatal("err is not a *DecodeError wrapping a *TypeError", err)
+	}
+	expected := DecodeError{int64(len(data)), "$.items[3].name", 0xa1, reflect.TypeOf(0), typeError}
+	if *decodeError != expected {
+		t.Errorf("%#v != %#v", *decodeError, expected)
+	}
+
+	for _, unpack := range []func(dec *Decoder) error{
+		func(dec *Decoder) error { _, _, err := dec.Unpack(); return err },
+		func(dec *Decoder) error { _, _, err := dec.UnpackNode(); return err },
+		func(dec *Decoder) error { _, err := dec.Skip(); return err },
+		func(dec *Decoder) error { var v interface{}; _, err := dec.Decode(&v); return err },
+	} {
+		err := unpack(NewDecoder(bytes.NewReader(data[:len(data)-1])))
+		if !errors.As(err, &decodeError) || !errors.Is(err, io.ErrUnexpectedEOF) || decodeError.Offset != int64(len(data)-1) || decodeError.Path != "$.items[3].name" {
+			t.Errorf("wrong error %v", err)
+		}
+		if err := unpack(NewDecoder(bytes.NewReader(nil))); err != io.EOF {
+			t.Error("err != io.EOF", err)
+		}
+	}
+
+	dec := NewDecoder(bytes.NewReader(Bytes{0x92, 1, 2, 0x81, 0xa3, 'a', '-', 'b', 0x91}))
+	dec.Unpack()
+	_, _, err = dec.Unpack()
+	if !errors.As(err, &decodeError) || decodeError.Offset != 9 || decodeError.Path != `$["a-b"][0]` {
+		t.Errorf("wrong error %v", err)
+	}
+
+	// Keys of skipped maps, including keys within keys, are only unpacked
+	// for the path
+	data = Bytes{0x82, 0xa1, 'a', 0x81, 1, 2, 0x81, 0x81, 0xa1, 'k', 0x91, 1, 0x81, 0xa1, 'b', 0xa1}
+	_, err = NewDecoder(bytes.NewReader(data)).Skip()
+	if !errors.As(err, &decodeError) || decodeError.Offset != int64(len(data)) || decodeError.Path != `$[{"k": [1]}].b` {
+		t.Errorf("wrong error %v", err)
+	}
+}
+
+func TestMalformedInput(t *testing.T) {
+	for _, test := range []struct {
+		data []byte
+		err  error
+	}{
+		{Bytes{0x91, 0xc1}, ErrUnsupportedCode},
+		{Bytes{0x81, 0x90, 1}, ErrUnhashableKey},
+		{Bytes{0x81, 0xd4, 1, 1, 1}, ErrUnhashableKey},
+		{Bytes{UINT16, 1}, io.ErrUnexpectedEOF},
+		{Bytes{RAW32, 0xff, 0xff, 0xff, 0xff, 'x'}, io.ErrUnexpectedEOF},
+		{Bytes{ARRAY32, 0xff, 0xff, 0xff, 0xff, NIL}, io.ErrUnexpectedEOF},
+		{Bytes{EXT32, 0xff, 0xff, 0xff, 0xff, 1}, io.ErrUnexpectedEOF},
+	} {
+		_, _, err := Unpack(bytes.NewReader(test.data))
+		if !errors.Is(err, test.err) {
+			t.Errorf("Unpack(%x): %v, want %v", test.data, err, test.err)
+		}
+		var v []int
+		if _, err := Decode(bytes.NewReader(test.data), &v); err == nil {
+			t.Errorf("Decode(%x) succeeded", test.data)
+		}
+	}
+}
+
+// Deeply nested input fails with ErrMaxDepth instead of overflowing the
+// stack
+func TestMaxDepth(t *testing.T) {
+	data := append(bytes.Repeat([]byte{0x91}, 3000000), 0x01)
+	for _, unpack := range []func(dec *Decoder) error{
+		func(dec *Decoder) error { _, _, err := dec.Unpack(); return err },
+		func(dec *Decoder) error { _, _, err := dec.UnpackNode(); return err },
+		func(dec *Decoder) error { _, err := dec.Skip(); return err },
+		func(dec *Decoder) error { var v interface{}; _, err := dec.Decode(&v); return err },
+		func(dec *Decoder) error { var v []tree; _, err := dec.Decode(&v); return err },
+	} {
+		var decodeError *DecodeError
+		err := unpack(NewDecoder(bytes.NewReader(data)))
+		if !errors.As(err, &decodeError) || !errors.Is(err, ErrMaxDepth) || decodeError.Offset != DEFAULT_MAX_DEPTH+1 {
+			t.Errorf("wrong error %v", err)
+		}
+
+		dec := NewDecoder(bytes.NewReader(Bytes{0x91, 0x81, 0xa1, 'a', 0x90, 0x91, 0x80}))
+		dec.MaxDepth = 2
+		if err := unpack(dec); !errors.As(err, &decodeError) || !errors.Is(err, ErrMaxDepth) || decodeError.Path != "$[0].a" {
+			t.Errorf("wrong error %v", err)
+		}
+		// The depth starts over with every value
+		if err := unpack(dec); err != nil {
+			t.Error("err != nil", err)
+		}
+	}
+	if s := Format(data); !strings.HasSuffix(s, "[!error(maximum nesting depth exceeded)") {
+		t.Errorf("Format = ...%s", s[len(s)-50:])
+	}
+	if s := (&Dumper{MaxDepth: 1}).Format(Bytes{0x91, 0x90}); s != "[!error(maximum nesting depth exceeded)" {
+		t.Errorf("Format = %s", s)
+	}
+}
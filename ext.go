@@ -0,0 +1,145 @@
+package msgpack
+
+import (
+	"io"
+	"reflect"
+	"sync"
+)
+
+const (
+	FIXEXT1  = 0xd4
+	FIXEXT2  = 0xd5
+	FIXEXT4  = 0xd6
+	FIXEXT8  = 0xd7
+	FIXEXT16 = 0xd8
+	EXT8     = 0xc7
+	EXT16    = 0xc8
+	EXT32    = 0xc9
+)
+
+// An Ext is an extension value.  Unpack returns extension values whose
+// type has no registered codec as Ext.
+type Ext struct {
+	Type int8
+	Data []byte
+}
+
+var extType = reflect.TypeOf(Ext{})
+
+// An ExtCodec converts values of a Go type to and from the payload of an
+// extension type.
+type ExtCodec struct {
+	Type   int8
+	GoType reflect.Type
+	Encode func(value reflect.Value) ([]byte, error)
+	Decode func(data []byte) (reflect.Value, error)
+}
+
+var extCodecs = struct {
+	sync.RWMutex
+	byType   map[int8]*ExtCodec
+	byGoType map[reflect.Type]*ExtCodec
+}{
+	byType:   make(map[int8]*ExtCodec),
+	byGoType: make(map[reflect.Type]*ExtCodec),
+}
+
+// Registers a codec, so that values of codec.GoType are packed as
+// extension values of codec.Type and unpacked back.  Replaces any codec
+// previously registered for the same extension type or Go type.
+func RegisterExt(codec *ExtCodec) {
+	extCodecs.Lock()
+	defer extCodecs.Unlock()
+	if old := extCodecs.byType[codec.Type]; old != nil {
+		delete(extCodecs.byGoType, old.GoType)
+	}
+	if old := extCodecs.byGoType[codec.GoType]; old != nil {
+		delete(extCodecs.byType, old.Type)
+	}
+	extCodecs.byType[codec.Type] = codec
+	extCodecs.byGoType[codec.GoType] = codec
+	resetEncoderCache()
+}
+
+// Removes the codec registered for the given extension type, if any.
+func UnregisterExt(typ int8) {
+	extCodecs.Lock()
+	defer extCodecs.Unlock()
+	if old := extCodecs.byType[typ]; old != nil {
+		delete(extCodecs.byType, typ)
+		delete(extCodecs.byGoType, old.GoType)
+		resetEncoderCache()
+	}
+}
+
+func extCodecForType(typ int8) *ExtCodec {
+	extCodecs.RLock()
+	defer extCodecs.RUnlock()
+	return extCodecs.byType[typ]
+}
+
+func extCodecForGoType(typ reflect.Type) *ExtCodec {
+	extCodecs.RLock()
+	defer extCodecs.RUnlock()
+	return extCodecs.byGoType[typ]
+}
+
+// Packs an extension value and writes it into the specified writer.
+func PackExt(writer io.Writer, typ int8, data []byte) (n int, err error) {
+	length := len(data)
+	var header Bytes
+	switch {
+	case length == 1:
+		header = Bytes{FIXEXT1, byte(typ)}
+	case length == 2:
+		header = Bytes{FIXEXT2, byte(typ)}
+	case length == 4:
+		header = Bytes{FIXEXT4, byte(typ)}
+	case length == 8:
+		header = Bytes{FIXEXT8, byte(typ)}
+	case length == 16:
+		header = Bytes{FIXEXT16, byte(typ)}
+	case length < REGULAR_UINT8_MAX:
+		header = Bytes{EXT8, byte(length), byte(typ)}
+	case length < MAX16BIT:
+		header = Bytes{EXT16, byte(length >> 8), byte(length), byte(typ)}
+	default:
+		header = Bytes{EXT32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length), byte(typ)}
+	}
+	n1, err := writer.Write(header)
+	if err != nil {
+		return n1, err
+	}
+	n2, err := writer.Write(data)
+	return n1 + n2, err
+}
+
+func packExtCodec(writer io.Writer, codec *ExtCodec, value reflect.Value) (n int, err error) {
+	if value.Kind() == reflect.Ptr && value.IsNil() {
+		return PackNil(writer)
+	}
+	data, err := codec.Encode(value)
+	if err != nil {
+		return 0, err
+	}
+	return PackExt(writer, codec.Type, data)
+}
+
+// Reads the type and payload of an extension value and converts it with
+// the registered codec, if any.
+func (dec *Decoder) unpackExt(length uint) (v reflect.Value, n int, err error) {
+	typ, n, e := readUint8(dec.reader)
+	if e != nil {
+		return reflect.Value{}, n, e
+	}
+	data, _n, e := readBytes(dec.reader, uint64(length))
+	n += _n
+	if e != nil {
+		return reflect.Value{}, n, e
+	}
+	if codec := extCodecForType(int8(typ)); codec != nil {
+		v, e = codec.Decode(data)
+		return v, n, e
+	}
+	return reflect.ValueOf(Ext{int8(typ), data}), n, nil
+}
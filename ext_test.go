@@ -0,0 +1,180 @@
+package msgpack
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPackExt(t *testing.T) {
+	b := &bytes.Buffer{}
+	for _, i := range []Ext{{1, []byte{0xaa}}, {2, []byte{0xaa, 0xbb, 0xcc, 0xdd}}, {-3, []byte{0xaa, 0xbb, 0xcc}}, {4, []byte{}}} {
+		_, err := Pack(b, i)
+		if err != nil {
+			t.Error("err != nil")
+		}
+	}
+	if bytes.Compare(b.Bytes(), []byte{0xd4, 0x01, 0xaa, 0xd6, 0x02, 0xaa, 0xbb, 0xcc, 0xdd, 0xc7, 0x03, 0xfd, 0xaa, 0xbb, 0xcc, 0xc7, 0x00, 0x04}) != 0 {
+		t.Error("wrong output", b.Bytes())
+	}
+	for _, v := range []Ext{{1, []byte{0xaa}}, {2, []byte{0xaa, 0xbb, 0xcc, 0xdd}}, {-3, []byte{0xaa, 0xbb, 0xcc}}, {4, []byte{}}} {
+		retval, _, e := Unpack(b)
+		if e != nil {
+			t.Error("err != nil")
+		}
+		if !reflect.DeepEqual(retval.Interface(), v) {
+			t.Errorf("%#v != %#v", retval.Interface(), v)
+		}
+	}
+}
+
+func TestBuiltinExt(t *testing.T) {
+	for _, codec := range []*ExtCodec{BigIntExt, BigFloatExt, BigRatExt, DurationExt} {
+		RegisterExt(codec)
+		defer UnregisterExt(codec.Type)
+	}
+	bigint, _ := new(big.Int).SetString("-123456789012345678901234567890", 10)
+	for _, i := range []struct {
+		v interface{}
+		b []byte
+	}{
+		{big.NewInt(0), []byte{0xd4, 0x10, 0x00}},
+		{big.NewInt(127), []byte{0xd4, 0x10, 0x7f}},
+		{big.NewInt(128), []byte{0xd5, 0x10, 0x00, 0x80}},
+		{big.NewInt(-1), []byte{0xd4, 0x10, 0xff}},
+		{big.NewInt(-128), []byte{0xd4, 0x10, 0x80}},
+		{big.NewInt(-129), []byte{0xd5, 0x10, 0xff, 0x7f}},
+		{bigint, []byte{0xc7, 0x0d, 0x10, 0xfe, 0x71, 0x16, 0xf0, 0x09, 0x3c, 0x8c, 0x1f, 0x11, 0xb1, 0xc0, 0xf5, 0x2e}},
+		{big.NewRat(-3, 4), []byte{0xc7, 0x06, 0x12, 0x00, 0x00, 0x00, 0x01, 0xfd, 0x04}},
+		{big.NewFloat(1.5), []byte{0xc7, 0x12, 0x11, 0x01, 0x0a, 0x00, 0x00, 0x00, 0x35, 0x00, 0x00, 0x00, 0x01, 0xc0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+		{90 * time.Second, []byte{0xd7, 0x13, 0x00, 0x00, 0x00, 0x14, 0xf4, 0x6b, 0x04, 0x00}},
+	} {
+		b := &bytes.Buffer{}
+		_, err := Pack(b, i.v)
+		if err != nil {
+			t.Error("err != nil")
+		}
+		if bytes.Compare(b.Bytes(), i.b) != 0 {
+			t.Errorf("wrong output for %v: % x", i.v, b.Bytes())
+		}
+		retval, _, e := Unpack(b)
+		if e != nil {
+			t.Error("err != nil")
+		}
+		// big values may differ in internal representation
+		if retval.Type() != reflect.TypeOf(i.v) || fmt.Sprint(retval.Interface()) != fmt.Sprint(i.v) {
+			t.Errorf("%v != %v", retval.Interface(), i.v)
+		}
+	}
+}
+
+// Registers the codecs of complex numbers until the end of the test.
+func registerComplexExt(t testing.TB) {
+	RegisterExt(Complex64Ext)
+	RegisterExt(Complex128Ext)
+	t.Cleanup(func() {
+		UnregisterExt(COMPLEX64_EXT)
+		UnregisterExt(COMPLEX128_EXT)
+	})
+}
+
+func TestPackComplex(t *testing.T) {
+	b := &bytes.Buffer{}
+	if _, err := Pack(b, complex64(1)); err != ErrNoComplexExt || b.Len() != 0 {
+		t.Error("complex64 packed without a codec", b.Bytes(), err)
+	}
+	if _, err := EncodedSize([]complex128{1}); err != ErrNoComplexExt {
+		t.Error("complex128 sized without a codec", err)
+	}
+	registerComplexExt(t)
+	for _, i := range [](interface{}){complex64(complex(1.5, -2)), complex(math.Inf(1), math.NaN()), []complex64{complex(float32(math.Inf(-1)), 0)}} {
+		_, err := Pack(b, i)
+		if err != nil {
+			t.Error("err != nil")
+		}
+	}
+	if bytes.Compare(b.Bytes(), []byte{0xd7, 0x14, 0x3f, 0xc0, 0x00, 0x00, 0xc0, 0x00, 0x00, 0x00, 0xd8, 0x15, 0x7f, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x7f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x91, 0xd7, 0x14, 0xff, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}) != 0 {
+		t.Error("wrong output", b.Bytes())
+	}
+	data := b.Bytes()
+
+	retval, _, e := Unpack(b)
+	if e != nil || retval.Interface() != complex64(complex(1.5, -2)) {
+		t.Error("wrong complex64", retval, e)
+	}
+	retval, _, e = Unpack(b)
+	if c, ok := retval.Interface().(complex128); e != nil || !ok || !math.IsInf(real(c), 1) || !math.IsNaN(imag(c)) {
+		t.Error("wrong complex128", retval, e)
+	}
+
+	var c128 complex128
+	var c64 complex64
+	var s []complex128
+	b = bytes.NewBuffer(data)
+	for _, v := range [](interface{}){&c64, &c128, &s} {
+		_, e := Decode(b, v)
+		if e != nil {
+			t.Error("err != nil", e)
+		}
+	}
+	if c64 != complex(1.5, -2) || !math.IsInf(real(c128), 1) || !math.IsNaN(imag(c128)) || len(s) != 1 || !math.IsInf(real(s[0]), -1) {
+		t.Error("wrong decoded values", c64, c128, s)
+	}
+}
+
+// Complex numbers only claim their extension types once registered, so
+// that peers can use the same numbers for their own types.
+func TestComplexExtTypes(t *testing.T) {
+	data := []byte{0xd7, 0x14, 0x3f, 0xc0, 0x00, 0x00, 0xc0, 0x00, 0x00, 0x00}
+	retval, _, e := Unpack(bytes.NewReader(data))
+	if e != nil || !reflect.DeepEqual(retval.Interface(), Ext{COMPLEX64_EXT, data[2:]}) {
+		t.Error("unregistered extension not unpacked as Ext", retval, e)
+	}
+
+	type pair [2]float32
+	RegisterExt(Complex64Ext)
+	RegisterExt(&ExtCodec{Type: COMPLEX64_EXT, GoType: reflect.TypeOf(pair{}), Decode: func(data []byte) (reflect.Value, error) {
+		return reflect.ValueOf(pair{1, 2}), nil
+	}})
+	defer UnregisterExt(COMPLEX64_EXT)
+	retval, _, e = Unpack(bytes.NewReader(data))
+	if e != nil || retval.Interface() != (pair{1, 2}) {
+		t.Error("user codec not used", retval, e)
+	}
+	// The user codec replaced Complex64Ext
+	if _, err := Marshal(complex64(1)); err != ErrNoComplexExt {
+		t.Error("complex64 packed without a codec", err)
+	}
+}
+
+// Values of extension codecs are ext nodes, whatever the kind of their Go
+// type
+func TestExtNodes(t *testing.T) {
+	RegisterExt(DurationExt)
+	defer UnregisterExt(DURATION_EXT)
+	RegisterExt(&ExtCodec{Type: 0x41, GoType: reflect.TypeOf([]uint16(nil)), Decode: func(data []byte) (reflect.Value, error) {
+		return reflect.ValueOf([]uint16{uint16(len(data))}), nil
+	}})
+	defer UnregisterExt(0x41)
+	duration := Bytes{0xd7, 0x13, 0, 0, 0, 0, 0, 0, 0, 5}
+	for _, test := range []struct {
+		data     Bytes
+		expected interface{}
+	}{
+		{duration, 5 * time.Nanosecond},
+		{Bytes{0xd5, 0x41, 1, 2}, []uint16{2}},
+	} {
+		node, _, err := UnpackNode(bytes.NewReader(append(Bytes{0x91}, test.data...)))
+		if err != nil || node.Index(0).Kind() != EXT_NODE || !reflect.DeepEqual(node.Index(0).Value().Interface(), test.expected) {
+			t.Errorf("UnpackNode(%x) = %v, %v", test.data, node, err)
+		}
+	}
+	diff, err := (&Differ{IgnoreWidths: true}).Diff(duration, Bytes{5})
+	if err != nil || len(diff) != 1 || diff[0].Kind != DIFF_TYPE {
+		t.Errorf("Diff = %v, %v", diff, err)
+	}
+}
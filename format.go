@@ -0,0 +1,297 @@
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// A Dumper writes packed values in a diagnostic notation that shows the
+// format each value is packed in:
+//
+//	5  -3  uint16(300)  int8(-100)  float32(1.5)  float64(0.1)
+//	nil  true  "text"  h'00ff'  raw16("text")  ext(-1, h'0102')
+//	[1, 2]  array16[1, 2]  {"a": 1}  map32{"a": 1}  ext8(5, h'...')
+//
+// Raw values are quoted when they are valid UTF-8 and shown as hex
+// otherwise.  Formats whose size is implied by the value, like fixed
+// arrays and positive fixnums, are written without a name.
+type Dumper struct {
+	// Nested values are written on lines of their own, indented by Indent
+	// per level, unless it is empty.
+	Indent string
+	// Prefixes every value with "@" and its offset from the start of the
+	// input, like "@12 uint8(200)".
+	Offsets bool
+	// The maximum number of arrays and maps a value may be nested in, as
+	// in Decoder.  Zero means DEFAULT_MAX_DEPTH.
+	MaxDepth int
+}
+
+type dumper struct {
+	*Dumper
+	reader io.Reader
+	writer *bufio.Writer
+	offset int
+}
+
+// Writes the next value from the reader in diagnostic notation.  Returns
+// io.EOF if the reader is empty; otherwise the value is written up to any
+// error in its data.
+func (d *Dumper) Dump(reader io.Reader, writer io.Writer) error {
+	dump := &dumper{Dumper: d, reader: reader, writer: bufio.NewWriter(writer)}
+	err := dump.value(0)
+	if _err := dump.writer.Flush(); err == nil {
+		err = _err
+	}
+	return err
+}
+
+// Returns the values packed in b in diagnostic notation, one per line.
+// Malformed data is followed by the error it caused, as in
+// "[1, !error(unexpected EOF)".
+func (d *Dumper) Format(b []byte) string {
+	buf := &bytes.Buffer{}
+	reader := bytes.NewReader(b)
+	dump := &dumper{Dumper: d, reader: reader, writer: bufio.NewWriter(buf)}
+	for reader.Len() > 0 {
+		if dump.offset > 0 {
+			dump.writer.WriteByte('\n')
+		}
+		if err := dump.value(0); err != nil {
+			dump.writer.WriteString("!error(" + err.Error() + ")")
+			break
+		}
+	}
+	dump.writer.Flush()
+	return buf.String()
+}
+
+// Writes the next value from the reader with the default Dumper, which
+// writes values on a single line without offsets.
+func Dump(reader io.Reader, writer io.Writer) error {
+	return (&Dumper{}).Dump(reader, writer)
+}
+
+// Returns the values packed in b as written by the default Dumper.
+func Format(b []byte) string {
+	return (&Dumper{}).Format(b)
+}
+
+// Reads n bytes of the current value.
+func (d *dumper) read(n uint64) ([]byte, error) {
+	data, nread, err := readBytes(d.reader, n)
+	d.offset += nread
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return data, err
+}
+
+// Reads a big-endian integer of n bytes.
+func (d *dumper) readUint(n uint64) (uint64, error) {
+	data, err := d.read(n)
+	var v uint64
+	for _, c := range data {
+		v = v<<8 | uint64(c)
+	}
+	return v, err
+}
+
+func (d *dumper) value(depth int) error {
+	offset := d.offset
+	c, n, err := readUint8(d.reader)
+	d.offset += n
+	if err != nil {
+		if depth > 0 && err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if d.Offsets {
+		d.writer.WriteString("@" + strconv.Itoa(offset) + " ")
+	}
+	w := d.writer
+	switch {
+	case c < FIXMAP:
+		w.WriteString(strconv.Itoa(int(c)))
+		return nil
+	case c >= NEGFIXNUM:
+		w.WriteString(strconv.Itoa(int(int8(c))))
+		return nil
+	case c <= FIXMAPMAX:
+		return d.container("", uint64(c-FIXMAP), true, depth)
+	case c <= FIXARRAYMAX:
+		return d.container("", uint64(c-FIXARRAY), false, depth)
+	case c <= FIXRAWMAX:
+		return d.raw("", uint64(c-FIXRAW))
+	}
+	switch c {
+	case NIL:
+		w.WriteString("nil")
+	case FALSE:
+		w.WriteString("false")
+	case TRUE:
+		w.WriteString("true")
+	case UINT8, UINT16, UINT32, UINT64:
+		size := uint64(1) << (c - UINT8)
+		v, err := d.readUint(size)
+		if err != nil {
+			return err
+		}
+		w.WriteString("uint" + strconv.Itoa(int(size*8)) + "(" + strconv.FormatUint(v, 10) + ")")
+	case INT8, INT16, INT32, INT64:
+		size := uint64(1) << (c - INT8)
+		v, err := d.readUint(size)
+		if err != nil {
+			return err
+		}
+		// Sign-extends the value from its size
+		shift := 64 - size*8
+		w.WriteString("int" + strconv.Itoa(int(size*8)) + "(" + strconv.FormatInt(int64(v<<shift)>>shift, 10) + ")")
+	case FLOAT:
+		v, err := d.readUint(4)
+		if err != nil {
+			return err
+		}
+		w.WriteString("float32(" + formatFloat(float64(math.Float32frombits(uint32(v))), 32) + ")")
+	case DOUBLE:
+		v, err := d.readUint(8)
+		if err != nil {
+			return err
+		}
+		w.WriteString("float64(" + formatFloat(math.Float64frombits(v), 64) + ")")
+	case RAW16, RAW32:
+		length, err := d.readUint(2 << (c - RAW16))
+		if err != nil {
+			return err
+		}
+		return d.raw("raw"+strconv.Itoa(16<<(c-RAW16)), length)
+	case ARRAY16, ARRAY32:
+		length, err := d.readUint(2 << (c - ARRAY16))
+		if err != nil {
+			return err
+		}
+		return d.container("array"+strconv.Itoa(16<<(c-ARRAY16)), length, false, depth)
+	case MAP16, MAP32:
+		length, err := d.readUint(2 << (c - MAP16))
+		if err != nil {
+			return err
+		}
+		return d.container("map"+strconv.Itoa(16<<(c-MAP16)), length, true, depth)
+	case FIXEXT1, FIXEXT2, FIXEXT4, FIXEXT8, FIXEXT16:
+		return d.ext("ext", 1<<(c-FIXEXT1))
+	case EXT8, EXT16, EXT32:
+		size := uint64(1) << (c - EXT8)
+		length, err := d.readUint(size)
+		if err != nil {
+			return err
+		}
+		return d.ext("ext"+strconv.Itoa(int(size*8)), length)
+	default:
+		return ErrUnsupportedCode
+	}
+	return nil
+}
+
+func formatFloat(v float64, bits int) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, bits)
+}
+
+func (d *dumper) raw(name string, length uint64) error {
+	data, err := d.read(length)
+	if err != nil {
+		return err
+	}
+	if name != "" {
+		d.writer.WriteString(name + "(")
+	}
+	if utf8.Valid(data) {
+		d.writer.WriteString(strconv.Quote(string(data)))
+	} else {
+		d.writeHex(data)
+	}
+	if name != "" {
+		d.writer.WriteByte(')')
+	}
+	return nil
+}
+
+func (d *dumper) ext(name string, length uint64) error {
+	typ, err := d.readUint(1)
+	if err != nil {
+		return err
+	}
+	data, err := d.read(length)
+	if err != nil {
+		return err
+	}
+	d.writer.WriteString(name + "(" + strconv.Itoa(int(int8(typ))) + ", ")
+	d.writeHex(data)
+	d.writer.WriteByte(')')
+	return nil
+}
+
+func (d *dumper) writeHex(data []byte) {
+	d.writer.WriteString("h'")
+	hex.NewEncoder(d.writer).Write(data)
+	d.writer.WriteByte('\'')
+}
+
+// Writes an array, or a map if isMap, of length elements.
+func (d *dumper) container(name string, length uint64, isMap bool, depth int) error {
+	open, close := byte('['), byte(']')
+	if isMap {
+		open, close = '{', '}'
+	}
+	max := d.MaxDepth
+	if max <= 0 {
+		max = DEFAULT_MAX_DEPTH
+	}
+	if depth >= max {
+		return ErrMaxDepth
+	}
+	w := d.writer
+	w.WriteString(name)
+	w.WriteByte(open)
+	for i := uint64(0); i < length; i++ {
+		if i > 0 {
+			w.WriteByte(',')
+			if d.Indent == "" {
+				w.WriteByte(' ')
+			}
+		}
+		d.newline(depth + 1)
+		if isMap {
+			if err := d.value(depth + 1); err != nil {
+				return err
+			}
+			w.WriteString(": ")
+		}
+		if err := d.value(depth + 1); err != nil {
+			return err
+		}
+	}
+	if length > 0 {
+		d.newline(depth)
+	}
+	w.WriteByte(close)
+	return nil
+}
+
+func (d *dumper) newline(depth int) {
+	if d.Indent == "" {
+		return
+	}
+	d.writer.WriteByte('\n')
+	for i := 0; i < depth; i++ {
+		d.writer.WriteString(d.Indent)
+	}
+}
@@ -0,0 +1,96 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{nil, `nil`},
+		{[]bool{true, false}, `[true, false]`},
+		{5, `5`},
+		{-3, `-3`},
+		{200, `uint8(200)`},
+		{300, `uint16(300)`},
+		{uint64(math.MaxUint64), `uint64(18446744073709551615)`},
+		{-100, `int8(-100)`},
+		{-40000, `int32(-40000)`},
+		{int64(math.MinInt64), `int64(-9223372036854775808)`},
+		{float32(1.5), `float32(1.5)`},
+		{0.1, `float64(0.1)`},
+		{math.Inf(-1), `float64(-Inf)`},
+		{math.Inf(1), `float64(+Inf)`},
+		{"a\"\n", `"a\"\n"`},
+		{[]byte{0, 0xff}, `h'00ff'`},
+		{strings.Repeat("x", 40), `raw16("` + strings.Repeat("x", 40) + `")`},
+		{[]interface{}{1, []int{}, map[string]int{}}, `[1, [], {}]`},
+		{make([]int, 16), `array16[0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0]`},
+		{map[string][]int{"a": {1}}, `{"a": [1]}`},
+		{Ext{-1, []byte{1, 2}}, `ext(-1, h'0102')`},
+		{Ext{5, []byte{1, 2, 3}}, `ext8(5, h'010203')`},
+	} {
+		data, err := Marshal(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := Format(data); s != test.expected {
+			t.Errorf("Format(%#v) = %s, want %s", test.value, s, test.expected)
+		}
+	}
+}
+
+func TestFormatMalformed(t *testing.T) {
+	for _, test := range []struct {
+		data     Bytes
+		expected string
+	}{
+		{nil, ``},
+		{Bytes{0x01, 0x02}, "1\n2"},
+		{Bytes{0x92, 0x01}, `[1, !error(unexpected EOF)`},
+		{Bytes{0x81, 0xa1}, `{!error(unexpected EOF)`},
+		{Bytes{0x91, 0xc1}, `[!error(unsupported type code)`},
+		{Bytes{RAW32, 0xff, 0xff, 0xff, 0xff}, `!error(unexpected EOF)`},
+	} {
+		if s := Format(test.data); s != test.expected {
+			t.Errorf("Format(%x) = %s, want %s", test.data, s, test.expected)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	data, _ := Marshal([]interface{}{map[string][]int{"a": {}}, 300, "x"})
+	reader := bytes.NewReader(append(data, NIL))
+	b := &bytes.Buffer{}
+	d := &Dumper{Indent: "  ", Offsets: true}
+	if err := d.Dump(reader, b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `@0 [
+  @1 {
+    @2 "a": @4 []
+  },
+  @5 uint16(300),
+  @8 "x"
+]`
+	if b.String() != expected {
+		t.Errorf("Dump = %s, want %s", b.String(), expected)
+	}
+	b.Reset()
+	if err := d.Dump(reader, b); err != nil || b.String() != "@0 nil" {
+		t.Errorf("Dump = %s, %v", b.String(), err)
+	}
+	if err := d.Dump(reader, b); err != io.EOF {
+		t.Error("err =", err)
+	}
+	if err := Dump(bytes.NewReader(Bytes{0x91}), io.Discard); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("err =", err)
+	}
+}
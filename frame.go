@@ -0,0 +1,202 @@
+package msgpack
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Selects how frames are delimited on a stream.
+type PrefixMode int
+
+const (
+	// Frames are not prefixed; each frame is one value, delimited by its
+	// own encoding.
+	NO_PREFIX PrefixMode = iota
+	// Each frame is prefixed with its length as an unsigned varint.
+	UVARINT_PREFIX
+	// Each frame is prefixed with its length as a 4 byte big-endian
+	// integer.
+	UINT32_PREFIX
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// A FrameWriter writes values to a stream as frames, each with a single
+// Write call.
+type FrameWriter struct {
+	writer io.Writer
+	prefix PrefixMode
+	buf    bytes.Buffer
+
+	// Options for packing values.
+	Encoder Encoder
+
+	// When positive, frames longer than this many bytes (not counting the
+	// prefix) are rejected with ErrFrameTooLarge.
+	MaxFrameSize int
+}
+
+// Returns a new frame writer that writes to the specified writer.
+func NewFrameWriter(writer io.Writer, prefix PrefixMode) *FrameWriter {
+	return &FrameWriter{writer: writer, prefix: prefix}
+}
+
+// Packs a given value and writes it as a frame.  Returns the number of
+// bytes written, including the prefix.
+func (fw *FrameWriter) WriteValue(value interface{}) (n int, err error) {
+	fw.buf.Reset()
+	fw.Encoder.Reset(&fw.buf)
+	if _, err := fw.Encoder.Pack(value); err != nil {
+		return 0, err
+	}
+	return fw.WriteFrame(fw.buf.Bytes())
+}
+
+// Writes an already packed value as a frame.
+func (fw *FrameWriter) WriteFrame(data []byte) (n int, err error) {
+	if fw.MaxFrameSize > 0 && len(data) > fw.MaxFrameSize {
+		return 0, ErrFrameTooLarge
+	}
+	if fw.prefix == NO_PREFIX {
+		return fw.writer.Write(data)
+	}
+	var frame []byte
+	if fw.prefix == UVARINT_PREFIX {
+		frame = binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(data)), uint64(len(data)))
+	} else {
+		if uint64(len(data)) > math.MaxUint32 {
+			return 0, ErrFrameTooLarge
+		}
+		frame = binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	}
+	return fw.writer.Write(append(frame, data...))
+}
+
+// A FrameReader reads frames written by a FrameWriter, or a plain stream
+// of consecutive values.  It can be used like a bufio.Scanner:
+//
+//	for fr.Next() {
+//		frame := fr.Bytes()
+//		...
+//	}
+//	if err := fr.Err(); err != nil {
+//		...
+//	}
+type FrameReader struct {
+	reader *bufio.Reader
+	prefix PrefixMode
+	buf    bytes.Buffer
+	frame  []byte
+	err    error
+
+	// When positive, frames longer than this many bytes (not counting the
+	// prefix) are rejected with ErrFrameTooLarge before they are read.
+	MaxFrameSize int
+}
+
+// Returns a new frame reader that reads from the specified reader.
+func NewFrameReader(reader io.Reader, prefix PrefixMode) *FrameReader {
+	return &FrameReader{reader: bufio.NewReader(reader), prefix: prefix}
+}
+
+// Reads the next frame and returns its bytes, which are valid until the
+// next call.  Returns io.EOF when the stream ends between frames and
+// io.ErrUnexpectedEOF when it ends within one.  Without a prefix, the frame
+// is one complete value, found with the logic of Skip.
+func (fr *FrameReader) ReadFrame() ([]byte, error) {
+	fr.buf.Reset()
+	var length uint64
+	switch fr.prefix {
+	case NO_PREFIX:
+		return fr.readValue()
+	case UVARINT_PREFIX:
+		l, err := binary.ReadUvarint(fr.reader)
+		if err != nil {
+			return nil, err
+		}
+		length = l
+	case UINT32_PREFIX:
+		var header [4]byte
+		if _, err := io.ReadFull(fr.reader, header[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint32(header[:]))
+	}
+	// A corrupt uvarint prefix may not fit the count CopyN takes
+	if length > math.MaxInt64 || (fr.MaxFrameSize > 0 && length > uint64(fr.MaxFrameSize)) {
+		return nil, ErrFrameTooLarge
+	}
+	// Grow the buffer as data arrives rather than trusting the prefix
+	if _, err := io.CopyN(&fr.buf, fr.reader, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return fr.buf.Bytes(), nil
+}
+
+func (fr *FrameReader) readValue() ([]byte, error) {
+	var reader io.Reader = fr.reader
+	if fr.MaxFrameSize > 0 {
+		reader = &frameLimiter{reader, fr.MaxFrameSize}
+	}
+	if _, err := NewDecoder(io.TeeReader(reader, &fr.buf)).Skip(); err != nil {
+		return nil, err
+	}
+	return fr.buf.Bytes(), nil
+}
+
+// Advances to the next frame, which is then available through Bytes.
+// Returns false when there are no more frames or an error occurred.
+func (fr *FrameReader) Next() bool {
+	if fr.err != nil {
+		return false
+	}
+	fr.frame, fr.err = fr.ReadFrame()
+	return fr.err == nil
+}
+
+// Returns the frame read by the last call to Next.
+func (fr *FrameReader) Bytes() []byte {
+	return fr.frame
+}
+
+// Returns the error that stopped Next, or nil if the stream ended between
+// frames.
+func (fr *FrameReader) Err() error {
+	if fr.err == io.EOF {
+		return nil
+	}
+	return fr.err
+}
+
+// Reads the next frame and stores the value it holds in the value pointed
+// to by v.
+func (fr *FrameReader) Decode(v interface{}) error {
+	frame, err := fr.ReadFrame()
+	if err != nil {
+		return err
+	}
+	_, err = Decode(bytes.NewReader(frame), v)
+	return err
+}
+
+// Fails with ErrFrameTooLarge once more than n bytes are read.
+type frameLimiter struct {
+	reader io.Reader
+	n      int
+}
+
+func (r *frameLimiter) Read(p []byte) (n int, err error) {
+	if len(p) > r.n {
+		return 0, ErrFrameTooLarge
+	}
+	n, err = r.reader.Read(p)
+	r.n -= n
+	return n, err
+}
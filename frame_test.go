@@ -0,0 +1,83 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFrames(t *testing.T) {
+	values := []interface{}{1, "abc", []interface{}{nil, 1.5, map[string]int{"a": 1}}, strings.Repeat("x", 70000), Ext{1, Bytes{2}}}
+	for _, prefix := range []PrefixMode{NO_PREFIX, UVARINT_PREFIX, UINT32_PREFIX} {
+		r, w := io.Pipe()
+		go func() {
+			fw := NewFrameWriter(w, prefix)
+			for _, value := range values {
+				if _, err := fw.WriteValue(value); err != nil {
+					w.CloseWithError(err)
+					return
+				}
+			}
+			w.Close()
+		}()
+		fr := NewFrameReader(iotest.OneByteReader(r), prefix)
+		i := 0
+		for ; fr.Next(); i++ {
+			b := &bytes.Buffer{}
+			Pack(b, values[i])
+			if !bytes.Equal(fr.Bytes(), b.Bytes()) {
+				t.Errorf("prefix %d: frame %d = %v, want %v", prefix, i, fr.Bytes(), b.Bytes())
+			}
+		}
+		if fr.Err() != nil || i != len(values) {
+			t.Errorf("prefix %d: read %d frames, err %v", prefix, i, fr.Err())
+		}
+	}
+}
+
+func TestFrameErrors(t *testing.T) {
+	b := &bytes.Buffer{}
+	fw := NewFrameWriter(b, UINT32_PREFIX)
+	fw.MaxFrameSize = 4
+	if _, err := fw.WriteValue("abcd"); err != ErrFrameTooLarge {
+		t.Error("err != ErrFrameTooLarge", err)
+	}
+	fw.MaxFrameSize = 0
+	fw.WriteValue("abcd")
+	if !bytes.Equal(b.Bytes(), Bytes{0, 0, 0, 5, 0xa4, 'a', 'b', 'c', 'd'}) {
+		t.Error("wrong output", b.Bytes())
+	}
+
+	fr := NewFrameReader(bytes.NewReader(b.Bytes()), UINT32_PREFIX)
+	fr.MaxFrameSize = 4
+	if _, err := fr.ReadFrame(); err != ErrFrameTooLarge {
+		t.Error("err != ErrFrameTooLarge", err)
+	}
+	fr = NewFrameReader(bytes.NewReader(b.Bytes()[:6]), UINT32_PREFIX)
+	if _, err := fr.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Error("err != io.ErrUnexpectedEOF", err)
+	}
+	// A uvarint prefix of 2^63 does not fit an int64, even without a
+	// maximum size
+	fr = NewFrameReader(bytes.NewReader(Bytes{0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, NIL}), UVARINT_PREFIX)
+	if frame, err := fr.ReadFrame(); err != ErrFrameTooLarge {
+		t.Error("err != ErrFrameTooLarge", frame, err)
+	}
+
+	fr = NewFrameReader(bytes.NewReader(Bytes{0x92, 1, 2, 0x94, 1, 2, 3, 4}), NO_PREFIX)
+	fr.MaxFrameSize = 4
+	if !fr.Next() || fr.Next() || !errors.Is(fr.Err(), ErrFrameTooLarge) {
+		t.Error("err != ErrFrameTooLarge", fr.Err())
+	}
+	fr = NewFrameReader(bytes.NewReader(Bytes{0x92, 1, 2, 0x93, 1}), NO_PREFIX)
+	var v []int
+	if err := fr.Decode(&v); err != nil || len(v) != 2 {
+		t.Error("Decode", v, err)
+	}
+	if err := fr.Decode(&v); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("err != io.ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,138 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// Seeds shared by the fuzz targets, in addition to testdata/fuzz.
+var fuzzSeeds = [][]byte{
+	{NIL},
+	{0x93, 0x01, 0xa1, 0x61, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+	{0x82, 0xa1, 0x61, 0x90, 0x01, 0xc0},
+	{0xd5, 0x01, 0x01, 0x02},
+	{RAW32, 0xff, 0xff, 0xff, 0xff},
+	{ARRAY32, 0xff, 0xff, 0xff, 0xff, NIL},
+	{0x81, 0x91, 0x01, 0x02},
+}
+
+func FuzzUnpack(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bytes.NewReader(data)
+		_, n, err := Unpack(reader)
+		if consumed := len(data) - reader.Len(); n != consumed {
+			t.Fatalf("Unpack = %d, %v; consumed %d bytes", n, err, consumed)
+		}
+		// Unlike Unpack, nodes and Skip accept any map keys
+		_, n, err = UnpackNode(bytes.NewReader(data))
+		if _n, _err := Skip(bytes.NewReader(data)); _n != n || (_err == nil) != (err == nil) {
+			t.Fatalf("Skip = %d, %v; UnpackNode = %d, %v", _n, _err, n, err)
+		}
+		// SkipValue does not limit the nesting depth
+		if rest, _err := SkipValue(data); !errors.Is(err, ErrMaxDepth) && ((_err == nil) != (err == nil) || (err == nil && len(data)-len(rest) != n)) {
+			t.Fatalf("SkipValue = %d, %v; UnpackNode = %d, %v", len(data)-len(rest), _err, n, err)
+		}
+		var v interface{}
+		Decode(bytes.NewReader(data), &v)
+	})
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	// Map keys of different integer types that pack the same, like int8(1)
+	// and int16(1), would merge on the second round trip unless the types
+	// are normalized
+	unpack := func(data []byte) (v reflect.Value, n int, err error) {
+		dec := NewDecoder(bytes.NewReader(data))
+		dec.Normalize = true
+		return dec.Unpack()
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		v, _, err := unpack(data)
+		if err != nil {
+			return
+		}
+		// Pack may choose shorter formats than data, so the stable form is
+		// the one after the first round trip
+		packed, err := Marshal(valueInterface(v))
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %v", valueInterface(v), err)
+		}
+		v, n, err := unpack(packed)
+		if err != nil || n != len(packed) {
+			t.Fatalf("Unpack(%s) = %d, %v", Format(packed), n, err)
+		}
+		repacked, err := Marshal(valueInterface(v))
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %v", valueInterface(v), err)
+		}
+		node, _, err := UnpackNode(bytes.NewReader(packed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		renode, _, err := UnpackNode(bytes.NewReader(repacked))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameNode(node, renode) {
+			t.Fatalf("round trip of %s changed %s into %s", Format(data), Format(packed), Format(repacked))
+		}
+	})
+}
+
+// Compares nodes exactly, including the Go types of scalars and the bits of
+// floats, but ignoring the order of map entries.
+func sameNode(a *Node, b *Node) bool {
+	if a.kind != b.kind {
+		return false
+	}
+	switch a.kind {
+	case NIL_NODE:
+		return true
+	case ARRAY_NODE:
+		if len(a.elems) != len(b.elems) {
+			return false
+		}
+		for i := range a.elems {
+			if !sameNode(a.elems[i], b.elems[i]) {
+				return false
+			}
+		}
+		return true
+	case MAP_NODE:
+		if len(a.elems) != len(b.elems) {
+			return false
+		}
+		used := make([]bool, len(b.elems))
+	entries:
+		for i := range a.keys {
+			for j := range b.keys {
+				if !used[j] && sameNode(a.keys[i], b.keys[j]) && sameNode(a.elems[i], b.elems[j]) {
+					used[j] = true
+					continue entries
+				}
+			}
+			return false
+		}
+		return true
+	}
+	if a.value.Type() != b.value.Type() {
+		return false
+	}
+	switch a.value.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return math.Float64bits(a.value.Float()) == math.Float64bits(b.value.Float())
+	case reflect.Complex64, reflect.Complex128:
+		ca, cb := a.value.Complex(), b.value.Complex()
+		return math.Float64bits(real(ca)) == math.Float64bits(real(cb)) && math.Float64bits(imag(ca)) == math.Float64bits(imag(cb))
+	}
+	return reflect.DeepEqual(a.value.Interface(), b.value.Interface())
+}
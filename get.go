@@ -0,0 +1,132 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+)
+
+var ErrNotFound = errors.New("path not found")
+
+// Finds the value at a path in the packed value at the front of b and
+// returns its packed bytes, which share the memory of b.  Each element of
+// the path is either an integer indexing an array or a key of a map,
+// compared as by Node.Get.  Siblings of the values on the path are skipped
+// without being unpacked.  Returns ErrNotFound if an index is out of
+// range, a key is missing or a value on the path is not a container.
+func Get(b []byte, path ...interface{}) ([]byte, error) {
+	b, err := walk(b, path)
+	if err != nil {
+		return nil, err
+	}
+	rest, err := SkipValue(b)
+	if err != nil {
+		return nil, err
+	}
+	return b[:len(b)-len(rest)], nil
+}
+
+// Returns the bytes of b starting at the value at path.
+func walk(b []byte, path []interface{}) ([]byte, error) {
+	for _, elem := range path {
+		if len(b) == 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		var err error
+		switch {
+		case isArrayCode(b[0]):
+			b, err = getIndex(b, elem)
+		case isMapCode(b[0]):
+			b, err = getKey(b, elem)
+		default:
+			err = ErrNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Finds the value at a path like Get and decodes it into the value pointed
+// to by v.
+func GetValue(b []byte, v interface{}, path ...interface{}) error {
+	value, err := Get(b, path...)
+	if err != nil {
+		return err
+	}
+	_, err = ReadValue(value, v)
+	return err
+}
+
+// Returns the bytes of the array element at index.
+func getIndex(b []byte, index interface{}) ([]byte, error) {
+	var i uint64
+	switch _index := reflect.ValueOf(index); _index.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if _index.Int() < 0 {
+			return nil, ErrNotFound
+		}
+		i = uint64(_index.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i = _index.Uint()
+	default:
+		return nil, ErrNotFound
+	}
+	length, b, err := ReadArrayHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	if i >= uint64(length) {
+		return nil, ErrNotFound
+	}
+	for ; i > 0; i-- {
+		if b, err = SkipValue(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Returns the bytes of the map value with a key matching key.
+func getKey(b []byte, key interface{}) ([]byte, error) {
+	length, b, err := ReadMapHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < length; i++ {
+		var match bool
+		if match, b, err = matchKey(b, key); err != nil {
+			return nil, err
+		}
+		if match {
+			return b, nil
+		}
+		if b, err = SkipValue(b); err != nil {
+			return nil, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Reports whether the packed value at the front of b matches key and
+// returns the bytes following it.  Raw keys are compared in place; other
+// keys are unpacked as nodes.
+func matchKey(b []byte, key interface{}) (match bool, rest []byte, err error) {
+	if s, ok := key.(string); ok && len(b) > 0 && isRawCode(b[0]) {
+		length, rest, err := readRawHeader(b, nil)
+		if err != nil {
+			return false, b, err
+		}
+		return string(rest[:length]) == s, rest[length:], nil
+	}
+	if rest, err = SkipValue(b); err != nil {
+		return false, b, err
+	}
+	node, _, err := UnpackNode(bytes.NewReader(b[:len(b)-len(rest)]))
+	if err != nil {
+		return false, b, err
+	}
+	return node.matches(key), rest, nil
+}
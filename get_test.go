@@ -0,0 +1,76 @@
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	data, err := Marshal(map[interface{}]interface{}{
+		"headers": map[string]interface{}{"tenant": "acme", "ids": []int{1, 2, 300}},
+		"body":    []interface{}{nil, map[int]string{-1: "neg", 7: "seven"}},
+		int8(5):   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path     []interface{}
+		expected interface{}
+	}{
+		{[]interface{}{"headers", "tenant"}, "acme"},
+		{[]interface{}{"headers", "ids", 2}, 300},
+		{[]interface{}{"headers", "ids", uint8(0)}, 1},
+		{[]interface{}{[]byte("body"), 1, -1}, "neg"},
+		{[]interface{}{"body", 1, uint(7)}, "seven"},
+		{[]interface{}{"body", 0}, nil},
+		{[]interface{}{5}, true},
+	} {
+		value, err := Get(data, test.path...)
+		if err != nil {
+			t.Errorf("Get(%v): %v", test.path, err)
+			continue
+		}
+		expected, _ := Marshal(test.expected)
+		if !bytes.Equal(value, expected) {
+			t.Errorf("Get(%v) = %s, want %s", test.path, Format(value), Format(expected))
+		}
+	}
+
+	if value, err := Get(data); err != nil || !bytes.Equal(value, data) {
+		t.Errorf("Get() = %x, %v", value, err)
+	}
+	var tenant string
+	if err := GetValue(data, &tenant, "headers", "tenant"); err != nil || tenant != "acme" {
+		t.Errorf("GetValue = %q, %v", tenant, err)
+	}
+
+	for _, path := range [][]interface{}{
+		{"missing"},
+		{"headers", "ids", 3},
+		{"headers", "ids", -1},
+		{"headers", "ids", "0"},
+		{"headers", "tenant", "x"},
+		{"body", 0, 0},
+		{"body", 1, 8},
+		{int8(6)},
+	} {
+		if value, err := Get(data, path...); err != ErrNotFound {
+			t.Errorf("Get(%v) = %x, %v; want ErrNotFound", path, value, err)
+		}
+	}
+}
+
+func TestGetMalformed(t *testing.T) {
+	// An array keeps the value sought after the one skipped
+	data, _ := Marshal([]interface{}{map[string][]int{"a": {1, 2}}, "x"})
+	for i := 0; i < len(data); i++ {
+		if _, err := Get(data[:i], 1); err != io.ErrUnexpectedEOF {
+			t.Errorf("Get(%x): %v", data[:i], err)
+		}
+	}
+	if _, err := Get([]byte{0x81, 0xc1, 0x01}, "a"); err != ErrUnsupportedCode {
+		t.Error("err =", err)
+	}
+}
@@ -2,6 +2,7 @@ package msgpack
 
 import (
 	"bytes"
+	"errors"
 	"math"
 	"reflect"
 	"testing"
@@ -162,7 +163,7 @@ func TestPackInt16(t *testing.T) {
 			t.Error("err != nil")
 		}
 	}
-	if bytes.Compare(b.Bytes(), []byte{0xd1, 0x80, 0x00, 0xd1, 0x80, 0x01, 0xd1, 0xff, 0x7d, 0xd1, 0xff, 0x7e, 0xd1, 0xff, 0x7f, 0xd0, 0x80, 0xd0, 0x81, 0xd0, 0xde, 0xd0, 0xdf, 0xe0, 0xe1, 0x00, 0x01, 0x7e, 0x7f, 0xd1, 0x00, 0x80, 0xd1, 0x00, 0x81, 0xd1, 0x00, 0x82, 0xd1, 0x7f, 0xfd, 0xd1, 0x7f, 0xfe, 0xd1, 0x7f, 0xff}) != 0 {
+	if bytes.Compare(b.Bytes(), []byte{0xd1, 0x80, 0x00, 0xd1, 0x80, 0x01, 0xd1, 0xff, 0x7d, 0xd1, 0xff, 0x7e, 0xd1, 0xff, 0x7f, 0xd0, 0x80, 0xd0, 0x81, 0xd0, 0xde, 0xd0, 0xdf, 0xe0, 0xe1, 0x00, 0x01, 0x7e, 0x7f, 0xcc, 0x80, 0xcc, 0x81, 0xcc, 0x82, 0xcd, 0x7f, 0xfd, 0xcd, 0x7f, 0xfe, 0xcd, 0x7f, 0xff}) != 0 {
 		t.Error("wrong output", b.Bytes())
 	}
 }
@@ -175,7 +176,7 @@ func TestPackInt32(t *testing.T) {
 			t.Error("err != nil")
 		}
 	}
-	if bytes.Compare(b.Bytes(), []byte{0xd2, 0x80, 0x00, 0x00, 0x00, 0xd2, 0x80, 0x00, 0x00, 0x01, 0xd2, 0x80, 0x00, 0x00, 0x02, 0xd2, 0xff, 0xff, 0x7f, 0xfd, 0xd2, 0xff, 0xff, 0x7f, 0xfe, 0xd2, 0xff, 0xff, 0x7f, 0xff, 0xd1, 0x80, 0x00, 0xd1, 0x80, 0x01, 0xd1, 0xff, 0x7d, 0xd1, 0xff, 0x7e, 0xd1, 0xff, 0x7f, 0xd0, 0x80, 0xd0, 0x81, 0xd0, 0xde, 0xd0, 0xdf, 0xe0, 0xe1, 0x00, 0x01, 0x7e, 0x7f, 0xd1, 0x00, 0x80, 0xd1, 0x00, 0x81, 0xd1, 0x00, 0x82, 0xd1, 0x7f, 0xfd, 0xd1, 0x7f, 0xfe, 0xd1, 0x7f, 0xff, 0xd2, 0x00, 0x00, 0x80, 0x00, 0xd2, 0x00, 0x00, 0x80, 0x01, 0xd2, 0x00, 0x00, 0x80, 0x02, 0xd2, 0x7f, 0xff, 0xff, 0xfd, 0xd2, 0x7f, 0xff, 0xff, 0xfe, 0xd2, 0x7f, 0xff, 0xff, 0xff}) != 0 {
+	if bytes.Compare(b.Bytes(), []byte{0xd2, 0x80, 0x00, 0x00, 0x00, 0xd2, 0x80, 0x00, 0x00, 0x01, 0xd2, 0x80, 0x00, 0x00, 0x02, 0xd2, 0xff, 0xff, 0x7f, 0xfd, 0xd2, 0xff, 0xff, 0x7f, 0xfe, 0xd2, 0xff, 0xff, 0x7f, 0xff, 0xd1, 0x80, 0x00, 0xd1, 0x80, 0x01, 0xd1, 0xff, 0x7d, 0xd1, 0xff, 0x7e, 0xd1, 0xff, 0x7f, 0xd0, 0x80, 0xd0, 0x81, 0xd0, 0xde, 0xd0, 0xdf, 0xe0, 0xe1, 0x00, 0x01, 0x7e, 0x7f, 0xcc, 0x80, 0xcc, 0x81, 0xcc, 0x82, 0xcd, 0x7f, 0xfd, 0xcd, 0x7f, 0xfe, 0xcd, 0x7f, 0xff, 0xcd, 0x80, 0x00, 0xcd, 0x80, 0x01, 0xcd, 0x80, 0x02, 0xce, 0x7f, 0xff, 0xff, 0xfd, 0xce, 0x7f, 0xff, 0xff, 0xfe, 0xce, 0x7f, 0xff, 0xff, 0xff}) != 0 {
 		t.Error("wrong output", b.Bytes())
 	}
 }
@@ -188,6 +189,21 @@ func TestPackInt64(t *testing.T) {
 			t.Error("err != nil")
 		}
 	}
+	if bytes.Compare(b.Bytes(), []byte{0xd3, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xd3, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xd3, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xfd, 0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xfe, 0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xff, 0xd2, 0x80, 0x00, 0x00, 0x00, 0xd2, 0x80, 0x00, 0x00, 0x01, 0xd2, 0x80, 0x00, 0x00, 0x02, 0xd2, 0xff, 0xff, 0x7f, 0xfd, 0xd2, 0xff, 0xff, 0x7f, 0xfe, 0xd2, 0xff, 0xff, 0x7f, 0xff, 0xd1, 0x80, 0x00, 0xd1, 0x80, 0x01, 0xd1, 0xff, 0x7d, 0xd1, 0xff, 0x7e, 0xd1, 0xff, 0x7f, 0xd0, 0x80, 0xd0, 0x81, 0xd0, 0xde, 0xd0, 0xdf, 0xe0, 0xe1, 0x00, 0x01, 0x7e, 0x7f, 0xcc, 0x80, 0xcc, 0x81, 0xcc, 0x82, 0xcd, 0x7f, 0xfd, 0xcd, 0x7f, 0xfe, 0xcd, 0x7f, 0xff, 0xcd, 0x80, 0x00, 0xcd, 0x80, 0x01, 0xcd, 0x80, 0x02, 0xce, 0x7f, 0xff, 0xff, 0xfd, 0xce, 0x7f, 0xff, 0xff, 0xfe, 0xce, 0x7f, 0xff, 0xff, 0xff, 0xce, 0x80, 0x00, 0x00, 0x00, 0xce, 0x80, 0x00, 0x00, 0x01, 0xce, 0x80, 0x00, 0x00, 0x02, 0xcf, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0xcf, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0xcf, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02}) != 0 {
+		t.Error("wrong output", b.Bytes())
+	}
+}
+
+func TestPackSignedInts(t *testing.T) {
+	b := &bytes.Buffer{}
+	enc := NewEncoder(b)
+	enc.SignedInts = true
+	for _, i := range []int64{-9223372036854775808, -9223372036854775807, -9223372036854775806, -2147483651, -2147483650, -2147483649, -2147483648, -2147483647, -2147483646, -32771, -32770, -32769, -32768, -32767, -131, -130, -129, -128, -127, -34, -33, -32, -31, 0, 1, 126, 127, 128, 129, 130, 32765, 32766, 32767, 32768, 32769, 32770, 2147483645, 2147483646, 2147483647, 2147483648, 2147483649, 2147483650, 4294967296, 4294967297, 4294967298} {
+		_, err := enc.Pack(i)
+		if err != nil {
+			t.Error("err != nil")
+		}
+	}
 	if bytes.Compare(b.Bytes(), []byte{0xd3, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xd3, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0xd3, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xfd, 0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xfe, 0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f, 0xff, 0xff, 0xff, 0xd2, 0x80, 0x00, 0x00, 0x00, 0xd2, 0x80, 0x00, 0x00, 0x01, 0xd2, 0x80, 0x00, 0x00, 0x02, 0xd2, 0xff, 0xff, 0x7f, 0xfd, 0xd2, 0xff, 0xff, 0x7f, 0xfe, 0xd2, 0xff, 0xff, 0x7f, 0xff, 0xd1, 0x80, 0x00, 0xd1, 0x80, 0x01, 0xd1, 0xff, 0x7d, 0xd1, 0xff, 0x7e, 0xd1, 0xff, 0x7f, 0xd0, 0x80, 0xd0, 0x81, 0xd0, 0xde, 0xd0, 0xdf, 0xe0, 0xe1, 0x00, 0x01, 0x7e, 0x7f, 0xd1, 0x00, 0x80, 0xd1, 0x00, 0x81, 0xd1, 0x00, 0x82, 0xd1, 0x7f, 0xfd, 0xd1, 0x7f, 0xfe, 0xd1, 0x7f, 0xff, 0xd2, 0x00, 0x00, 0x80, 0x00, 0xd2, 0x00, 0x00, 0x80, 0x01, 0xd2, 0x00, 0x00, 0x80, 0x02, 0xd2, 0x7f, 0xff, 0xff, 0xfd, 0xd2, 0x7f, 0xff, 0xff, 0xfe, 0xd2, 0x7f, 0xff, 0xff, 0xff, 0xd3, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x00, 0xd3, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x01, 0xd3, 0x00, 0x00, 0x00, 0x00, 0x80, 0x00, 0x00, 0x02, 0xd3, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0xd3, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0xd3, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02}) != 0 {
 		t.Error("wrong output", b.Bytes())
 	}
@@ -269,6 +285,42 @@ func TestPackArray(t *testing.T) {
 	}
 }
 
+// The slices taking a fast path pack like the Pack*Array functions, also
+// when the encoder reuses its scratch buffer for a shorter slice.
+func TestPackSliceFastPaths(t *testing.T) {
+	int64s := []int64{-9223372036854775808, -2147483649, -2147483648, -32769, -32768, -129, -128, -33, -32, -1, 0, 127, 128, 255, 256, 65535, 65536, 4294967295, 4294967296, 9223372036854775807}
+	var int32s []int32
+	var ints []int
+	for _, i := range int64s {
+		if i == int64(int32(i)) {
+			int32s = append(int32s, int32(i))
+		}
+		if i == int64(int(i)) {
+			ints = append(ints, int(i))
+		}
+	}
+	floats := []float64{0, -1.5, 1e300, math.Inf(-1)}
+	b := &bytes.Buffer{}
+	enc := NewEncoder(b)
+	for _, v := range []interface{}{int32s, int32s[:2], int64s, int64s[:2], ints, ints[:2], floats, floats[:2]} {
+		expected := &bytes.Buffer{}
+		switch _v := v.(type) {
+		case []int32:
+			PackInt32Array(expected, _v)
+		case []int64:
+			PackInt64Array(expected, _v)
+		case []int:
+			PackIntArray(expected, _v)
+		case []float64:
+			PackFloat64Array(expected, _v)
+		}
+		b.Reset()
+		if n, err := enc.Pack(v); err != nil || n != b.Len() || !bytes.Equal(b.Bytes(), expected.Bytes()) {
+			t.Errorf("Pack(%T %v) = %d, %v, %x", v, v, n, err, b.Bytes())
+		}
+	}
+}
+
 func TestPackMap(t *testing.T) {
 	b := &bytes.Buffer{}
 	_, err := PackMap(b, reflect.ValueOf(map[int]int{0: 1, 2: 3, 4: 5}))
@@ -276,14 +328,11 @@ func TestPackMap(t *testing.T) {
 		t.Error("err != nil")
 	}
 
-	// map ordering is no longer deterministic -- check all possible orderings :(
-	if bytes.Compare(b.Bytes(), []byte{0x83, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}) != 0 &&
-		bytes.Compare(b.Bytes(), []byte{0x83, 0x00, 0x01, 0x04, 0x05, 0x02, 0x03}) != 0 &&
-		bytes.Compare(b.Bytes(), []byte{0x83, 0x02, 0x03, 0x00, 0x01, 0x04, 0x05}) != 0 &&
-		bytes.Compare(b.Bytes(), []byte{0x83, 0x02, 0x03, 0x04, 0x05, 0x00, 0x01}) != 0 &&
-		bytes.Compare(b.Bytes(), []byte{0x83, 0x04, 0x05, 0x00, 0x01, 0x02, 0x03}) != 0 &&
-		bytes.Compare(b.Bytes(), []byte{0x83, 0x04, 0x05, 0x02, 0x03, 0x00, 0x01}) != 0 {
-		t.Error("wrong output", b.Bytes())
+	// map ordering is no longer deterministic, so the entries are compared
+	// as a set
+	expected := []byte{0x83, 0x00, 0x01, 0x02, 0x03, 0x04, 0x05}
+	if diff, err := Diff(expected, b.Bytes()); err != nil || len(diff) > 0 || b.Len() != len(expected) {
+		t.Error("wrong output", b.Bytes(), diff, err)
 	}
 }
 
@@ -295,7 +344,7 @@ func TestPack(t *testing.T) {
 			t.Error("err != nil")
 		}
 	}
-	if bytes.Compare(b.Bytes(), []byte{0xc0, 0xc2, 0xc3, 0x00, 0x01, 0x02, 0x03, 0x7f, 0xe0, 0xff, 0xd0, 0xdf, 0xd1, 0x00, 0x80, 0xA7, 'a', 's', 't', 'r', 'i', 'n', 'g'}) != 0 {
+	if bytes.Compare(b.Bytes(), []byte{0xc0, 0xc2, 0xc3, 0x00, 0x01, 0x02, 0x03, 0x7f, 0xe0, 0xff, 0xd0, 0xdf, 0xcc, 0x80, 0xA7, 'a', 's', 't', 'r', 'i', 'n', 'g'}) != 0 {
 		t.Error("wrong output")
 	}
 }
@@ -375,3 +424,138 @@ func TestUnpackMapWithStringKey(t *testing.T) {
 		t.Errorf("Expected %q, got %q", expected, kv)
 	}
 }
+
+func TestUnpackNormalized(t *testing.T) {
+	b := bytes.NewBuffer([]byte{0x01, 0xff, 0xcc, 0x80, 0xcd, 0x01, 0x00, 0xd1, 0xff, 0x00, 0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xca, 0x3e, 0x80, 0x00, 0x00, 0xa3, 'a', 'b', 'c', 0x92, 0x01, 0xa1, 'x', 0x81, 0xa1, 'k', 0xcc, 0xff, 0x81, 0x01, 0x02})
+	dec := NewDecoder(b)
+	dec.Normalize = true
+	for _, v := range [](interface{}){
+		int64(1), int64(-1), int64(128), int64(256), int64(-256), uint64(18446744073709551615), float64(.25), "abc",
+		[]interface{}{int64(1), "x"},
+		map[string]interface{}{"k": int64(255)},
+		map[interface{}]interface{}{int64(1): int64(2)}} {
+		retval, _, e := dec.Unpack()
+		if e != nil {
+			t.Error("err != nil")
+		}
+		if !reflect.DeepEqual(retval.Interface(), v) {
+			t.Errorf("%#v != %#v", retval.Interface(), v)
+		}
+	}
+}
+
+func TestUnpackStringKeyedMap(t *testing.T) {
+	data := []byte{0x92, 0x81, 0xa1, 'a', 0x81, 0xa1, 'b', 0x01, 0x81, 0x01, 0x02}
+	dec := NewDecoder(bytes.NewBuffer(data))
+	dec.MapMode = MAP_STRING_KEYS
+	retval, _, e := dec.Unpack()
+	if e != nil {
+		t.Error("err != nil")
+	}
+	expected := []interface{}{map[string]interface{}{"a": map[string]interface{}{"b": int8(1)}}, map[interface{}]interface{}{int8(1): int8(2)}}
+	if !reflect.DeepEqual(retval.Interface(), expected) {
+		t.Errorf("%#v != %#v", retval.Interface(), expected)
+	}
+
+	dec = NewDecoder(bytes.NewBuffer(data))
+	dec.MapMode = MAP_STRICT_STRING_KEYS
+	_, _, e = dec.Unpack()
+	if !errors.Is(e, ErrNonStringKey) {
+		t.Error("err != ErrNonStringKey", e)
+	}
+}
+
+func TestUnpackNode(t *testing.T) {
+	b := bytes.NewBuffer([]byte{0x83, 0xa4, 'n', 'a', 'm', 'e', 0xa3, 'a', 'b', 'c', 0xa5, 'i', 't', 'e', 'm', 's', 0x93, 0x01, 0xcd, 0x01, 0x00, 0xc0, 0xcc, 0x80, 0xca, 0x3e, 0x80, 0x00, 0x00})
+	node, _, e := UnpackNode(b)
+	if e != nil {
+		t.Error("err != nil")
+	}
+	if node.Kind() != MAP_NODE || node.Len() != 3 {
+		t.Error("wrong map node", node.Kind())
+	}
+	if node.Key(0).Str() != "name" || node.Get("name").Str() != "abc" {
+		t.Error("wrong name")
+	}
+	items := node.Get("items")
+	if items.Kind() != ARRAY_NODE || items.Len() != 3 {
+		t.Error("wrong array node")
+	}
+	if items.Index(1).Value().Interface() != uint16(256) || items.Index(1).Int() != 256 {
+		t.Error("wrong element", items.Index(1).Value())
+	}
+	if items.Index(2).Kind() != NIL_NODE {
+		t.Error("wrong nil element")
+	}
+	if node.Get(128).Float() != .25 || node.Get(int8(128-256)) != nil || node.Get("missing") != nil {
+		t.Error("wrong lookup by integer key")
+	}
+	expected := map[interface{}]interface{}{"name": []byte("abc"), "items": []interface{}{int8(1), uint16(256), nil}, uint8(128): float32(.25)}
+	if v, err := node.Interface(); err != nil || !reflect.DeepEqual(v, expected) {
+		t.Errorf("%#v, %v != %#v", v, err, expected)
+	}
+
+	// Nodes accept any keys, but Go maps do not
+	node, _, e = UnpackNode(bytes.NewReader([]byte{0x81, 0x91, 0x01, 0x02}))
+	if e != nil || node.Key(0).Len() != 1 {
+		t.Fatal(e)
+	}
+	if _, err := node.Interface(); err != ErrUnhashableKey {
+		t.Error("err != ErrUnhashableKey", err)
+	}
+}
+
+func TestPackFloat(t *testing.T) {
+	b := &bytes.Buffer{}
+	for _, i := range [](interface{}){float32(.25), float64(.1), float32(math.Inf(-1))} {
+		_, err := Pack(b, i)
+		if err != nil {
+			t.Error("err != nil")
+		}
+	}
+	_, err := PackValue(b, reflect.ValueOf([]float32{1.5}))
+	if err != nil {
+		t.Error("err != nil")
+	}
+	if bytes.Compare(b.Bytes(), []byte{0xca, 0x3e, 0x80, 0x00, 0x00, 0xcb, 0x3f, 0xb9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a, 0xca, 0xff, 0x80, 0x00, 0x00, 0x91, 0xca, 0x3f, 0xc0, 0x00, 0x00}) != 0 {
+		t.Error("wrong output", b.Bytes())
+	}
+	for _, v := range [](interface{}){float32(.25), float64(.1), float32(math.Inf(-1)), []interface{}{float32(1.5)}} {
+		retval, _, e := Unpack(b)
+		if e != nil {
+			t.Error("err != nil")
+		}
+		if !reflect.DeepEqual(retval.Interface(), v) {
+			t.Errorf("%#v != %#v", retval.Interface(), v)
+		}
+	}
+}
+
+func TestPackCompactFloats(t *testing.T) {
+	b := &bytes.Buffer{}
+	enc := NewEncoder(b)
+	enc.CompactFloats = true
+	for _, i := range [](interface{}){float64(.25), float64(.1), math.Inf(1), []float64{-2, math.NaN()}} {
+		_, err := enc.Pack(i)
+		if err != nil {
+			t.Error("err != nil")
+		}
+	}
+	if bytes.Compare(b.Bytes(), []byte{0xca, 0x3e, 0x80, 0x00, 0x00, 0xcb, 0x3f, 0xb9, 0x99, 0x99, 0x99, 0x99, 0x99, 0x9a, 0xca, 0x7f, 0x80, 0x00, 0x00, 0x92, 0xca, 0xc0, 0x00, 0x00, 0x00, 0xcb, 0x7f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01}) != 0 {
+		t.Error("wrong output", b.Bytes())
+	}
+}
+
+func TestSkip(t *testing.T) {
+	b := bytes.NewBuffer([]byte{0x82, 0xa1, 'a', 0x92, 0xcd, 0x01, 0x00, 0xc0, 0xda, 0x00, 0x01, 'b', 0xd7, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0x2a})
+	n, e := Skip(b)
+	if e != nil {
+		t.Error("err != nil")
+	}
+	if n != 22 {
+		t.Error("n != 22", n)
+	}
+	if bytes.Compare(b.Bytes(), []byte{0x2a}) != 0 {
+		t.Error("wrong remainder", b.Bytes())
+	}
+}
@@ -0,0 +1,552 @@
+// Package msgpackjson transcodes between JSON and msgpack.  Values are
+// converted token by token, without building interface{} trees: ToJSON
+// writes each part of a msgpack value as soon as it is read, and FromJSON
+// only buffers the packed output, since msgpack arrays and maps are
+// preceded by their lengths.
+//
+// Raw values become JSON strings and JSON strings become raw values.  The
+// msgpack spec implemented here does not tell text from binary data, so
+// raw values that are not valid UTF-8 are treated as binary.
+package msgpackjson
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/msgpack/msgpack-go"
+)
+
+// Selects how raw values that are not valid UTF-8 are written to JSON.
+type BinaryMode int
+
+const (
+	// Write them as base64 strings in the standard encoding.
+	BINARY_BASE64 BinaryMode = iota
+	// Fail with ErrBinary.
+	BINARY_ERROR
+)
+
+// Selects how map keys other than raw values are written to JSON.
+type KeyMode int
+
+const (
+	// Write the JSON of the key as a string, so that the integer key 1
+	// becomes "1" and the array key [1,2] becomes "[1,2]".
+	KEYS_STRINGIFY KeyMode = iota
+	// Fail with msgpack.ErrNonStringKey.
+	KEYS_ERROR
+)
+
+// Selects how NaN and infinite floats, which JSON cannot represent, are
+// written.
+type FloatMode int
+
+const (
+	// Fail with ErrNonFinite.
+	NONFINITE_ERROR FloatMode = iota
+	// Write null.
+	NONFINITE_NULL
+	// Write the strings "NaN", "+Inf" and "-Inf".
+	NONFINITE_STRING
+)
+
+// Selects how extension values are written to JSON.
+type ExtMode int
+
+const (
+	// Fail with ErrExt.
+	EXT_ERROR ExtMode = iota
+	// Write them as objects like {"type":1,"data":"AQI="}, with the payload
+	// in base64.
+	EXT_OBJECT
+)
+
+var (
+	ErrBinary    = errors.New("raw value is not valid UTF-8")
+	ErrNonFinite = errors.New("NaN or infinite float")
+	ErrExt       = errors.New("extension value has no JSON representation")
+)
+
+// A Transcoder converts values between JSON and msgpack.  Its options other
+// than MaxDepth only affect ToJSON.  The zero value writes binary data as
+// base64 and map keys as strings, and fails on NaN, infinite floats and
+// extension values.
+type Transcoder struct {
+	Binary    BinaryMode
+	MapKeys   KeyMode
+	NonFinite FloatMode
+	Ext       ExtMode
+	// The maximum number of arrays and maps a value may be nested in, in
+	// either direction, with values nested deeper failing with
+	// msgpack.ErrMaxDepth.  Zero means msgpack.DEFAULT_MAX_DEPTH.
+	MaxDepth int
+}
+
+func (t *Transcoder) maxDepth() int {
+	if t.MaxDepth <= 0 {
+		return msgpack.DEFAULT_MAX_DEPTH
+	}
+	return t.MaxDepth
+}
+
+// Reads a msgpack value from the reader and writes it as JSON to the
+// writer, with the options of a zero Transcoder.
+func ToJSON(writer io.Writer, reader io.Reader) error {
+	return (&Transcoder{}).ToJSON(writer, reader)
+}
+
+// Reads a JSON value from the reader and writes it packed to the writer.
+func FromJSON(writer io.Writer, reader io.Reader) error {
+	return (&Transcoder{}).FromJSON(writer, reader)
+}
+
+// Where JSON is written: a bufio.Writer, or a bytes.Buffer for stringified
+// map keys.
+type jsonWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type toJSON struct {
+	*Transcoder
+	reader  byteReader
+	writer  jsonWriter
+	scratch [64]byte
+	// The number of arrays and maps the current value is nested in
+	depth int
+}
+
+// Reads a msgpack value from the reader and writes it as JSON to the
+// writer.  Returns io.EOF if the reader is empty.  The reader is read past
+// the value unless it implements io.ByteReader.  On error, part of the
+// JSON may have been written.
+func (t *Transcoder) ToJSON(writer io.Writer, reader io.Reader) error {
+	r, ok := reader.(byteReader)
+	if !ok {
+		r = bufio.NewReader(reader)
+	}
+	w := bufio.NewWriter(writer)
+	tr := &toJSON{Transcoder: t, reader: r, writer: w}
+	c, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if err := tr.value(c); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (tr *toJSON) byte() (byte, error) {
+	c, err := tr.reader.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return c, err
+}
+
+// Reads a big-endian unsigned integer of n bytes.
+func (tr *toJSON) uint(n int) (uint64, error) {
+	if _, err := io.ReadFull(tr.reader, tr.scratch[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	var v uint64
+	for _, b := range tr.scratch[:n] {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// Reads the payload of a raw or extension value.  Like the decoder of
+// package msgpack, it only trusts lengths up to msgpack.MAX_PREALLOC_BYTES
+// for allocations.
+func (tr *toJSON) bytes(length uint64) ([]byte, error) {
+	if length <= msgpack.MAX_PREALLOC_BYTES {
+		data := make([]byte, length)
+		if _, err := io.ReadFull(tr.reader, data); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return data, nil
+	}
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, tr.reader, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Writes the value whose first byte c has already been read.
+func (tr *toJSON) value(c byte) error {
+	switch {
+	case c < msgpack.FIXMAP:
+		return tr.writeUint(uint64(c))
+	case c >= msgpack.NEGFIXNUM:
+		return tr.writeInt(int64(int8(c)))
+	case c <= msgpack.FIXMAPMAX:
+		return tr.mapEntries(uint64(c - msgpack.FIXMAP))
+	case c <= msgpack.FIXARRAYMAX:
+		return tr.array(uint64(c - msgpack.FIXARRAY))
+	case c <= msgpack.FIXRAWMAX:
+		return tr.raw(uint64(c - msgpack.FIXRAW))
+	}
+	switch c {
+	case msgpack.NIL:
+		_, err := tr.writer.WriteString("null")
+		return err
+	case msgpack.FALSE:
+		_, err := tr.writer.WriteString("false")
+		return err
+	case msgpack.TRUE:
+		_, err := tr.writer.WriteString("true")
+		return err
+	case msgpack.FLOAT:
+		bits, err := tr.uint(4)
+		if err != nil {
+			return err
+		}
+		return tr.writeFloat(float64(math.Float32frombits(uint32(bits))), 32)
+	case msgpack.DOUBLE:
+		bits, err := tr.uint(8)
+		if err != nil {
+			return err
+		}
+		return tr.writeFloat(math.Float64frombits(bits), 64)
+	case msgpack.UINT8, msgpack.UINT16, msgpack.UINT32, msgpack.UINT64:
+		v, err := tr.uint(1 << (c - msgpack.UINT8))
+		if err != nil {
+			return err
+		}
+		return tr.writeUint(v)
+	case msgpack.INT8, msgpack.INT16, msgpack.INT32, msgpack.INT64:
+		size := 1 << (c - msgpack.INT8)
+		v, err := tr.uint(size)
+		if err != nil {
+			return err
+		}
+		// Sign-extend from the width of the format
+		shift := 64 - 8*size
+		return tr.writeInt(int64(v<<shift) >> shift)
+	case msgpack.RAW16, msgpack.RAW32, msgpack.ARRAY16, msgpack.ARRAY32, msgpack.MAP16, msgpack.MAP32:
+		size := 2
+		if c == msgpack.RAW32 || c == msgpack.ARRAY32 || c == msgpack.MAP32 {
+			size = 4
+		}
+		length, err := tr.uint(size)
+		if err != nil {
+			return err
+		}
+		switch c {
+		case msgpack.RAW16, msgpack.RAW32:
+			return tr.raw(length)
+		case msgpack.ARRAY16, msgpack.ARRAY32:
+			return tr.array(length)
+		}
+		return tr.mapEntries(length)
+	case msgpack.FIXEXT1, msgpack.FIXEXT2, msgpack.FIXEXT4, msgpack.FIXEXT8, msgpack.FIXEXT16:
+		return tr.ext(1 << (c - msgpack.FIXEXT1))
+	case msgpack.EXT8, msgpack.EXT16, msgpack.EXT32:
+		length, err := tr.uint(1 << (c - msgpack.EXT8))
+		if err != nil {
+			return err
+		}
+		return tr.ext(length)
+	}
+	return msgpack.ErrUnsupportedCode
+}
+
+func (tr *toJSON) writeUint(v uint64) error {
+	_, err := tr.writer.Write(strconv.AppendUint(tr.scratch[:0], v, 10))
+	return err
+}
+
+func (tr *toJSON) writeInt(v int64) error {
+	_, err := tr.writer.Write(strconv.AppendInt(tr.scratch[:0], v, 10))
+	return err
+}
+
+func (tr *toJSON) writeFloat(v float64, bits int) error {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		switch tr.NonFinite {
+		case NONFINITE_NULL:
+			_, err := tr.writer.WriteString("null")
+			return err
+		case NONFINITE_STRING:
+			s := `"NaN"`
+			if math.IsInf(v, 1) {
+				s = `"+Inf"`
+			} else if math.IsInf(v, -1) {
+				s = `"-Inf"`
+			}
+			_, err := tr.writer.WriteString(s)
+			return err
+		}
+		return ErrNonFinite
+	}
+	_, err := tr.writer.Write(strconv.AppendFloat(tr.scratch[:0], v, 'g', -1, bits))
+	return err
+}
+
+func (tr *toJSON) raw(length uint64) error {
+	data, err := tr.bytes(length)
+	if err != nil {
+		return err
+	}
+	if utf8.Valid(data) {
+		return writeString(tr.writer, data)
+	}
+	if tr.Binary == BINARY_ERROR {
+		return ErrBinary
+	}
+	return tr.writeBase64(data)
+}
+
+func (tr *toJSON) writeBase64(data []byte) error {
+	tr.writer.WriteByte('"')
+	enc := base64.NewEncoder(base64.StdEncoding, tr.writer)
+	enc.Write(data)
+	enc.Close()
+	return tr.writer.WriteByte('"')
+}
+
+// Enters an array or map, failing with msgpack.ErrMaxDepth if that nests
+// it too deeply.
+func (tr *toJSON) enter() error {
+	if tr.depth >= tr.maxDepth() {
+		return msgpack.ErrMaxDepth
+	}
+	tr.depth++
+	return nil
+}
+
+func (tr *toJSON) array(length uint64) error {
+	if err := tr.enter(); err != nil {
+		return err
+	}
+	defer func() { tr.depth-- }()
+	tr.writer.WriteByte('[')
+	for i := uint64(0); i < length; i++ {
+		if i > 0 {
+			tr.writer.WriteByte(',')
+		}
+		c, err := tr.byte()
+		if err != nil {
+			return err
+		}
+		if err := tr.value(c); err != nil {
+			return err
+		}
+	}
+	return tr.writer.WriteByte(']')
+}
+
+func (tr *toJSON) mapEntries(length uint64) error {
+	if err := tr.enter(); err != nil {
+		return err
+	}
+	defer func() { tr.depth-- }()
+	tr.writer.WriteByte('{')
+	for i := uint64(0); i < length; i++ {
+		if i > 0 {
+			tr.writer.WriteByte(',')
+		}
+		c, err := tr.byte()
+		if err != nil {
+			return err
+		}
+		if err := tr.key(c); err != nil {
+			return err
+		}
+		tr.writer.WriteByte(':')
+		c, err = tr.byte()
+		if err != nil {
+			return err
+		}
+		if err := tr.value(c); err != nil {
+			return err
+		}
+	}
+	return tr.writer.WriteByte('}')
+}
+
+// Writes the map key whose first byte c has already been read.
+func (tr *toJSON) key(c byte) error {
+	if (c >= msgpack.FIXRAW && c <= msgpack.FIXRAWMAX) || c == msgpack.RAW16 || c == msgpack.RAW32 {
+		return tr.value(c)
+	}
+	if tr.MapKeys == KEYS_ERROR {
+		return msgpack.ErrNonStringKey
+	}
+	var buf bytes.Buffer
+	sub := &toJSON{Transcoder: tr.Transcoder, reader: tr.reader, writer: &buf, depth: tr.depth}
+	if err := sub.value(c); err != nil {
+		return err
+	}
+	return writeString(tr.writer, buf.Bytes())
+}
+
+func (tr *toJSON) ext(length uint64) error {
+	typ, err := tr.byte()
+	if err != nil {
+		return err
+	}
+	data, err := tr.bytes(length)
+	if err != nil {
+		return err
+	}
+	if tr.Ext == EXT_ERROR {
+		return ErrExt
+	}
+	tr.writer.WriteString(`{"type":`)
+	tr.writeInt(int64(int8(typ)))
+	tr.writer.WriteString(`,"data":`)
+	if err := tr.writeBase64(data); err != nil {
+		return err
+	}
+	return tr.writer.WriteByte('}')
+}
+
+const hex = "0123456789abcdef"
+
+// Writes valid UTF-8 as a JSON string.
+func writeString(w jsonWriter, s []byte) error {
+	w.WriteByte('"')
+	start := 0
+	for i, c := range s {
+		if c >= 0x20 && c != '"' && c != '\\' {
+			continue
+		}
+		w.Write(s[start:i])
+		switch c {
+		case '"', '\\':
+			w.WriteByte('\\')
+			w.WriteByte(c)
+		case '\n':
+			w.WriteString(`\n`)
+		case '\r':
+			w.WriteString(`\r`)
+		case '\t':
+			w.WriteString(`\t`)
+		default:
+			w.WriteString(`\u00`)
+			w.WriteByte(hex[c>>4])
+			w.WriteByte(hex[c&0xf])
+		}
+		start = i + 1
+	}
+	w.Write(s[start:])
+	return w.WriteByte('"')
+}
+
+// Reads a JSON value from the reader and writes it packed to the writer.
+// Integers that fit in 64 bits are packed as integers and all other
+// numbers as float64.  Returns io.EOF if the reader holds no value.  The
+// reader may be read past the value.
+func (t *Transcoder) FromJSON(writer io.Writer, reader io.Reader) error {
+	dec := json.NewDecoder(reader)
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	b, err := t.appendToken(nil, dec, tok, 0)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(b)
+	return err
+}
+
+// Room left for the header of an array or map before its elements, which
+// is shrunk to the actual header size once the length is known.
+const MAX_HEADER_SIZE = 5
+
+// Appends the value starting with tok, which is nested in depth arrays
+// and maps.
+func (t *Transcoder) appendToken(b []byte, dec *json.Decoder, tok json.Token, depth int) ([]byte, error) {
+	switch tok := tok.(type) {
+	case nil:
+		return msgpack.AppendNil(b), nil
+	case bool:
+		return msgpack.AppendBool(b, tok), nil
+	case string:
+		return msgpack.AppendString(b, tok), nil
+	case json.Number:
+		return appendNumber(b, tok)
+	}
+	delim := tok.(json.Delim)
+	if depth >= t.maxDepth() {
+		return b, msgpack.ErrMaxDepth
+	}
+	start := len(b)
+	b = append(b, make([]byte, MAX_HEADER_SIZE)...)
+	var n int
+	for ; dec.More(); n++ {
+		if delim == '{' {
+			// Keys are strings, as Token checks
+			key, err := dec.Token()
+			if err != nil {
+				return b, err
+			}
+			b = msgpack.AppendString(b, key.(string))
+		}
+		tok, err := dec.Token()
+		if err != nil {
+			return b, err
+		}
+		if b, err = t.appendToken(b, dec, tok, depth+1); err != nil {
+			return b, err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return b, err
+	}
+	var header []byte
+	if delim == '{' {
+		header = msgpack.AppendMapHeader(make([]byte, 0, MAX_HEADER_SIZE), n)
+	} else {
+		header = msgpack.AppendArrayHeader(make([]byte, 0, MAX_HEADER_SIZE), n)
+	}
+	copy(b[start+len(header):], b[start+MAX_HEADER_SIZE:])
+	copy(b[start:], header)
+	return b[:len(b)-MAX_HEADER_SIZE+len(header)], nil
+}
+
+func appendNumber(b []byte, number json.Number) ([]byte, error) {
+	s := number.String()
+	if !strings.ContainsAny(s, ".eE") {
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return msgpack.AppendInt64(b, v), nil
+		}
+		if v, err := strconv.ParseUint(s, 10, 64); err == nil {
+			return msgpack.AppendUint64(b, v), nil
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return b, err
+	}
+	return msgpack.AppendFloat64(b, v), nil
+}
@@ -0,0 +1,210 @@
+package msgpackjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/msgpack/msgpack-go"
+)
+
+func transcode(t *testing.T, tr *Transcoder, value interface{}) (string, error) {
+	data, err := msgpack.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &bytes.Buffer{}
+	err = tr.ToJSON(b, bytes.NewReader(data))
+	return b.String(), err
+}
+
+func TestToJSON(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{nil, `null`},
+		{true, `true`},
+		{0, `0`},
+		{200, `200`},
+		{uint64(math.MaxUint64), `18446744073709551615`},
+		{-1, `-1`},
+		{-200, `-200`},
+		{int64(math.MinInt64), `-9223372036854775808`},
+		{float32(1.5), `1.5`},
+		{0.1, `0.1`},
+		{1e300, `1e+300`},
+		{"", `""`},
+		{"a\"b\\c\n\x01é", `"a\"b\\c\n\u0001é"`},
+		{strings.Repeat("x", 300), `"` + strings.Repeat("x", 300) + `"`},
+		{[]byte{0xff, 0}, `"/wA="`},
+		{[]int{}, `[]`},
+		{[]interface{}{1, "a", nil, []int{2}}, `[1,"a",null,[2]]`},
+		{map[string]int{"a": 1}, `{"a":1}`},
+		{map[int]bool{-1: true}, `{"-1":true}`},
+		{map[float64]int{1.5: 1}, `{"1.5":1}`},
+		{map[[2]int]int{{1, 2}: 3}, `{"[1,2]":3}`},
+		{map[string]map[string][]int{"a": {"b": {1}}}, `{"a":{"b":[1]}}`},
+	} {
+		s, err := transcode(t, &Transcoder{}, test.value)
+		if err != nil || s != test.expected {
+			t.Errorf("ToJSON(%#v) = %s, %v; want %s", test.value, s, err, test.expected)
+		}
+		if !json.Valid([]byte(s)) {
+			t.Errorf("ToJSON(%#v) = %s is not valid JSON", test.value, s)
+		}
+	}
+}
+
+func TestToJSONOptions(t *testing.T) {
+	for _, test := range []struct {
+		tr       Transcoder
+		value    interface{}
+		expected string
+		err      error
+	}{
+		{Transcoder{Binary: BINARY_ERROR}, []byte{0xff}, ``, ErrBinary},
+		{Transcoder{Binary: BINARY_ERROR}, []byte("ok"), `"ok"`, nil},
+		{Transcoder{MapKeys: KEYS_ERROR}, map[int]int{1: 2}, ``, msgpack.ErrNonStringKey},
+		{Transcoder{}, math.NaN(), ``, ErrNonFinite},
+		{Transcoder{NonFinite: NONFINITE_NULL}, []float64{math.Inf(1), 1}, `[null,1]`, nil},
+		{Transcoder{NonFinite: NONFINITE_STRING}, []float64{math.NaN(), math.Inf(1), math.Inf(-1)}, `["NaN","+Inf","-Inf"]`, nil},
+		{Transcoder{}, msgpack.Ext{Type: 1, Data: []byte{1, 2}}, ``, ErrExt},
+		{Transcoder{Ext: EXT_OBJECT}, []msgpack.Ext{{Type: -1, Data: []byte{1, 2}}, {Type: 5, Data: make([]byte, 300)}}, `[{"type":-1,"data":"AQI="},{"type":5,"data":"` + strings.Repeat("A", 400) + `"}]`, nil},
+	} {
+		s, err := transcode(t, &test.tr, test.value)
+		if err != test.err || (err == nil && s != test.expected) {
+			t.Errorf("%+v: ToJSON(%#v) = %s, %v; want %s, %v", test.tr, test.value, s, err, test.expected, test.err)
+		}
+	}
+}
+
+func TestToJSONMalformed(t *testing.T) {
+	for _, test := range []struct {
+		data []byte
+		err  error
+	}{
+		{nil, io.EOF},
+		{[]byte{0x92, 1}, io.ErrUnexpectedEOF},
+		{[]byte{msgpack.RAW32, 0xff, 0xff, 0xff, 0xff, 'x'}, io.ErrUnexpectedEOF},
+		{[]byte{msgpack.UINT16, 1}, io.ErrUnexpectedEOF},
+		{[]byte{0x91, 0xc1}, msgpack.ErrUnsupportedCode},
+		{append(bytes.Repeat([]byte{0x91}, 3000000), 1), msgpack.ErrMaxDepth},
+		{append(bytes.Repeat([]byte{0x81, 0x91}, 1000000), 1, 1), msgpack.ErrMaxDepth},
+	} {
+		if err := ToJSON(io.Discard, bytes.NewReader(test.data)); err != test.err {
+			t.Errorf("ToJSON(%x): %v, want %v", test.data, err, test.err)
+		}
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	for _, test := range []struct {
+		json     string
+		expected interface{}
+	}{
+		{`null`, nil},
+		{`false`, false},
+		{`1`, int64(1)},
+		{`-1`, int64(-1)},
+		{`18446744073709551615`, uint64(math.MaxUint64)},
+		{`18446744073709551616`, 18446744073709551616.0},
+		{`1.5`, 1.5},
+		{`1e3`, 1000.0},
+		{`"aé\n"`, "aé\n"},
+		{`[]`, []interface{}{}},
+		{` [1, [2, {}], "x"] `, []interface{}{int64(1), []interface{}{int64(2), map[string]interface{}{}}, "x"}},
+		{`{"a": {"b": null}, "c": [true]}`, map[string]interface{}{"a": map[string]interface{}{"b": nil}, "c": []interface{}{true}}},
+	} {
+		b := &bytes.Buffer{}
+		if err := FromJSON(b, strings.NewReader(test.json)); err != nil {
+			t.Errorf("FromJSON(%s): %v", test.json, err)
+			continue
+		}
+		dec := msgpack.NewDecoder(b)
+		dec.Normalize = true
+		v, _, err := dec.Unpack()
+		if err != nil || !reflect.DeepEqual(interfaceOf(v), test.expected) || b.Len() != 0 {
+			t.Errorf("FromJSON(%s) = %#v, %v", test.json, interfaceOf(v), err)
+		}
+	}
+
+	for _, s := range []string{``, `[1,`, `{"a"}`, `1e999`} {
+		if err := FromJSON(io.Discard, strings.NewReader(s)); err == nil {
+			t.Errorf("FromJSON(%s) succeeded", s)
+		}
+	}
+	if err := FromJSON(io.Discard, strings.NewReader("")); !errors.Is(err, io.EOF) {
+		t.Error("err != io.EOF", err)
+	}
+	tr := &Transcoder{MaxDepth: 2}
+	if err := tr.FromJSON(io.Discard, strings.NewReader(`[{"a":[]}]`)); err != msgpack.ErrMaxDepth {
+		t.Error("err != msgpack.ErrMaxDepth", err)
+	}
+	b := &bytes.Buffer{}
+	if err := tr.FromJSON(b, strings.NewReader(`[{"a":1}]`)); err != nil || b.Len() != 5 {
+		t.Error("wrong output", b.Bytes(), err)
+	}
+}
+
+func interfaceOf(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Interface()
+}
+
+func TestRoundTrip(t *testing.T) {
+	// Long containers cross the sizes of the fixed and 16 bit headers
+	long := make([]interface{}, 70000)
+	for i := range long {
+		long[i] = i
+	}
+	wide := make(map[string]interface{})
+	for i := 0; i < 20; i++ {
+		wide[strings.Repeat("k", i)] = []interface{}{i, strings.Repeat("v", 40*i)}
+	}
+	for _, value := range []interface{}{long, wide, map[string]interface{}{"a": long[:17]}} {
+		expected, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packed := &bytes.Buffer{}
+		if err := FromJSON(packed, bytes.NewReader(expected)); err != nil {
+			t.Fatal(err)
+		}
+		b := &bytes.Buffer{}
+		if err := ToJSON(b, packed); err != nil {
+			t.Fatal(err)
+		}
+		var v, w interface{}
+		json.Unmarshal(expected, &v)
+		json.Unmarshal(b.Bytes(), &w)
+		if !reflect.DeepEqual(v, w) {
+			t.Errorf("round trip of %.40s gave %.40s", expected, b.Bytes())
+		}
+	}
+}
+
+func TestToJSONStream(t *testing.T) {
+	data, _ := msgpack.Marshal([]int{1})
+	data = append(data, 0xa1, 'x')
+	reader := bytes.NewReader(data)
+	b := &bytes.Buffer{}
+	for {
+		if err := ToJSON(b, reader); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		b.WriteByte(' ')
+	}
+	if b.String() != `[1] "x" ` {
+		t.Error("stream =", b.String())
+	}
+}
@@ -0,0 +1,314 @@
+package msgpack
+
+import (
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// The kind of value a Node holds.
+type NodeKind int
+
+const (
+	NIL_NODE NodeKind = iota
+	BOOL_NODE
+	INT_NODE
+	UINT_NODE
+	FLOAT_NODE
+	RAW_NODE
+	ARRAY_NODE
+	MAP_NODE
+	EXT_NODE
+)
+
+var nodeKindNames = []string{
+	NIL_NODE:   "nil",
+	BOOL_NODE:  "bool",
+	INT_NODE:   "int",
+	UINT_NODE:  "uint",
+	FLOAT_NODE: "float",
+	RAW_NODE:   "raw",
+	ARRAY_NODE: "array",
+	MAP_NODE:   "map",
+	EXT_NODE:   "ext",
+}
+
+func (k NodeKind) String() string {
+	if int(k) < len(nodeKindNames) {
+		return nodeKindNames[k]
+	}
+	return "kind" + strconv.Itoa(int(k))
+}
+
+// A Node is an unpacked value that keeps the exact Go type each scalar was
+// decoded to (int8, uint16, float32, ...) and the order of map entries.
+// Arrays and maps are navigated with Index, Key and Get.
+type Node struct {
+	kind  NodeKind
+	value reflect.Value // scalars
+	elems []*Node       // array elements or map values
+	keys  []*Node       // map keys
+}
+
+func newNode(v reflect.Value) *Node {
+	if !v.IsValid() {
+		return &Node{kind: NIL_NODE}
+	}
+	if node, ok := v.Interface().(*Node); ok {
+		return node
+	}
+	node := &Node{value: v}
+	if v.Type() == extType || extCodecForGoType(v.Type()) != nil {
+		node.kind = EXT_NODE
+		return node
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		node.kind = BOOL_NODE
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		node.kind = INT_NODE
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		node.kind = UINT_NODE
+	case reflect.Float32, reflect.Float64:
+		node.kind = FLOAT_NODE
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			node.kind = RAW_NODE
+		} else {
+			node.kind = EXT_NODE
+		}
+	default:
+		node.kind = EXT_NODE
+	}
+	return node
+}
+
+func (dec *Decoder) unpackArrayNode(nelems uint) (v reflect.Value, n int, err error) {
+	if e := dec.enter(); e != nil {
+		return reflect.Value{}, 0, e
+	}
+	defer dec.leave()
+	var i uint
+	var nbytesread int
+	retval := &Node{kind: ARRAY_NODE, elems: make([]*Node, 0, preallocLen(nelems))}
+
+	for i = 0; i < nelems; i++ {
+		dec.pushIndex(int(i))
+		v, n, err = dec.unpack(true)
+		nbytesread += n
+		if err != nil {
+			return reflect.Value{}, nbytesread, err
+		}
+		dec.pop()
+		retval.elems = append(retval.elems, newNode(v))
+	}
+	return reflect.ValueOf(retval), nbytesread, nil
+}
+
+func (dec *Decoder) unpackMapNode(nelems uint) (v reflect.Value, n int, err error) {
+	if e := dec.enter(); e != nil {
+		return reflect.Value{}, 0, e
+	}
+	defer dec.leave()
+	var i uint
+	var nbytesread int
+	var k reflect.Value
+	retval := &Node{kind: MAP_NODE, elems: make([]*Node, 0, preallocLen(nelems)), keys: make([]*Node, 0, preallocLen(nelems))}
+
+	for i = 0; i < nelems; i++ {
+		k, n, err = dec.unpack(true)
+		nbytesread += n
+		if err != nil {
+			return reflect.Value{}, nbytesread, err
+		}
+		dec.pushKey(newNode(k).value)
+		v, n, err = dec.unpack(true)
+		nbytesread += n
+		if err != nil {
+			return reflect.Value{}, nbytesread, err
+		}
+		dec.pop()
+		retval.keys = append(retval.keys, newNode(k))
+		retval.elems = append(retval.elems, newNode(v))
+	}
+	return reflect.ValueOf(retval), nbytesread, nil
+}
+
+// Returns the kind of the node.
+func (node *Node) Kind() NodeKind {
+	return node.kind
+}
+
+// Returns the number of elements of an array node or entries of a map
+// node.  It panics for other kinds.
+func (node *Node) Len() int {
+	node.mustBe(ARRAY_NODE, MAP_NODE)
+	return len(node.elems)
+}
+
+// Returns the i'th element of an array node, or the value of the i'th
+// entry of a map node in wire order.
+func (node *Node) Index(i int) *Node {
+	node.mustBe(ARRAY_NODE, MAP_NODE)
+	return node.elems[i]
+}
+
+// Returns the key of the i'th entry of a map node in wire order.
+func (node *Node) Key(i int) *Node {
+	node.mustBe(MAP_NODE)
+	return node.keys[i]
+}
+
+// Looks up key in a map node and returns the corresponding value, or nil
+// if there is no such key.  Strings match raw keys, integers match
+// integer keys of any width and signedness.
+func (node *Node) Get(key interface{}) *Node {
+	node.mustBe(MAP_NODE)
+	for i, k := range node.keys {
+		if k.matches(key) {
+			return node.elems[i]
+		}
+	}
+	return nil
+}
+
+func (node *Node) matches(key interface{}) bool {
+	if key == nil {
+		return node.kind == NIL_NODE
+	}
+	switch _key := reflect.ValueOf(key); _key.Kind() {
+	case reflect.String:
+		return node.kind == RAW_NODE && string(node.value.Bytes()) == _key.String()
+	case reflect.Slice:
+		return node.kind == RAW_NODE && _key.Type().Elem().Kind() == reflect.Uint8 && string(node.value.Bytes()) == string(_key.Bytes())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := _key.Int()
+		return (node.kind == INT_NODE && node.value.Int() == i) ||
+			(node.kind == UINT_NODE && i >= 0 && node.value.Uint() == uint64(i))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := _key.Uint()
+		return (node.kind == UINT_NODE && node.value.Uint() == u) ||
+			(node.kind == INT_NODE && node.value.Int() >= 0 && uint64(node.value.Int()) == u)
+	case reflect.Bool:
+		return node.kind == BOOL_NODE && node.value.Bool() == _key.Bool()
+	case reflect.Float32, reflect.Float64:
+		return node.kind == FLOAT_NODE && node.value.Float() == _key.Float()
+	}
+	return false
+}
+
+// Returns the value of a bool node.
+func (node *Node) Bool() bool {
+	node.mustBe(BOOL_NODE)
+	return node.value.Bool()
+}
+
+// Returns the value of an integer node as int64.  Unsigned values beyond
+// the int64 range wrap around.
+func (node *Node) Int() int64 {
+	node.mustBe(INT_NODE, UINT_NODE)
+	if node.kind == UINT_NODE {
+		return int64(node.value.Uint())
+	}
+	return node.value.Int()
+}
+
+// Returns the value of an integer node as uint64.  Negative values wrap
+// around.
+func (node *Node) Uint() uint64 {
+	node.mustBe(INT_NODE, UINT_NODE)
+	if node.kind == INT_NODE {
+		return uint64(node.value.Int())
+	}
+	return node.value.Uint()
+}
+
+// Returns the value of a float node as float64.
+func (node *Node) Float() float64 {
+	node.mustBe(FLOAT_NODE)
+	return node.value.Float()
+}
+
+// Returns the value of a raw node as string.
+func (node *Node) Str() string {
+	node.mustBe(RAW_NODE)
+	return string(node.value.Bytes())
+}
+
+// Returns the value of a raw node.
+func (node *Node) Bytes() []byte {
+	node.mustBe(RAW_NODE)
+	return node.value.Bytes()
+}
+
+// Returns the value of a scalar node with the Go type it was decoded to.
+// For extension nodes this is an Ext, or the value produced by the
+// registered codec.  The result is invalid for nil nodes.
+func (node *Node) Value() reflect.Value {
+	node.mustBe(NIL_NODE, BOOL_NODE, INT_NODE, UINT_NODE, FLOAT_NODE, RAW_NODE, EXT_NODE)
+	return node.value
+}
+
+// Converts the node into the value Unpack would have returned for it.
+// Like Unpack, it returns ErrUnhashableKey for maps with keys that cannot
+// be Go map keys, such as arrays.
+func (node *Node) Interface() (interface{}, error) {
+	switch node.kind {
+	case NIL_NODE:
+		return nil, nil
+	case ARRAY_NODE:
+		retval := make([]interface{}, len(node.elems))
+		for i, elem := range node.elems {
+			v, err := elem.Interface()
+			if err != nil {
+				return nil, err
+			}
+			retval[i] = v
+		}
+		return retval, nil
+	case MAP_NODE:
+		retval := make(map[interface{}]interface{}, len(node.elems))
+		for i, key := range node.keys {
+			k, err := key.Interface()
+			if err != nil {
+				return nil, err
+			}
+			if key.kind == RAW_NODE {
+				k = key.Str()
+			} else if k != nil && !reflect.TypeOf(k).Comparable() {
+				return nil, ErrUnhashableKey
+			}
+			v, err := node.elems[i].Interface()
+			if err != nil {
+				return nil, err
+			}
+			retval[k] = v
+		}
+		return retval, nil
+	}
+	return node.value.Interface(), nil
+}
+
+func (node *Node) mustBe(kinds ...NodeKind) {
+	for _, kind := range kinds {
+		if node.kind == kind {
+			return
+		}
+	}
+	panic("call of Node method on " + node.kind.String() + " node")
+}
+
+// Reads a value from the decoder's reader and unpacks it into a Node.
+func (dec *Decoder) UnpackNode() (node *Node, n int, err error) {
+	start := dec.begin()
+	v, n, err := dec.unpack(true)
+	if err != nil {
+		return nil, n, dec.wrapError(start, err)
+	}
+	return newNode(v), n, nil
+}
+
+// Reads a value from the reader and unpacks it into a Node.
+func UnpackNode(reader io.Reader) (node *Node, n int, err error) {
+	return NewDecoder(reader).UnpackNode()
+}
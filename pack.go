@@ -1,7 +1,9 @@
 package msgpack
 
 import (
+	"encoding"
 	"io"
+	"math"
 	"os"
 	"reflect"
 	"unsafe"
@@ -58,6 +60,41 @@ const (
 
 type Bytes []byte
 
+// A Marshaler packs itself into a msgpack value.  MarshalMsgpack returns
+// the complete packed value, which is written as is.
+type Marshaler interface {
+	MarshalMsgpack() ([]byte, error)
+}
+
+var (
+	marshalerType       = reflect.TypeOf((*Marshaler)(nil)).Elem()
+	binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// An Encoder packs values and writes them to an output stream.
+type Encoder struct {
+	writer io.Writer
+
+	// When set, float64 values that convert to float32 without loss are
+	// packed in the shorter float format.
+	CompactFloats bool
+
+	// When set, values of signed integer types are packed in the signed
+	// formats (or as positive fixnum) even if they are non-negative, for
+	// peers that tell signed and unsigned values apart.
+	SignedInts bool
+
+	// The elements of slices taking a fast path are packed here and
+	// written at once.
+	scratch []byte
+}
+
+// Returns a new encoder that writes to the specified writer.
+func NewEncoder(writer io.Writer) *Encoder {
+	return &Encoder{writer: writer}
+}
+
 // Packs a given value and writes it into the specified writer.
 func PackUint8(writer io.Writer, value uint8) (n int, err error) {
 	// Assume the numbers outside of range is the least common case
@@ -105,8 +142,9 @@ func PackUint(writer io.Writer, value uint) (n int, err error) {
 	return 0, os.ErrNotExist // never get here
 }
 
-// Packs a given value and writes it into the specified writer.
-func PackInt8(writer io.Writer, value int8) (n int, err error) {
+// The packSignedInt functions choose the shortest signed format for a
+// value, so that signed types stay signed on the wire.
+func packSignedInt8(writer io.Writer, value int8) (n int, err error) {
 	// Assume the numbers outside of range is the least common case
 	if value < -SPECIAL_INT8 {
 		return writer.Write(Bytes{INT8, byte(value)})
@@ -114,31 +152,64 @@ func PackInt8(writer io.Writer, value int8) (n int, err error) {
 	return writer.Write(Bytes{byte(value)})
 }
 
-// Packs a given value and writes it into the specified writer.
-func PackInt16(writer io.Writer, value int16) (n int, err error) {
+func packSignedInt16(writer io.Writer, value int16) (n int, err error) {
 	// Assume the numbers outside of range is the least common case
 	if value < -SPECIAL_INT16 || value >= SPECIAL_INT16 {
 		return writer.Write(Bytes{INT16, byte(uint16(value) >> 8), byte(value)})
 	}
-	return PackInt8(writer, int8(value))
+	return packSignedInt8(writer, int8(value))
 }
 
-// Packs a given value and writes it into the specified writer.
-func PackInt32(writer io.Writer, value int32) (n int, err error) {
+func packSignedInt32(writer io.Writer, value int32) (n int, err error) {
 	// Assume the numbers outside of range is the least common case
 	if value < -SPECIAL_INT32 || value >= SPECIAL_INT32 {
 		return writer.Write(Bytes{INT32, byte(uint32(value) >> 24), byte(uint32(value) >> 16), byte(uint32(value) >> 8), byte(value)})
 	}
-	return PackInt16(writer, int16(value))
+	return packSignedInt16(writer, int16(value))
 }
 
-// Packs a given value and writes it into the specified writer.
-func PackInt64(writer io.Writer, value int64) (n int, err error) {
+func packSignedInt64(writer io.Writer, value int64) (n int, err error) {
 	// Assume the numbers outside of range is the least common case
 	if value < -SPECIAL_INT64 || value >= SPECIAL_INT64 {
 		return writer.Write(Bytes{INT64, byte(uint64(value) >> 56), byte(uint64(value) >> 48), byte(uint64(value) >> 40), byte(uint64(value) >> 32), byte(uint64(value) >> 24), byte(uint64(value) >> 16), byte(uint64(value) >> 8), byte(value)})
 	}
-	return PackInt32(writer, int32(value))
+	return packSignedInt32(writer, int32(value))
+}
+
+// Packs a given value and writes it into the specified writer.  Non-negative
+// values are packed in the unsigned formats.
+func PackInt8(writer io.Writer, value int8) (n int, err error) {
+	if value >= 0 {
+		return PackUint8(writer, uint8(value))
+	}
+	return packSignedInt8(writer, value)
+}
+
+// Packs a given value and writes it into the specified writer.  Non-negative
+// values are packed in the unsigned formats.
+func PackInt16(writer io.Writer, value int16) (n int, err error) {
+	if value >= 0 {
+		return PackUint16(writer, uint16(value))
+	}
+	return packSignedInt16(writer, value)
+}
+
+// Packs a given value and writes it into the specified writer.  Non-negative
+// values are packed in the unsigned formats.
+func PackInt32(writer io.Writer, value int32) (n int, err error) {
+	if value >= 0 {
+		return PackUint32(writer, uint32(value))
+	}
+	return packSignedInt32(writer, value)
+}
+
+// Packs a given value and writes it into the specified writer.  Non-negative
+// values are packed in the unsigned formats.
+func PackInt64(writer io.Writer, value int64) (n int, err error) {
+	if value >= 0 {
+		return PackUint64(writer, uint64(value))
+	}
+	return packSignedInt64(writer, value)
 }
 
 // Packs a given value and writes it into the specified writer.
@@ -167,12 +238,28 @@ func PackBool(writer io.Writer, value bool) (n int, err error) {
 
 // Packs a given value and writes it into the specified writer.
 func PackFloat32(writer io.Writer, value float32) (n int, err error) {
-	return PackUint32(writer, *(*uint32)(unsafe.Pointer(&value)))
+	bits := *(*uint32)(unsafe.Pointer(&value))
+	return writer.Write(Bytes{FLOAT, byte(bits >> 24), byte(bits >> 16), byte(bits >> 8), byte(bits)})
 }
 
 // Packs a given value and writes it into the specified writer.
 func PackFloat64(writer io.Writer, value float64) (n int, err error) {
-	return PackUint64(writer, *(*uint64)(unsafe.Pointer(&value)))
+	bits := *(*uint64)(unsafe.Pointer(&value))
+	return writer.Write(Bytes{DOUBLE, byte(bits >> 56), byte(bits >> 48), byte(bits >> 40), byte(bits >> 32), byte(bits >> 24), byte(bits >> 16), byte(bits >> 8), byte(bits)})
+}
+
+func (enc *Encoder) packInt64(value int64) (n int, err error) {
+	if enc.SignedInts {
+		return packSignedInt64(enc.writer, value)
+	}
+	return PackInt64(enc.writer, value)
+}
+
+func (enc *Encoder) packFloat64(value float64) (n int, err error) {
+	if enc.CompactFloats && !math.IsNaN(value) && float64(float32(value)) == value {
+		return PackFloat32(enc.writer, float32(value))
+	}
+	return PackFloat64(enc.writer, value)
 }
 
 // Packs a given value and writes it into the specified writer.
@@ -186,7 +273,7 @@ func PackBytes(writer io.Writer, value []byte) (n int, err error) {
 		n2, err := writer.Write(value)
 		return n1 + n2, err
 	} else if length < MAX16BIT {
-		n1, err := writer.Write(Bytes{RAW16, byte(length >> 16), byte(length)})
+		n1, err := writer.Write(Bytes{RAW16, byte(length >> 8), byte(length)})
 		if err != nil {
 			return n1, err
 		}
@@ -201,131 +288,70 @@ func PackBytes(writer io.Writer, value []byte) (n int, err error) {
 	return n1 + n2, err
 }
 
-// Packs a given value and writes it into the specified writer.
-func PackUint16Array(writer io.Writer, value []uint16) (n int, err error) {
-	length := len(value)
+// Writes the header of an array with the given number of elements.
+func packArrayHeader(writer io.Writer, length int) (n int, err error) {
 	if length < MAXFIXARRAY {
-		n, err := writer.Write(Bytes{FIXARRAY | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackUint16(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
+		return writer.Write(Bytes{FIXARRAY | byte(length)})
 	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackUint16(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+		return writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
+	}
+	return writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+}
+
+// Writes the header of a map with the given number of entries.
+func packMapHeader(writer io.Writer, length int) (n int, err error) {
+	if length < MAXFIXMAP {
+		return writer.Write(Bytes{FIXMAP | byte(length)})
+	} else if length < MAX16BIT {
+		return writer.Write(Bytes{MAP16, byte(length >> 8), byte(length)})
+	}
+	return writer.Write(Bytes{MAP32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+}
+
+// Packs a given value and writes it into the specified writer.
+func PackUint16Array(writer io.Writer, value []uint16) (n int, err error) {
+	n, err = packArrayHeader(writer, len(value))
+	if err != nil {
+		return n, err
+	}
+	for _, i := range value {
+		_n, err := PackUint16(writer, i)
+		n += _n
 		if err != nil {
 			return n, err
 		}
-		for _, i := range value {
-			_n, err := PackUint16(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
 	}
 	return n, nil
 }
 
 // Packs a given value and writes it into the specified writer.
 func PackUint32Array(writer io.Writer, value []uint32) (n int, err error) {
-	length := len(value)
-	if length < MAXFIXARRAY {
-		n, err := writer.Write(Bytes{FIXARRAY | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackUint32(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackUint32(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+	n, err = packArrayHeader(writer, len(value))
+	if err != nil {
+		return n, err
+	}
+	for _, i := range value {
+		_n, err := PackUint32(writer, i)
+		n += _n
 		if err != nil {
 			return n, err
 		}
-		for _, i := range value {
-			_n, err := PackUint32(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
 	}
 	return n, nil
 }
 
 // Packs a given value and writes it into the specified writer.
 func PackUint64Array(writer io.Writer, value []uint64) (n int, err error) {
-	length := len(value)
-	if length < MAXFIXARRAY {
-		n, err := writer.Write(Bytes{FIXARRAY | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackUint64(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackUint64(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+	n, err = packArrayHeader(writer, len(value))
+	if err != nil {
+		return n, err
+	}
+	for _, i := range value {
+		_n, err := PackUint64(writer, i)
+		n += _n
 		if err != nil {
 			return n, err
 		}
-		for _, i := range value {
-			_n, err := PackUint64(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
 	}
 	return n, nil
 }
@@ -343,172 +369,64 @@ func PackUintArray(writer io.Writer, value []uint) (n int, err error) {
 
 // Packs a given value and writes it into the specified writer.
 func PackInt8Array(writer io.Writer, value []int8) (n int, err error) {
-	length := len(value)
-	if length < MAXFIXARRAY {
-		n, err := writer.Write(Bytes{FIXARRAY | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackInt8(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackInt8(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+	n, err = packArrayHeader(writer, len(value))
+	if err != nil {
+		return n, err
+	}
+	for _, i := range value {
+		_n, err := PackInt8(writer, i)
+		n += _n
 		if err != nil {
 			return n, err
 		}
-		for _, i := range value {
-			_n, err := PackInt8(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
 	}
 	return n, nil
 }
 
 // Packs a given value and writes it into the specified writer.
 func PackInt16Array(writer io.Writer, value []int16) (n int, err error) {
-	length := len(value)
-	if length < MAXFIXARRAY {
-		n, err := writer.Write(Bytes{FIXARRAY | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackInt16(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackInt16(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+	n, err = packArrayHeader(writer, len(value))
+	if err != nil {
+		return n, err
+	}
+	for _, i := range value {
+		_n, err := PackInt16(writer, i)
+		n += _n
 		if err != nil {
 			return n, err
 		}
-		for _, i := range value {
-			_n, err := PackInt16(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
 	}
 	return n, nil
 }
 
 // Packs a given value and writes it into the specified writer.
 func PackInt32Array(writer io.Writer, value []int32) (n int, err error) {
-	length := len(value)
-	if length < MAXFIXARRAY {
-		n, err := writer.Write(Bytes{FIXARRAY | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackInt32(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackInt32(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+	n, err = packArrayHeader(writer, len(value))
+	if err != nil {
+		return n, err
+	}
+	for _, i := range value {
+		_n, err := PackInt32(writer, i)
+		n += _n
 		if err != nil {
 			return n, err
 		}
-		for _, i := range value {
-			_n, err := PackInt32(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
 	}
 	return n, nil
 }
 
 // Packs a given value and writes it into the specified writer.
 func PackInt64Array(writer io.Writer, value []int64) (n int, err error) {
-	length := len(value)
-	if length < MAXFIXARRAY {
-		n, err := writer.Write(Bytes{FIXARRAY | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackInt64(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackInt64(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+	n, err = packArrayHeader(writer, len(value))
+	if err != nil {
+		return n, err
+	}
+	for _, i := range value {
+		_n, err := PackInt64(writer, i)
+		n += _n
 		if err != nil {
 			return n, err
 		}
-		for _, i := range value {
-			_n, err := PackInt64(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
 	}
 	return n, nil
 }
@@ -526,234 +444,96 @@ func PackIntArray(writer io.Writer, value []int) (n int, err error) {
 
 // Packs a given value and writes it into the specified writer.
 func PackFloat32Array(writer io.Writer, value []float32) (n int, err error) {
-	length := len(value)
-	if length < MAXFIXARRAY {
-		n, err := writer.Write(Bytes{FIXARRAY | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackFloat32(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackFloat32(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+	n, err = packArrayHeader(writer, len(value))
+	if err != nil {
+		return n, err
+	}
+	for _, i := range value {
+		_n, err := PackFloat32(writer, i)
+		n += _n
 		if err != nil {
 			return n, err
 		}
-		for _, i := range value {
-			_n, err := PackFloat32(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
 	}
 	return n, nil
 }
 
 // Packs a given value and writes it into the specified writer.
 func PackFloat64Array(writer io.Writer, value []float64) (n int, err error) {
-	length := len(value)
-	if length < MAXFIXARRAY {
-		n, err := writer.Write(Bytes{FIXARRAY | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackFloat64(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, i := range value {
-			_n, err := PackFloat64(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
+	n, err = packArrayHeader(writer, len(value))
+	if err != nil {
+		return n, err
+	}
+	for _, i := range value {
+		_n, err := PackFloat64(writer, i)
+		n += _n
 		if err != nil {
 			return n, err
 		}
-		for _, i := range value {
-			_n, err := PackFloat64(writer, i)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
 	}
 	return n, nil
 }
 
 // Packs a given value and writes it into the specified writer.
 func PackArray(writer io.Writer, value reflect.Value) (n int, err error) {
-	{
-		elemType := value.Type().Elem()
-		if (elemType.Kind() == reflect.Uint || elemType.Kind() == reflect.Uint8 || elemType.Kind() == reflect.Uint16 || elemType.Kind() == reflect.Uint32 || elemType.Kind() == reflect.Uint64 || elemType.Kind() == reflect.Uintptr) &&
-			elemType.Kind() == reflect.Uint8 {
-			return PackBytes(writer, value.Interface().([]byte))
-		}
-	}
+	return NewEncoder(writer).packArray(value)
+}
 
-	length := value.Len()
-	if length < MAXFIXARRAY {
-		n, err := writer.Write(Bytes{FIXARRAY | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for i := 0; i < length; i++ {
-			_n, err := PackValue(writer, value.Index(i))
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{ARRAY16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for i := 0; i < length; i++ {
-			_n, err := PackValue(writer, value.Index(i))
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{ARRAY32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for i := 0; i < length; i++ {
-			_n, err := PackValue(writer, value.Index(i))
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
+func (enc *Encoder) packArray(value reflect.Value) (n int, err error) {
+	if value.Type().Elem().Kind() == reflect.Uint8 {
+		return encodeBytes(enc, value)
 	}
-	return n, nil
+	return encodeArray(enc, value, encoderFor(value.Type().Elem()))
 }
 
 // Packs a given value and writes it into the specified writer.
 func PackMap(writer io.Writer, value reflect.Value) (n int, err error) {
-	keys := value.MapKeys()
-	length := len(keys)
-	if length < MAXFIXMAP {
-		n, err := writer.Write(Bytes{FIXMAP | byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, k := range keys {
-			_n, err := PackValue(writer, k)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-			_n, err = PackValue(writer, value.MapIndex(k))
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else if length < MAX16BIT {
-		n, err := writer.Write(Bytes{MAP16, byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, k := range keys {
-			_n, err := PackValue(writer, k)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-			_n, err = PackValue(writer, value.MapIndex(k))
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	} else {
-		n, err := writer.Write(Bytes{MAP32, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)})
-		if err != nil {
-			return n, err
-		}
-		for _, k := range keys {
-			_n, err := PackValue(writer, k)
-			if err != nil {
-				return n, err
-			}
-			n += _n
-			_n, err = PackValue(writer, value.MapIndex(k))
-			if err != nil {
-				return n, err
-			}
-			n += _n
-		}
-	}
-	return n, nil
+	return NewEncoder(writer).packMap(value)
+}
+
+func (enc *Encoder) packMap(value reflect.Value) (n int, err error) {
+	return encodeMap(enc, value, encoderFor(value.Type().Key()), encoderFor(value.Type().Elem()))
 }
 
 // Packs a given value and writes it into the specified writer.
 func PackValue(writer io.Writer, value reflect.Value) (n int, err error) {
-	if !value.IsValid() || value.Type() == nil {
-		return PackNil(writer)
+	return NewEncoder(writer).PackValue(value)
+}
+
+// Packs a given value and writes it into the encoder's writer.  The
+// encoder for each type is built once and cached.
+func (enc *Encoder) PackValue(value reflect.Value) (n int, err error) {
+	if !value.IsValid() {
+		return PackNil(enc.writer)
 	}
-	switch _value := value; _value.Kind() {
-	case reflect.Bool:
-		return PackBool(writer, _value.Bool())
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
-		return PackUint64(writer, _value.Uint())
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		return PackInt64(writer, _value.Int())
-	case reflect.Float32, reflect.Float64:
-		return PackFloat64(writer, _value.Float())
-	case reflect.Array:
-		return PackArray(writer, _value)
-	case reflect.Slice:
-		return PackArray(writer, _value)
-	case reflect.Map:
-		return PackMap(writer, _value)
-	case reflect.String:
-		return PackBytes(writer, []byte(_value.String()))
-	case reflect.Interface:
-		__value := reflect.ValueOf(_value.Interface())
-
-		if __value.Kind() != reflect.Interface {
-			return PackValue(writer, __value)
+	return encoderFor(value.Type())(enc, value)
+}
+
+// Returns value, or a pointer to it or to a copy of it, as typ if it
+// implements the interface.
+func valueAs(value reflect.Value, typ reflect.Type) (interface{}, bool) {
+	if value.Type().Implements(typ) {
+		return value.Interface(), true
+	}
+	if reflect.PtrTo(value.Type()).Implements(typ) {
+		if value.CanAddr() {
+			return value.Addr().Interface(), true
 		}
+		ptr := reflect.New(value.Type())
+		ptr.Elem().Set(value)
+		return ptr.Interface(), true
 	}
-	panic("unsupported type: " + value.Type().String())
+	return nil, false
 }
 
 // Packs a given value and writes it into the specified writer.
 func Pack(writer io.Writer, value interface{}) (n int, err error) {
+	return NewEncoder(writer).Pack(value)
+}
+
+// Packs a given value and writes it into the encoder's writer.
+func (enc *Encoder) Pack(value interface{}) (n int, err error) {
+	writer := enc.writer
 	if value == nil {
 		return PackNil(writer)
 	}
@@ -771,19 +551,23 @@ func Pack(writer io.Writer, value interface{}) (n int, err error) {
 	case uint:
 		return PackUint(writer, _value)
 	case int8:
-		return PackInt8(writer, _value)
+		return enc.packInt64(int64(_value))
 	case int16:
-		return PackInt16(writer, _value)
+		return enc.packInt64(int64(_value))
 	case int32:
-		return PackInt32(writer, _value)
+		return enc.packInt64(int64(_value))
 	case int64:
-		return PackInt64(writer, _value)
+		return enc.packInt64(_value)
 	case int:
-		return PackInt(writer, _value)
+		return enc.packInt64(int64(_value))
 	case float32:
 		return PackFloat32(writer, _value)
 	case float64:
-		return PackFloat64(writer, _value)
+		return enc.packFloat64(_value)
+	case complex64:
+		return PackComplex64(writer, _value)
+	case complex128:
+		return PackComplex128(writer, _value)
 	case []byte:
 		return PackBytes(writer, _value)
 	case []uint16:
@@ -795,23 +579,40 @@ func Pack(writer io.Writer, value interface{}) (n int, err error) {
 	case []uint:
 		return PackUintArray(writer, _value)
 	case []int8:
+		if enc.SignedInts {
+			return enc.PackValue(reflect.ValueOf(_value))
+		}
 		return PackInt8Array(writer, _value)
 	case []int16:
+		if enc.SignedInts {
+			return enc.PackValue(reflect.ValueOf(_value))
+		}
 		return PackInt16Array(writer, _value)
 	case []int32:
+		if enc.SignedInts {
+			return enc.PackValue(reflect.ValueOf(_value))
+		}
 		return PackInt32Array(writer, _value)
 	case []int64:
+		if enc.SignedInts {
+			return enc.PackValue(reflect.ValueOf(_value))
+		}
 		return PackInt64Array(writer, _value)
 	case []int:
+		if enc.SignedInts {
+			return enc.PackValue(reflect.ValueOf(_value))
+		}
 		return PackIntArray(writer, _value)
 	case []float32:
 		return PackFloat32Array(writer, _value)
 	case []float64:
+		if enc.CompactFloats {
+			return enc.PackValue(reflect.ValueOf(_value))
+		}
 		return PackFloat64Array(writer, _value)
 	case string:
 		return PackBytes(writer, Bytes(_value))
 	default:
-		return PackValue(writer, reflect.ValueOf(value))
+		return enc.PackValue(reflect.ValueOf(value))
 	}
-	return 0, nil // never get here
 }
@@ -0,0 +1,142 @@
+package msgpack
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrEmptyPath = errors.New("empty path")
+
+// The changes made by Patch.
+type PatchOp int
+
+const (
+	// Replaces the value at the path, adding the key if the parent is a map
+	// without it.
+	PATCH_SET PatchOp = iota
+	// Removes the value at the path from its parent, along with its key.
+	PATCH_DELETE
+	// Appends a value to the array at the path.
+	PATCH_APPEND
+)
+
+// Applies a change to the value at a path, as found by Get, in the packed
+// value at the front of b and returns the patched bytes in a new slice.
+// Only the header of the container being changed is rewritten; the other
+// bytes are copied as they are, so nothing but the patched value is
+// unpacked.  Containers on the path keep their format, except that the
+// header of the changed container may grow or shrink, and nil reads as an
+// empty array or map.  Bytes following the value are kept.
+func Patch(b []byte, op PatchOp, value interface{}, path ...interface{}) ([]byte, error) {
+	var data []byte
+	if op != PATCH_DELETE {
+		var err error
+		if data, err = AppendValue(nil, value); err != nil {
+			return nil, err
+		}
+	}
+	if op == PATCH_APPEND {
+		array, err := walk(b, path)
+		if err != nil {
+			return nil, err
+		}
+		length, elems, err := ReadArrayHeader(array)
+		if err != nil {
+			return nil, err
+		}
+		end := elems
+		for i := 0; i < length; i++ {
+			if end, err = SkipValue(end); err != nil {
+				return nil, err
+			}
+		}
+		return splice(b, array, elems, AppendArrayHeader(nil, length+1), end, end, data), nil
+	}
+	if len(path) == 0 {
+		if op == PATCH_DELETE {
+			return nil, ErrEmptyPath
+		}
+		end, err := SkipValue(b)
+		if err != nil {
+			return nil, err
+		}
+		return splice(b, b, b, nil, b, end, data), nil
+	}
+
+	parent, err := walk(b, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	if len(parent) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	elem := path[len(path)-1]
+	if isArrayCode(parent[0]) {
+		length, elems, err := ReadArrayHeader(parent)
+		if err != nil {
+			return nil, err
+		}
+		start, err := getIndex(parent, elem)
+		if err != nil {
+			return nil, err
+		}
+		end, err := SkipValue(start)
+		if err != nil {
+			return nil, err
+		}
+		if op == PATCH_DELETE {
+			length--
+		}
+		return splice(b, parent, elems, AppendArrayHeader(nil, length), start, end, data), nil
+	}
+	if !isMapCode(parent[0]) && parent[0] != NIL {
+		return nil, ErrNotFound
+	}
+
+	length, entries, err := ReadMapHeader(parent)
+	if err != nil {
+		return nil, err
+	}
+	start := entries
+	for i := 0; i < length; i++ {
+		match, rest, err := matchKey(start, elem)
+		if err != nil {
+			return nil, err
+		}
+		end, err := SkipValue(rest)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			start = end
+			continue
+		}
+		if op == PATCH_DELETE {
+			return splice(b, parent, entries, AppendMapHeader(nil, length-1), start, end, nil), nil
+		}
+		return splice(b, parent, entries, AppendMapHeader(nil, length), rest, end, data), nil
+	}
+	if op == PATCH_DELETE {
+		return nil, ErrNotFound
+	}
+	entry, err := AppendValue(nil, elem)
+	if err != nil {
+		return nil, err
+	}
+	return splice(b, parent, entries, AppendMapHeader(nil, length+1), start, start, append(entry, data...)), nil
+}
+
+// Returns a copy of b in which the container header running from the
+// start of header to the start of elems is replaced by newHeader and the
+// bytes from the start of from to the start of to are replaced by data.
+// All the arguments are suffixes of b, the last two following elems.
+func splice(b []byte, header []byte, elems []byte, newHeader []byte, from []byte, to []byte, data []byte) []byte {
+	h, e := len(b)-len(header), len(b)-len(elems)
+	f, t := len(b)-len(from), len(b)-len(to)
+	patched := make([]byte, 0, len(b)-(e-h)+len(newHeader)-(t-f)+len(data))
+	patched = append(patched, b[:h]...)
+	patched = append(patched, newHeader...)
+	patched = append(patched, b[e:f]...)
+	patched = append(patched, data...)
+	return append(patched, b[t:]...)
+}
@@ -0,0 +1,114 @@
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	doc := map[string]interface{}{
+		"name": "doc",
+		"tags": []interface{}{"a", "b"},
+		"meta": map[string]interface{}{"n": int64(1)},
+		"none": nil,
+	}
+	data, err := Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := make([]interface{}, 15)
+	for i := range long {
+		long[i] = int64(i)
+	}
+	for _, test := range []struct {
+		op       PatchOp
+		value    interface{}
+		path     []interface{}
+		expected interface{} // at the path after patching, or the path itself
+	}{
+		{PATCH_SET, "renamed", []interface{}{"name"}, "renamed"},
+		{PATCH_SET, []interface{}{int64(1)}, []interface{}{"tags", 1}, []interface{}{int64(1)}},
+		{PATCH_SET, strings.Repeat("x", 100), []interface{}{"meta", "long"}, strings.Repeat("x", 100)},
+		{PATCH_SET, true, []interface{}{"none", "x"}, true},
+		{PATCH_DELETE, nil, []interface{}{"tags", 0}, []interface{}{"b"}},
+		{PATCH_DELETE, nil, []interface{}{"meta", "n"}, map[string]interface{}{}},
+		{PATCH_APPEND, "c", []interface{}{"tags"}, []interface{}{"a", "b", "c"}},
+		{PATCH_APPEND, int64(3), []interface{}{"none"}, []interface{}{int64(3)}},
+	} {
+		patched, err := Patch(data, test.op, test.value, test.path...)
+		if err != nil {
+			t.Errorf("Patch(%d, %v): %v", test.op, test.path, err)
+			continue
+		}
+		path := test.path
+		if test.op == PATCH_DELETE {
+			path = path[:len(path)-1]
+		}
+		var v interface{}
+		value, err := Get(patched, path...)
+		if err == nil {
+			v, _, err = unpackNormalized(value)
+		}
+		if err != nil || !reflect.DeepEqual(v, test.expected) {
+			t.Errorf("Patch(%d, %v) = %s: %#v, %v; want %#v", test.op, test.path, Format(patched), v, err, test.expected)
+		}
+		// The siblings are left alone
+		if name, err := Get(patched, "name"); test.path[0] != "name" && (err != nil || !bytes.Equal(name, []byte{0xa3, 'd', 'o', 'c'})) {
+			t.Errorf("Patch(%d, %v) changed name to %s, %v", test.op, test.path, Format(name), err)
+		}
+	}
+
+	// Headers change format when the length crosses a boundary
+	array, _ := Marshal(long)
+	patched, err := Patch(array, PATCH_APPEND, 15, nil...)
+	if err != nil || patched[0] != ARRAY16 {
+		t.Fatalf("Patch = %x, %v", patched, err)
+	}
+	patched, err = Patch(patched, PATCH_DELETE, nil, 15)
+	if err != nil || !bytes.Equal(patched, array) {
+		t.Errorf("Patch = %x, %v; want %x", patched, err, array)
+	}
+
+	// The whole value is replaced by an empty path and trailing bytes kept
+	patched, err = Patch(append(Bytes{0x91, 0x01}, 0xc3), PATCH_SET, "x")
+	if err != nil || !bytes.Equal(patched, Bytes{0xa1, 'x', 0xc3}) {
+		t.Errorf("Patch = %x, %v", patched, err)
+	}
+}
+
+func unpackNormalized(data []byte) (interface{}, int, error) {
+	dec := NewDecoder(bytes.NewReader(data))
+	dec.Normalize = true
+	v, n, err := dec.Unpack()
+	return valueInterface(v), n, err
+}
+
+func TestPatchErrors(t *testing.T) {
+	data, _ := Marshal(map[string]interface{}{"a": []int{1}, "b": 2})
+	for _, test := range []struct {
+		op   PatchOp
+		path []interface{}
+		err  error
+	}{
+		{PATCH_DELETE, nil, ErrEmptyPath},
+		{PATCH_DELETE, []interface{}{"c"}, ErrNotFound},
+		{PATCH_SET, []interface{}{"a", 1}, ErrNotFound},
+		{PATCH_SET, []interface{}{"b", "x"}, ErrNotFound},
+		{PATCH_SET, []interface{}{"c", "x"}, ErrNotFound},
+		{PATCH_DELETE, []interface{}{"a", -1}, ErrNotFound},
+	} {
+		if _, err := Patch(data, test.op, 0, test.path...); err != test.err {
+			t.Errorf("Patch(%d, %v): %v, want %v", test.op, test.path, err, test.err)
+		}
+	}
+	if _, err := Patch(data, PATCH_APPEND, 0, "b"); err == nil {
+		t.Error("appended to an integer")
+	}
+	array, _ := Marshal([]interface{}{1, []int{2}})
+	if _, err := Patch(array[:len(array)-1], PATCH_SET, 0, 1); err != io.ErrUnexpectedEOF {
+		t.Error("err =", err)
+	}
+}
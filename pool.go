@@ -0,0 +1,38 @@
+package msgpack
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Scratch buffers larger than this are not returned to the pool, so that
+// one huge message does not pin its memory.
+const MAX_POOLED_BUFFER = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// Makes the encoder write to the specified writer.  The options are kept.
+func (enc *Encoder) Reset(writer io.Writer) {
+	enc.writer = writer
+}
+
+// Packs a given value and returns the packed bytes.  The value is packed
+// into a pooled scratch buffer, so only the result is allocated.
+func Marshal(value interface{}) ([]byte, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	_, err := NewEncoder(buf).Pack(value)
+	var data []byte
+	if err == nil {
+		data = append([]byte(nil), buf.Bytes()...)
+	}
+	if buf.Cap() <= MAX_POOLED_BUFFER {
+		bufferPool.Put(buf)
+	}
+	return data, err
+}
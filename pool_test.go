@@ -0,0 +1,43 @@
+package msgpack
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestMarshal(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				value := []interface{}{i, j, "x"}
+				b := &bytes.Buffer{}
+				Pack(b, value)
+				data, err := Marshal(value)
+				if err != nil || !bytes.Equal(data, b.Bytes()) {
+					t.Error("wrong output", data, b.Bytes(), err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if _, err := Marshal(make([]byte, 2*MAX_POOLED_BUFFER)); err != nil {
+		t.Error("err != nil", err)
+	}
+}
+
+func TestEncoderReset(t *testing.T) {
+	enc := &Encoder{CompactFloats: true}
+	b1, b2 := &bytes.Buffer{}, &bytes.Buffer{}
+	enc.Reset(b1)
+	enc.Pack(1.5)
+	enc.Reset(b2)
+	enc.Pack(2.5)
+	if !bytes.Equal(b1.Bytes(), Bytes{FLOAT, 0x3f, 0xc0, 0, 0}) || !bytes.Equal(b2.Bytes(), Bytes{FLOAT, 0x40, 0x20, 0, 0}) {
+		t.Error("wrong output", b1.Bytes(), b2.Bytes())
+	}
+}
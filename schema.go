@@ -0,0 +1,477 @@
+package msgpack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A set of the types of packed values.
+type SchemaType int
+
+const (
+	NIL_TYPE SchemaType = 1 << iota
+	BOOL_TYPE
+	INT_TYPE
+	FLOAT_TYPE
+	RAW_TYPE
+	ARRAY_TYPE
+	MAP_TYPE
+	EXT_TYPE
+
+	NUMBER_TYPE = INT_TYPE | FLOAT_TYPE
+)
+
+// The names of the types in schema documents, in the order of their bits.
+var schemaTypeNames = []string{"null", "boolean", "integer", "float", "string", "array", "object", "ext"}
+
+func (t SchemaType) String() string {
+	var names []string
+	for i, name := range schemaTypeNames {
+		if t&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, " or ")
+}
+
+// Reads a type name, or an array of them, as in the "type" keyword of a
+// JSON Schema.  "number" stands for both integers and floats.
+func (t *SchemaType) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			return err
+		}
+		names = []string{name}
+	}
+	*t = 0
+names:
+	for _, name := range names {
+		if name == "number" {
+			*t |= NUMBER_TYPE
+			continue
+		}
+		for i, _name := range schemaTypeNames {
+			if name == _name {
+				*t |= 1 << i
+				continue names
+			}
+		}
+		return fmt.Errorf("unknown schema type %q", name)
+	}
+	return nil
+}
+
+// Returns the type of the value starting with code c, or 0 for
+// unsupported codes.
+func codeSchemaType(c byte) SchemaType {
+	switch {
+	case c < FIXMAP || c >= NEGFIXNUM:
+		return INT_TYPE
+	case c <= FIXMAPMAX:
+		return MAP_TYPE
+	case c <= FIXARRAYMAX:
+		return ARRAY_TYPE
+	case c <= FIXRAWMAX:
+		return RAW_TYPE
+	}
+	switch c {
+	case NIL:
+		return NIL_TYPE
+	case FALSE, TRUE:
+		return BOOL_TYPE
+	case UINT8, UINT16, UINT32, UINT64, INT8, INT16, INT32, INT64:
+		return INT_TYPE
+	case FLOAT, DOUBLE:
+		return FLOAT_TYPE
+	case RAW16, RAW32:
+		return RAW_TYPE
+	case ARRAY16, ARRAY32:
+		return ARRAY_TYPE
+	case MAP16, MAP32:
+		return MAP_TYPE
+	case FIXEXT1, FIXEXT2, FIXEXT4, FIXEXT8, FIXEXT16, EXT8, EXT16, EXT32:
+		return EXT_TYPE
+	}
+	return 0
+}
+
+// A Schema describes the packed values accepted by Validate.  The zero
+// Schema accepts any value, and every field that is set adds a constraint.
+// Schemas can be written in Go or read from JSON documents in a subset of
+// JSON Schema, such as
+//
+//	{"type": "object", "required": ["id"], "properties": {
+//		"id": {"type": "integer", "minimum": 1},
+//		"tags": {"type": "array", "maxItems": 8, "items": {"type": "string"}}}}
+//
+// A schema may refer to itself to describe nested values.
+type Schema struct {
+	Type SchemaType // the accepted types, or 0 for any
+
+	Minimum *float64 // inclusive bounds of numbers
+	Maximum *float64
+
+	MinLength *int // inclusive bounds of the lengths of raws in bytes
+	MaxLength *int
+
+	MinItems *int // inclusive bounds of the lengths of arrays
+	MaxItems *int
+
+	MinProperties *int // inclusive bounds of the number of map entries
+	MaxProperties *int
+
+	Items *Schema // the schema of array elements
+
+	Properties map[string]*Schema // the schemas of values by their raw keys
+	Required   []string           // keys that maps must have
+	Additional *Schema            // the schema of values not in Properties
+	Closed     bool               // rejects keys not in Properties
+	Keys       *Schema            // the schema of all map keys
+
+	// The maximum number of arrays and maps a value may be nested in, or 0
+	// for DEFAULT_MAX_DEPTH.  Only the schema Validate is called on sets
+	// it; values nested deeper fail with ErrMaxDepth.
+	MaxDepth int
+}
+
+// Reads a schema from a JSON document.  Unknown keywords are errors, so
+// that constraints are not silently ignored; annotations like "title" and
+// "description" are allowed.
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	*s = Schema{}
+	for keyword, value := range doc {
+		var err error
+		switch keyword {
+		case "$schema", "$id", "$comment", "title", "description", "default", "examples":
+		case "type":
+			err = json.Unmarshal(value, &s.Type)
+		case "minimum":
+			err = json.Unmarshal(value, &s.Minimum)
+		case "maximum":
+			err = json.Unmarshal(value, &s.Maximum)
+		case "minLength":
+			err = json.Unmarshal(value, &s.MinLength)
+		case "maxLength":
+			err = json.Unmarshal(value, &s.MaxLength)
+		case "minItems":
+			err = json.Unmarshal(value, &s.MinItems)
+		case "maxItems":
+			err = json.Unmarshal(value, &s.MaxItems)
+		case "minProperties":
+			err = json.Unmarshal(value, &s.MinProperties)
+		case "maxProperties":
+			err = json.Unmarshal(value, &s.MaxProperties)
+		case "items":
+			err = json.Unmarshal(value, &s.Items)
+		case "properties":
+			err = json.Unmarshal(value, &s.Properties)
+		case "required":
+			err = json.Unmarshal(value, &s.Required)
+		case "additionalProperties":
+			var allowed bool
+			if json.Unmarshal(value, &allowed) == nil {
+				s.Closed = !allowed
+			} else {
+				err = json.Unmarshal(value, &s.Additional)
+			}
+		case "propertyNames":
+			err = json.Unmarshal(value, &s.Keys)
+		default:
+			err = fmt.Errorf("unsupported schema keyword %q", keyword)
+		}
+		if err != nil {
+			return fmt.Errorf("msgpack: schema %s: %w", keyword, err)
+		}
+	}
+	return nil
+}
+
+// Reads a schema from a JSON document.
+func ParseSchema(data []byte) (*Schema, error) {
+	s := &Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// A Violation describes a value that does not match its schema.
+type Violation struct {
+	Offset  int    // of the first byte of the value
+	Path    string // location of the value, such as $.items[3].name
+	Message string
+}
+
+func (v Violation) String() string {
+	return v.Path + ": " + v.Message
+}
+
+// A ValidationError lists every violation found by Validate, in the order
+// of the values in the data.
+type ValidationError struct {
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	s := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		s[i] = v.String()
+	}
+	return "msgpack: schema violations: " + strings.Join(s, "; ")
+}
+
+// Checks that b holds exactly one value and that it matches the schema.
+// The data is read in a single pass without unpacking it.  Returns a
+// *ValidationError listing all the violations, or a *DecodeError if the
+// data is malformed.
+func (s *Schema) Validate(b []byte) error {
+	v := &validator{data: b, maxDepth: s.MaxDepth}
+	if v.maxDepth <= 0 {
+		v.maxDepth = DEFAULT_MAX_DEPTH
+	}
+	rest, err := v.validate(s, b)
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		v.violate(rest, "unexpected data after the value")
+	}
+	if len(v.violations) > 0 {
+		return &ValidationError{v.violations}
+	}
+	return nil
+}
+
+var anySchema = &Schema{}
+
+// An element of the path to the value being validated: an array index, or
+// the packed key of a map entry.
+type schemaPathElem struct {
+	index int
+	key   []byte
+}
+
+type validator struct {
+	data       []byte
+	path       []schemaPathElem
+	inKey      bool
+	violations []Violation
+	// The number of arrays and maps the current value is nested in
+	depth    int
+	maxDepth int
+}
+
+// Returns the path to the current value, unpacking the keys on it.
+func (v *validator) formatPath() string {
+	path := make([]pathElem, len(v.path))
+	for i, elem := range v.path {
+		if elem.key == nil {
+			path[i].index = elem.index
+			continue
+		}
+		path[i].isKey = true
+		path[i].packed = elem.key
+	}
+	return formatPath(path)
+}
+
+// Records a violation by the value at the front of b.
+func (v *validator) violate(b []byte, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if v.inKey {
+		message = "key: " + message
+	}
+	v.violations = append(v.violations, Violation{len(v.data) - len(b), v.formatPath(), message})
+}
+
+// Wraps an error in reading the value at the front of b.
+func (v *validator) error(b []byte, err error) error {
+	var code byte
+	if len(b) > 0 {
+		code = b[0]
+	}
+	return &DecodeError{int64(len(v.data) - len(b)), v.formatPath(), code, nil, err}
+}
+
+// Validates the value at the front of b and returns the bytes following
+// it.
+func (v *validator) validate(s *Schema, b []byte) (rest []byte, err error) {
+	if s == nil {
+		s = anySchema
+	}
+	if len(b) == 0 {
+		return b, v.error(b, io.ErrUnexpectedEOF)
+	}
+	typ := codeSchemaType(b[0])
+	if typ == 0 {
+		return b, v.error(b, ErrUnsupportedCode)
+	}
+	if s.Type != 0 && s.Type&typ == 0 {
+		v.violate(b, "expected %v, got %v", s.Type, typ)
+		// The value is still read, to find any malformed data in it
+		s = anySchema
+	}
+
+	switch typ {
+	case NIL_TYPE, BOOL_TYPE:
+		return b[1:], nil
+	case INT_TYPE:
+		u, neg, rest, err := readInteger(b, nil)
+		if err != nil {
+			return b, v.error(b, err)
+		}
+		f := float64(u)
+		if neg {
+			f = -f
+		}
+		if s.Minimum != nil || s.Maximum != nil {
+			value := strconv.FormatUint(u, 10)
+			if neg {
+				value = "-" + value
+			}
+			v.checkRange(s, b, f, value)
+		}
+		return rest, nil
+	case FLOAT_TYPE:
+		f, rest, err := ReadFloat64(b)
+		if err != nil {
+			return b, v.error(b, err)
+		}
+		if s.Minimum != nil || s.Maximum != nil {
+			v.checkRange(s, b, f, strconv.FormatFloat(f, 'g', -1, 64))
+		}
+		return rest, nil
+	case RAW_TYPE:
+		length, rest, err := readRawHeader(b, nil)
+		if err != nil {
+			return b, v.error(b, err)
+		}
+		v.checkLength(b, length, s.MinLength, s.MaxLength)
+		return rest[length:], nil
+	case EXT_TYPE:
+		return v.ext(b)
+	case ARRAY_TYPE:
+		length, rest, err := ReadArrayHeader(b)
+		if err != nil {
+			return b, v.error(b, err)
+		}
+		if v.depth >= v.maxDepth {
+			return b, v.error(b, ErrMaxDepth)
+		}
+		v.checkLength(b, length, s.MinItems, s.MaxItems)
+		v.depth++
+		for i := 0; i < length; i++ {
+			v.path = append(v.path, schemaPathElem{index: i})
+			if rest, err = v.validate(s.Items, rest); err != nil {
+				return b, err
+			}
+			v.path = v.path[:len(v.path)-1]
+		}
+		v.depth--
+		return rest, nil
+	}
+	return v.validateMap(s, b)
+}
+
+func (v *validator) checkRange(s *Schema, b []byte, f float64, value string) {
+	if s.Minimum != nil && !(f >= *s.Minimum) {
+		v.violate(b, "%s is less than the minimum %v", value, *s.Minimum)
+	}
+	if s.Maximum != nil && !(f <= *s.Maximum) {
+		v.violate(b, "%s is greater than the maximum %v", value, *s.Maximum)
+	}
+}
+
+func (v *validator) checkLength(b []byte, length int, min, max *int) {
+	if min != nil && length < *min {
+		v.violate(b, "length %d is less than the minimum %d", length, *min)
+	}
+	if max != nil && length > *max {
+		v.violate(b, "length %d is greater than the maximum %d", length, *max)
+	}
+}
+
+// Reads an extension value, which has no constraints.
+func (v *validator) ext(b []byte) ([]byte, error) {
+	c := b[0]
+	var length uint64
+	rest := b[1:]
+	if c >= FIXEXT1 && c <= FIXEXT16 {
+		length = 1 << (c - FIXEXT1)
+	} else {
+		var err error
+		if length, rest, err = readBigEndian(b, 1<<(c-EXT8)); err != nil {
+			return b, v.error(b, err)
+		}
+	}
+	// The type byte precedes the data
+	if uint64(len(rest)) < 1+length {
+		return b, v.error(b, io.ErrUnexpectedEOF)
+	}
+	return rest[1+length:], nil
+}
+
+func (v *validator) validateMap(s *Schema, b []byte) ([]byte, error) {
+	length, rest, err := ReadMapHeader(b)
+	if err != nil {
+		return b, v.error(b, err)
+	}
+	if v.depth >= v.maxDepth {
+		return b, v.error(b, ErrMaxDepth)
+	}
+	v.checkLength(b, length, s.MinProperties, s.MaxProperties)
+	v.depth++
+	var found []bool
+	if len(s.Required) > 0 {
+		found = make([]bool, len(s.Required))
+	}
+	for i := 0; i < length; i++ {
+		key := rest
+		inKey := v.inKey
+		v.inKey = true
+		keyEnd, err := v.validate(s.Keys, key)
+		v.inKey = inKey
+		if err != nil {
+			return b, err
+		}
+		v.path = append(v.path, schemaPathElem{key: key[:len(key)-len(keyEnd)]})
+
+		elem := s.Additional
+		known := false
+		if isRawCode(key[0]) {
+			length, name, _ := readRawHeader(key, nil)
+			name = name[:length]
+			if schema, ok := s.Properties[string(name)]; ok {
+				elem, known = schema, true
+			}
+			for j, required := range s.Required {
+				if required == string(name) {
+					found[j] = true
+				}
+			}
+		}
+		if s.Closed && !known {
+			v.violate(key, "unexpected key")
+		}
+		if rest, err = v.validate(elem, keyEnd); err != nil {
+			return b, err
+		}
+		v.path = v.path[:len(v.path)-1]
+	}
+	v.depth--
+	for j, required := range s.Required {
+		if !found[j] {
+			v.violate(b, "missing required key %q", required)
+		}
+	}
+	return rest, nil
+}
@@ -0,0 +1,209 @@
+package msgpack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSchema = `{
+	"title": "event",
+	"type": "object",
+	"required": ["id", "kind"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"kind": {"type": "string", "minLength": 1, "maxLength": 8},
+		"score": {"type": "number", "maximum": 1.5},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": ["string", "null"]}},
+		"attrs": {"type": "object", "propertyNames": {"type": "integer"}, "additionalProperties": {"type": "boolean"}}
+	}
+}`
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := ParseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		value      interface{}
+		violations []string
+	}{
+		{map[string]interface{}{"id": 1, "kind": "click"}, nil},
+		{map[string]interface{}{"id": uint64(1 << 63), "kind": "x", "score": 1.5, "tags": []interface{}{"a", nil}, "attrs": map[int]bool{-1: true}}, nil},
+		{map[string]interface{}{"id": 0, "kind": ""}, []string{
+			"$.id: 0 is less than the minimum 1",
+			"$.kind: length 0 is less than the minimum 1",
+		}},
+		{map[string]interface{}{"kind": strings.Repeat("x", 9)}, []string{
+			"$.kind: length 9 is greater than the maximum 8",
+			`$: missing required key "id"`,
+		}},
+		{map[string]interface{}{"id": "1", "kind": "x", "score": float32(2)}, []string{
+			"$.id: expected integer, got string",
+			"$.score: 2 is greater than the maximum 1.5",
+		}},
+		{map[string]interface{}{"id": 1, "kind": "x", "tags": []interface{}{1, "a", 2}}, []string{
+			"$.tags: length 3 is greater than the maximum 2",
+			"$.tags[0]: expected null or string, got integer",
+			"$.tags[2]: expected null or string, got integer",
+		}},
+		{map[string]interface{}{"id": 1, "kind": "x", "attrs": map[interface{}]interface{}{"a": true, 2: 3}}, []string{
+			"$.attrs: key: expected integer, got string",
+			"$.attrs[2]: expected boolean, got integer",
+		}},
+		{map[string]interface{}{"id": 1, "kind": "x", "other": nil}, []string{
+			"$.other: unexpected key",
+		}},
+		{[]int{1}, []string{
+			"$: expected object, got array",
+		}},
+	} {
+		data, err := Marshal(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = schema.Validate(data)
+		var violations []string
+		if verr, ok := err.(*ValidationError); ok {
+			for _, v := range verr.Violations {
+				violations = append(violations, v.String())
+			}
+		} else if err != nil {
+			t.Errorf("Validate(%s): %v", Format(data), err)
+			continue
+		}
+		// The entries of maps are packed in any order
+		if !sameStrings(violations, test.violations) {
+			t.Errorf("Validate(%s) = %q, want %q", Format(data), violations, test.violations)
+		}
+	}
+}
+
+func sameStrings(a []string, b []string) bool {
+	count := make(map[string]int)
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		count[s]--
+	}
+	for _, n := range count {
+		if n != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSchemaGo(t *testing.T) {
+	one := 1
+	node := &Schema{Type: MAP_TYPE, Required: []string{"value"}}
+	node.Properties = map[string]*Schema{
+		"value":    {Type: INT_TYPE},
+		"children": {Type: ARRAY_TYPE | NIL_TYPE, MinItems: &one, Items: node},
+	}
+	data, _ := Marshal(map[string]interface{}{
+		"value":    1,
+		"children": []interface{}{map[string]interface{}{"value": 2, "children": nil}, map[string]interface{}{"children": []int{}}},
+		"extra":    Ext{1, []byte{1, 2, 3}},
+	})
+	err := node.Validate(data)
+	expected := []string{
+		"$.children[1].children: length 0 is less than the minimum 1",
+		`$.children[1]: missing required key "value"`,
+	}
+	verr, ok := err.(*ValidationError)
+	if !ok || len(verr.Violations) != len(expected) {
+		t.Fatalf("Validate = %v", err)
+	}
+	for i, v := range verr.Violations {
+		// Offsets depend on the order of the entries
+		if v.String() != expected[i] || v.Offset <= 0 || v.Offset >= len(data) {
+			t.Errorf("violation %d = %+v, want %s", i, v, expected[i])
+		}
+	}
+	if err := (&Schema{}).Validate(data); err != nil {
+		t.Error(err)
+	}
+
+	// Keys that are not valid Go map keys appear in paths as they are
+	err = (&Schema{Additional: &Schema{Type: RAW_TYPE}}).Validate(Bytes{0x81, 0x91, 0x01, 0x02})
+	if verr, ok := err.(*ValidationError); !ok || verr.Violations[0].String() != "$[[1]]: expected string, got integer" {
+		t.Errorf("Validate = %v", err)
+	}
+}
+
+func TestSchemaMalformed(t *testing.T) {
+	schema, _ := ParseSchema([]byte(testSchema))
+	data, _ := Marshal(map[string]interface{}{"id": 1, "tags": []string{"a"}})
+	for i := 0; i < len(data); i++ {
+		err := schema.Validate(data[:i])
+		var derr *DecodeError
+		if !errors.As(err, &derr) || derr.Err != io.ErrUnexpectedEOF {
+			t.Errorf("Validate(%x) = %v", data[:i], err)
+		}
+	}
+	err := schema.Validate(Bytes{0x91, 0xc1})
+	if derr, ok := err.(*DecodeError); !ok || derr.Err != ErrUnsupportedCode || derr.Path != "$[0]" || derr.Offset != 1 {
+		t.Errorf("Validate = %v", err)
+	}
+	err = (&Schema{}).Validate(Bytes{0x01, 0x02})
+	if verr, ok := err.(*ValidationError); !ok || !reflect.DeepEqual(verr.Violations, []Violation{{1, "$", "unexpected data after the value"}}) {
+		t.Errorf("Validate = %v", err)
+	}
+	// Deeply nested values fail instead of overflowing the stack, in keys
+	// as well as in values
+	err = (&Schema{}).Validate(append(bytes.Repeat([]byte{0x91}, 3000000), 0x01))
+	if derr, ok := err.(*DecodeError); !ok || derr.Err != ErrMaxDepth || derr.Offset != DEFAULT_MAX_DEPTH {
+		t.Errorf("Validate = %v", err)
+	}
+	err = (&Schema{}).Validate(append(bytes.Repeat([]byte{0x81, 0x91}, 1000000), 0x01))
+	if derr, ok := err.(*DecodeError); !ok || derr.Err != ErrMaxDepth {
+		t.Errorf("Validate = %v", err)
+	}
+	err = (&Schema{MaxDepth: 2}).Validate(Bytes{0x91, 0x81, 0xa1, 'a', 0x90})
+	if derr, ok := err.(*DecodeError); !ok || derr.Err != ErrMaxDepth || derr.Path != "$[0].a" {
+		t.Errorf("Validate = %v", err)
+	}
+	if err := (&Schema{MaxDepth: 2}).Validate(Bytes{0x91, 0x81, 0xa1, 'a', 0x01}); err != nil {
+		t.Errorf("Validate = %v", err)
+	}
+}
+
+func TestParseSchema(t *testing.T) {
+	for _, doc := range []string{
+		`{"type": "text"}`,
+		`{"pattern": "^a"}`,
+		`{"items": {"minimum": "1"}}`,
+		`[]`,
+	} {
+		if _, err := ParseSchema([]byte(doc)); err == nil {
+			t.Errorf("ParseSchema(%s) succeeded", doc)
+		}
+	}
+	schema, err := ParseSchema([]byte(`{"type": ["number", "null"], "maximum": 0, "additionalProperties": true}`))
+	if err != nil || schema.Type != INT_TYPE|FLOAT_TYPE|NIL_TYPE || *schema.Maximum != 0 || schema.Closed {
+		t.Errorf("ParseSchema = %+v, %v", schema, err)
+	}
+	// Each type has bounds of its own, whatever order the keywords are
+	// read in
+	for i := 0; i < 20; i++ {
+		schema, err = ParseSchema([]byte(`{"type": ["string", "array", "object"], "minLength": 1, "minItems": 2, "maxProperties": 0}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			value interface{}
+			valid bool
+		}{{"a", true}, {"", false}, {[]int{1, 2}, true}, {[]int{1}, false}, {map[string]int{}, true}, {map[string]int{"a": 1}, false}} {
+			data, _ := Marshal(test.value)
+			if err := schema.Validate(data); (err == nil) != test.valid {
+				t.Fatalf("Validate(%#v) = %v", test.value, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package msgpack
+
+import (
+	"encoding"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// Returns the size of a value of the type the function was compiled for.
+type sizerFunc func(enc *Encoder, value reflect.Value) (n int, err error)
+
+// Returns the exact number of bytes Pack writes for a given value, without
+// packing it.  Only values implementing Marshaler, encoding.BinaryMarshaler
+// or encoding.TextMarshaler, and values with a registered extension codec,
+// are marshaled to learn their size.
+func EncodedSize(value interface{}) (n int, err error) {
+	return (&Encoder{}).EncodedSize(value)
+}
+
+// Returns the exact number of bytes the encoder's Pack writes for a given
+// value, taking its options into account.
+func (enc *Encoder) EncodedSize(value interface{}) (n int, err error) {
+	switch _value := value.(type) {
+	case nil:
+		return 1, nil
+	case bool:
+		return 1, nil
+	case uint8:
+		return uintSize(uint64(_value)), nil
+	case uint16:
+		return uintSize(uint64(_value)), nil
+	case uint32:
+		return uintSize(uint64(_value)), nil
+	case uint64:
+		return uintSize(_value), nil
+	case uint:
+		return uintSize(uint64(_value)), nil
+	case int8:
+		return enc.intSize(int64(_value)), nil
+	case int16:
+		return enc.intSize(int64(_value)), nil
+	case int32:
+		return enc.intSize(int64(_value)), nil
+	case int64:
+		return enc.intSize(_value), nil
+	case int:
+		return enc.intSize(int64(_value)), nil
+	case float32:
+		return 5, nil
+	case float64:
+		return enc.floatSize(_value), nil
+	case []byte:
+		return rawSize(len(_value)), nil
+	case string:
+		return rawSize(len(_value)), nil
+	}
+	return enc.valueSize(reflect.ValueOf(value))
+}
+
+func (enc *Encoder) valueSize(value reflect.Value) (n int, err error) {
+	if !value.IsValid() {
+		return 1, nil
+	}
+	return sizerFor(value.Type())(enc, value)
+}
+
+func uintSize(value uint64) int {
+	switch {
+	case value < REGULAR_UINT7_MAX:
+		return 1
+	case value < REGULAR_UINT8_MAX:
+		return 2
+	case value < REGULAR_UINT16_MAX:
+		return 3
+	case value < REGULAR_UINT32_MAX:
+		return 5
+	}
+	return 9
+}
+
+func (enc *Encoder) intSize(value int64) int {
+	switch {
+	case value >= 0 && !enc.SignedInts:
+		return uintSize(uint64(value))
+	case value < -SPECIAL_INT64 || value >= SPECIAL_INT64:
+		return 9
+	case value < -SPECIAL_INT32 || value >= SPECIAL_INT32:
+		return 5
+	case value < -SPECIAL_INT16 || value >= SPECIAL_INT16:
+		return 3
+	case value < -SPECIAL_INT8:
+		return 2
+	}
+	return 1
+}
+
+func (enc *Encoder) floatSize(value float64) int {
+	if enc.CompactFloats && !math.IsNaN(value) && float64(float32(value)) == value {
+		return 5
+	}
+	return 9
+}
+
+// Returns the size of a raw value of the given length.
+func rawSize(length int) int {
+	switch {
+	case length < MAXFIXRAW:
+		return 1 + length
+	case length < MAX16BIT:
+		return 3 + length
+	}
+	return 5 + length
+}
+
+// Returns the size of the header of an array or map of the given length.
+func headerSize(length int) int {
+	switch {
+	case length < MAXFIXARRAY:
+		return 1
+	case length < MAX16BIT:
+		return 3
+	}
+	return 5
+}
+
+// Returns the size of an extension value with a payload of the given
+// length.
+func extSize(length int) int {
+	switch length {
+	case 1, 2, 4, 8, 16:
+		return 2 + length
+	}
+	switch {
+	case length < REGULAR_UINT8_MAX:
+		return 3 + length
+	case length < MAX16BIT:
+		return 4 + length
+	}
+	return 6 + length
+}
+
+// Returns the sizer for typ, compiling it on first use.  It follows the
+// decisions of the encoder returned by encoderFor.
+func sizerFor(typ reflect.Type) sizerFunc {
+	cache := &loadEncoderCaches().sizers
+	if f, ok := cache.Load(typ); ok {
+		return f.(sizerFunc)
+	}
+	var wg sync.WaitGroup
+	var f sizerFunc
+	wg.Add(1)
+	fi, loaded := cache.LoadOrStore(typ, sizerFunc(func(enc *Encoder, value reflect.Value) (n int, err error) {
+		wg.Wait()
+		return f(enc, value)
+	}))
+	if loaded {
+		return fi.(sizerFunc)
+	}
+	f = compileSizer(typ)
+	wg.Done()
+	cache.Store(typ, f)
+	return f
+}
+
+func compileSizer(typ reflect.Type) sizerFunc {
+	if codec := extCodecForGoType(typ); codec != nil {
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			if value.Kind() == reflect.Ptr && value.IsNil() {
+				return 1, nil
+			}
+			data, err := codec.Encode(value)
+			if err != nil {
+				return 0, err
+			}
+			return extSize(len(data)), nil
+		}
+	}
+	if typ == extType {
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return extSize(value.Field(1).Len()), nil
+		}
+	}
+	var f sizerFunc
+	if name, ok := nameForType(typ); ok {
+		if typ.Kind() == reflect.Ptr {
+			f = compileStructSizer(typ.Elem(), name)
+		} else {
+			f = compileStructSizer(typ, name)
+		}
+	}
+	switch {
+	case typ.Kind() == reflect.Interface:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			if value.IsNil() {
+				return 1, nil
+			}
+			return enc.valueSize(value.Elem())
+		}
+	case implements(typ, marshalerType):
+		f = func(enc *Encoder, value reflect.Value) (n int, err error) {
+			m, _ := valueAs(value, marshalerType)
+			data, err := m.(Marshaler).MarshalMsgpack()
+			return len(data), err
+		}
+	case implements(typ, binaryMarshalerType):
+		f = func(enc *Encoder, value reflect.Value) (n int, err error) {
+			m, _ := valueAs(value, binaryMarshalerType)
+			data, err := m.(encoding.BinaryMarshaler).MarshalBinary()
+			return rawSize(len(data)), err
+		}
+	case implements(typ, textMarshalerType):
+		f = func(enc *Encoder, value reflect.Value) (n int, err error) {
+			m, _ := valueAs(value, textMarshalerType)
+			data, err := m.(encoding.TextMarshaler).MarshalText()
+			return rawSize(len(data)), err
+		}
+	case f != nil && typ.Kind() == reflect.Ptr:
+		structf := f
+		f = func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return structf(enc, value.Elem())
+		}
+	case f == nil:
+		f = compileKindSizer(typ)
+	}
+	if typ.Kind() == reflect.Ptr {
+		nonnil := f
+		f = func(enc *Encoder, value reflect.Value) (n int, err error) {
+			if value.IsNil() {
+				return 1, nil
+			}
+			return nonnil(enc, value)
+		}
+	}
+	return f
+}
+
+func compileKindSizer(typ reflect.Type) sizerFunc {
+	switch typ.Kind() {
+	case reflect.Bool:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return 1, nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return uintSize(value.Uint()), nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return enc.intSize(value.Int()), nil
+		}
+	case reflect.Float32:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return 5, nil
+		}
+	case reflect.Float64:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return enc.floatSize(value.Float()), nil
+		}
+	case reflect.Complex64, reflect.Complex128:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			codec := complexCodec(typ)
+			if codec == nil {
+				return 0, ErrNoComplexExt
+			}
+			data, err := codec.Encode(value.Convert(codec.GoType))
+			return extSize(len(data)), err
+		}
+	case reflect.String:
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return rawSize(value.Len()), nil
+		}
+	case reflect.Slice, reflect.Array:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return func(enc *Encoder, value reflect.Value) (n int, err error) {
+				return rawSize(value.Len()), nil
+			}
+		}
+		elemf := sizerFor(typ.Elem())
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			n = headerSize(value.Len())
+			for i := 0; i < value.Len(); i++ {
+				_n, err := elemf(enc, value.Index(i))
+				n += _n
+				if err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+	case reflect.Map:
+		keyf, elemf := sizerFor(typ.Key()), sizerFor(typ.Elem())
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			n = headerSize(value.Len())
+			iter := value.MapRange()
+			for iter.Next() {
+				_n, err := keyf(enc, iter.Key())
+				n += _n
+				if err != nil {
+					return n, err
+				}
+				_n, err = elemf(enc, iter.Value())
+				n += _n
+				if err != nil {
+					return n, err
+				}
+			}
+			return n, nil
+		}
+	case reflect.Ptr:
+		elemf := sizerFor(typ.Elem())
+		return func(enc *Encoder, value reflect.Value) (n int, err error) {
+			return elemf(enc, value.Elem())
+		}
+	case reflect.Struct:
+		return compileStructSizer(typ, "")
+	}
+	return func(enc *Encoder, value reflect.Value) (n int, err error) {
+		panic("unsupported type: " + typ.String())
+	}
+}
+
+func compileStructSizer(typ reflect.Type, typeName string) sizerFunc {
+	fields := structFields(typ)
+	length := len(fields)
+	if typeName != "" {
+		length++
+	}
+	fixed := headerSize(length)
+	if typeName != "" {
+		fixed += rawSize(len(TYPE_KEY)) + rawSize(len(typeName))
+	}
+	sizers := make([]sizerFunc, len(fields))
+	for i, f := range fields {
+		fixed += rawSize(len(f.name))
+		sizers[i] = sizerFor(typ.Field(f.index).Type)
+	}
+	return func(enc *Encoder, value reflect.Value) (n int, err error) {
+		n = fixed
+		for i, f := range fields {
+			_n, err := sizers[i](enc, value.Field(f.index))
+			n += _n
+			if err != nil {
+				return n, err
+			}
+		}
+		return n, nil
+	}
+}
@@ -0,0 +1,61 @@
+package msgpack
+
+import (
+	"bytes"
+	"math"
+	"math/big"
+	"math/rand"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sizeRecord struct {
+	A  int
+	B  *sizeRecord
+	C  []interface{}
+	D  map[string]float64
+	E  [3]byte
+	F  complex64
+	G  point
+	H  netip.Addr
+	_h int
+}
+
+func TestEncodedSize(t *testing.T) {
+	registerComplexExt(t)
+	values := []interface{}{
+		nil, true, uint8(200), uint16(300), uint32(70000), uint64(math.MaxUint64), uint(5),
+		int8(-33), int16(-129), int32(-32769), int64(math.MinInt64), 1 << 40, 1.5, float32(1.5), 0.1,
+		"", strings.Repeat("x", 31), strings.Repeat("x", 32), strings.Repeat("x", 65535), strings.Repeat("x", 65536),
+		[]byte{1}, make([]int, 15), make([]int, 16), make([]int8, 70000), make([]uint16, 3), []float32{1},
+		[]float64{0.5, 0.1}, []string{"a"}, map[string]string{"a": "b"}, map[string]interface{}{"a": []int{1}},
+		map[int]bool{1: true, -100: false}, complex(1, 2), Ext{5, make([]byte, 300)}, Ext{5, make([]byte, 4)},
+		sizeRecord{1, &sizeRecord{}, []interface{}{nil, "x", 1.5}, map[string]float64{"x": 1}, [3]byte{1}, 1i, point{1, 2}, netip.MustParseAddr("::1"), 0},
+		&sizeRecord{}, (*sizeRecord)(nil), big.NewInt(1), time.Second,
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		shift := uint(r.Intn(64))
+		values = append(values, r.Int63()>>shift, -r.Int63()>>shift, r.Uint64()>>shift, r.NormFloat64())
+	}
+	for _, options := range []Encoder{{}, {CompactFloats: true}, {SignedInts: true}} {
+		for _, value := range values {
+			b := &bytes.Buffer{}
+			enc := options
+			enc.Reset(b)
+			n, err := enc.Pack(value)
+			size, _err := enc.EncodedSize(value)
+			if err != nil || _err != nil || size != n || size != b.Len() {
+				t.Errorf("EncodedSize(%T %.40v) = %d, %v; packed %d bytes, %v", value, value, size, _err, b.Len(), err)
+			}
+		}
+	}
+
+	RegisterExt(BigIntExt)
+	defer UnregisterExt(BIGINT_EXT)
+	if size, err := EncodedSize(big.NewInt(1000)); err != nil || size != 4 {
+		t.Error("EncodedSize(big.Int) =", size, err)
+	}
+}
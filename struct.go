@@ -0,0 +1,286 @@
+package msgpack
+
+import (
+	"reflect"
+	"sync"
+)
+
+// The map key under which the name of a registered type is packed.
+const TYPE_KEY = "@type"
+
+type structField struct {
+	name  string
+	index int
+}
+
+// Returns the fields of a struct type that are packed: exported fields,
+// named by their "msgpack" tag if present, except those tagged "-".
+func structFields(typ reflect.Type) []structField {
+	fields := make([]structField, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("msgpack"); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		fields = append(fields, structField{name, i})
+	}
+	return fields
+}
+
+var registeredTypes = struct {
+	sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}{
+	byName: make(map[string]reflect.Type),
+	byType: make(map[reflect.Type]string),
+}
+
+// Registers the type of value, which must be a struct or a pointer to a
+// struct, under the given name.  Values of registered types are packed
+// with their name under TYPE_KEY, and Decode uses the name to pick the
+// concrete type when storing such a value in an interface.  It is safe to
+// register types while other goroutines pack and decode.
+func RegisterType(name string, value interface{}) {
+	typ := reflect.TypeOf(value)
+	if typ == nil || (typ.Kind() != reflect.Struct && (typ.Kind() != reflect.Ptr || typ.Elem().Kind() != reflect.Struct)) {
+		panic("RegisterType of non-struct type")
+	}
+	registeredTypes.Lock()
+	defer registeredTypes.Unlock()
+	if old, ok := registeredTypes.byName[name]; ok {
+		delete(registeredTypes.byType, old)
+	}
+	registeredTypes.byName[name] = typ
+	registeredTypes.byType[typ] = name
+	resetEncoderCache()
+}
+
+// Removes the type registered under the given name, if any.
+func UnregisterType(name string) {
+	registeredTypes.Lock()
+	defer registeredTypes.Unlock()
+	if typ, ok := registeredTypes.byName[name]; ok {
+		delete(registeredTypes.byName, name)
+		delete(registeredTypes.byType, typ)
+		resetEncoderCache()
+	}
+}
+
+func typeForName(name string) reflect.Type {
+	registeredTypes.RLock()
+	defer registeredTypes.RUnlock()
+	return registeredTypes.byName[name]
+}
+
+func nameForType(typ reflect.Type) (string, bool) {
+	registeredTypes.RLock()
+	defer registeredTypes.RUnlock()
+	name, ok := registeredTypes.byType[typ]
+	return name, ok
+}
+
+func haveRegisteredTypes() bool {
+	registeredTypes.RLock()
+	defer registeredTypes.RUnlock()
+	return len(registeredTypes.byName) > 0
+}
+
+// Decodes a map into a struct, matching keys to field names.  Entries
+// without a matching field are skipped.
+func (dec *Decoder) decodeStruct(c byte, dst reflect.Value, fields []structField, byName map[string]int, decs []decoderFunc) (n int, err error) {
+	length, n, e := dec.readLength(c, FIXMAP, MAP16, MAP32)
+	if e != nil {
+		return n, e
+	}
+	if e := dec.enter(); e != nil {
+		return n, e
+	}
+	defer dec.leave()
+	_n, e := dec.decodeFields(length, dst, fields, byName, decs)
+	return n + _n, e
+}
+
+// Decodes the next length map entries into the fields of a struct.
+func (dec *Decoder) decodeFields(length uint, dst reflect.Value, fields []structField, byName map[string]int, decs []decoderFunc) (n int, err error) {
+	var i uint
+	for i = 0; i < length; i++ {
+		k, _n, e := dec.unpack(false)
+		n += _n
+		if e != nil {
+			return n, e
+		}
+		index := -1
+		if name, ok := keyString(k); ok {
+			if i, ok := byName[name]; ok {
+				index = i
+			}
+		}
+		dec.pushKey(k)
+		if index < 0 {
+			_n, e = dec.skip()
+		} else {
+			_n, e = dec.decodeElem(dst.Field(fields[index].index), decs[index])
+		}
+		n += _n
+		if e != nil {
+			return n, e
+		}
+		dec.pop()
+	}
+	return n, nil
+}
+
+// Returns an unpacked map key as string if it is raw bytes or a string.
+func keyString(k reflect.Value) (string, bool) {
+	switch _k := valueInterface(k).(type) {
+	case []byte:
+		return string(_k), true
+	case string:
+		return _k, true
+	}
+	return "", false
+}
+
+// The fields of a registered type, for decoding the entries that follow
+// its name.
+type typeFields struct {
+	fields []structField
+	byName map[string]int
+	decs   []decoderFunc
+}
+
+var typeFieldsCache sync.Map // reflect.Type -> *typeFields
+
+func typeFieldsFor(typ reflect.Type) *typeFields {
+	if tf, ok := typeFieldsCache.Load(typ); ok {
+		return tf.(*typeFields)
+	}
+	fields := structFields(typ)
+	tf := &typeFields{fields, make(map[string]int, len(fields)), make([]decoderFunc, len(fields))}
+	for i, f := range fields {
+		tf.byName[f.name] = i
+		tf.decs[i] = decoderFor(typ.Field(f.index).Type)
+	}
+	typeFieldsCache.Store(typ, tf)
+	return tf
+}
+
+var interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// Decodes an array or map into an interface while types are registered.
+// A map whose first key is TYPE_KEY, where Pack puts it, naming a
+// registered type becomes a value of that type.  Other maps and arrays
+// become what Unpack produces, with the values in them decoded the same
+// way, so that registered types nested in them are found too.  The value
+// is read once.
+func (dec *Decoder) decodeInterface(c byte, dst reflect.Value) (n int, err error) {
+	var v reflect.Value
+	if isArrayCode(c) {
+		v, n, err = dec.decodeAnyArray(c)
+	} else {
+		v, n, err = dec.decodeAnyMap(c, dst)
+	}
+	if err != nil || !v.IsValid() {
+		return n, err
+	}
+	return n, assign(dst, v)
+}
+
+func (dec *Decoder) decodeAnyArray(c byte) (v reflect.Value, n int, err error) {
+	length, n, e := dec.readLength(c, FIXARRAY, ARRAY16, ARRAY32)
+	if e != nil {
+		return reflect.Value{}, n, e
+	}
+	if e := dec.enter(); e != nil {
+		return reflect.Value{}, n, e
+	}
+	defer dec.leave()
+	elemf := decoderFor(interfaceType)
+	retval := make([]interface{}, preallocLen(length))
+	var i uint
+	for i = 0; i < length; i++ {
+		if int(i) == len(retval) {
+			retval = append(retval, nil)
+		}
+		dec.pushIndex(int(i))
+		_n, e := dec.decodeElem(reflect.ValueOf(&retval[i]).Elem(), elemf)
+		n += _n
+		if e != nil {
+			return reflect.Value{}, n, e
+		}
+		dec.pop()
+	}
+	return reflect.ValueOf(retval), n, nil
+}
+
+// Decodes a map for decodeInterface.  A map of a registered type is stored
+// in dst, and the invalid value returned.
+func (dec *Decoder) decodeAnyMap(c byte, dst reflect.Value) (v reflect.Value, n int, err error) {
+	length, n, e := dec.readLength(c, FIXMAP, MAP16, MAP32)
+	if e != nil {
+		return reflect.Value{}, n, e
+	}
+	if e := dec.enter(); e != nil {
+		return reflect.Value{}, n, e
+	}
+	defer dec.leave()
+	elemf := decoderFor(interfaceType)
+	retval := make(map[interface{}]interface{})
+	var i uint
+	for i = 0; i < length; i++ {
+		k, _n, e := dec.unpack(false)
+		n += _n
+		if e != nil {
+			return reflect.Value{}, n, e
+		}
+		key, e := mapKey(k)
+		if e != nil {
+			return reflect.Value{}, n, e
+		}
+		dec.pushKey(k)
+		var elem interface{}
+		_n, e = dec.decodeElem(reflect.ValueOf(&elem).Elem(), elemf)
+		n += _n
+		if e != nil {
+			return reflect.Value{}, n, e
+		}
+		if name, ok := keyString(reflect.ValueOf(elem)); ok && i == 0 && key == TYPE_KEY {
+			if typ := typeForName(name); typ != nil {
+				dec.pop()
+				_n, e := dec.decodeTyped(length-1, typ, dst)
+				return reflect.Value{}, n + _n, e
+			}
+		}
+		dec.pop()
+		retval[key] = elem
+	}
+	v, err = dec.mapValue(retval)
+	return v, n, err
+}
+
+// Decodes the entries of a map following the name of its registered type
+// into a new value of the type and stores it in dst.
+func (dec *Decoder) decodeTyped(length uint, typ reflect.Type, dst reflect.Value) (n int, err error) {
+	v := reflect.New(typ).Elem()
+	fields := v
+	if typ.Kind() == reflect.Ptr {
+		v.Set(reflect.New(typ.Elem()))
+		fields = v.Elem()
+	}
+	tf := typeFieldsFor(fields.Type())
+	if n, err = dec.decodeFields(length, fields, tf.fields, tf.byName, tf.decs); err != nil {
+		return n, err
+	}
+	if !typ.AssignableTo(dst.Type()) {
+		return n, &TypeError{typ.String(), dst.Type()}
+	}
+	dst.Set(v)
+	return n, nil
+}
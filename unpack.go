@@ -1,9 +1,12 @@
 package msgpack
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
+	"math"
 	"reflect"
-	"strconv"
 	"unsafe"
 )
 
@@ -22,18 +25,60 @@ const (
 	FIRSTBYTEMASK = 0xf
 )
 
+// Selects the Go type a Decoder produces for maps.
+type MapMode int
+
+const (
+	// Always produce map[interface{}]interface{}.
+	MAP_ANY_KEYS MapMode = iota
+	// Produce map[string]interface{} when all keys are strings or raw
+	// bytes, falling back to map[interface{}]interface{} otherwise.
+	MAP_STRING_KEYS
+	// Always produce map[string]interface{}, failing with
+	// ErrNonStringKey when a key is neither a string nor raw bytes.
+	MAP_STRICT_STRING_KEYS
+)
+
+var (
+	ErrNonStringKey    = errors.New("non-string map key")
+	ErrUnhashableKey   = errors.New("unhashable map key")
+	ErrUnsupportedCode = errors.New("unsupported type code")
+	ErrMaxDepth        = errors.New("maximum nesting depth exceeded")
+)
+
+const (
+	// Lengths read from the input are trusted for allocations up to these
+	// limits.  Longer raw values and arrays grow as their data arrives, so
+	// that a corrupt length cannot exhaust memory.
+	MAX_PREALLOC_BYTES = 1 << 20
+	MAX_PREALLOC_ELEMS = 1 << 12
+	// Arrays and maps nested deeper than this fail with ErrMaxDepth
+	// unless a Decoder sets another MaxDepth, so that a short input cannot
+	// overflow the stack.
+	DEFAULT_MAX_DEPTH = 10000
+)
+
 func readByte(reader io.Reader) (v uint8, err error) {
 	var data Bytes1
-	_, e := reader.Read(data[0:])
+	_, e := io.ReadFull(reader, data[0:])
 	if e != nil {
 		return 0, e
 	}
 	return data[0], nil
 }
 
+func readUint8(reader io.Reader) (v uint8, n int, err error) {
+	var data Bytes1
+	n, e := io.ReadFull(reader, data[0:])
+	if e != nil {
+		return 0, n, e
+	}
+	return data[0], n, nil
+}
+
 func readUint16(reader io.Reader) (v uint16, n int, err error) {
 	var data Bytes2
-	n, e := reader.Read(data[0:])
+	n, e := io.ReadFull(reader, data[0:])
 	if e != nil {
 		return 0, n, e
 	}
@@ -42,7 +87,7 @@ func readUint16(reader io.Reader) (v uint16, n int, err error) {
 
 func readUint32(reader io.Reader) (v uint32, n int, err error) {
 	var data Bytes4
-	n, e := reader.Read(data[0:])
+	n, e := io.ReadFull(reader, data[0:])
 	if e != nil {
 		return 0, n, e
 	}
@@ -51,7 +96,7 @@ func readUint32(reader io.Reader) (v uint32, n int, err error) {
 
 func readUint64(reader io.Reader) (v uint64, n int, err error) {
 	var data Bytes8
-	n, e := reader.Read(data[0:])
+	n, e := io.ReadFull(reader, data[0:])
 	if e != nil {
 		return 0, n, e
 	}
@@ -60,7 +105,7 @@ func readUint64(reader io.Reader) (v uint64, n int, err error) {
 
 func readInt16(reader io.Reader) (v int16, n int, err error) {
 	var data Bytes2
-	n, e := reader.Read(data[0:])
+	n, e := io.ReadFull(reader, data[0:])
 	if e != nil {
 		return 0, n, e
 	}
@@ -69,7 +114,7 @@ func readInt16(reader io.Reader) (v int16, n int, err error) {
 
 func readInt32(reader io.Reader) (v int32, n int, err error) {
 	var data Bytes4
-	n, e := reader.Read(data[0:])
+	n, e := io.ReadFull(reader, data[0:])
 	if e != nil {
 		return 0, n, e
 	}
@@ -78,92 +123,124 @@ func readInt32(reader io.Reader) (v int32, n int, err error) {
 
 func readInt64(reader io.Reader) (v int64, n int, err error) {
 	var data Bytes8
-	n, e := reader.Read(data[0:])
+	n, e := io.ReadFull(reader, data[0:])
 	if e != nil {
 		return 0, n, e
 	}
 	return (int64(data[0]) << 56) | (int64(data[1]) << 48) | (int64(data[2]) << 40) | (int64(data[3]) << 32) | (int64(data[4]) << 24) | (int64(data[5]) << 16) | (int64(data[6]) << 8) | int64(data[7]), n, nil
 }
 
-func unpackArray(reader io.Reader, nelems uint) (v reflect.Value, n int, err error) {
-	var i uint
-	var nbytesread int
-	retval := make([]interface{}, nelems)
+// Reads the payload of a raw or extension value.
+func readBytes(reader io.Reader, length uint64) (data []byte, n int, err error) {
+	if length <= MAX_PREALLOC_BYTES {
+		data = make([]byte, length)
+		n, err = io.ReadFull(reader, data)
+		return data, n, err
+	}
+	var buf bytes.Buffer
+	_n, err := io.CopyN(&buf, reader, int64(length))
+	if err == io.EOF && _n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), int(_n), err
+}
 
-	for i = 0; i < nelems; i++ {
-		v, n, err = Unpack(reader)
-		nbytesread += n
-		if err != nil {
-			return reflect.Value{}, nbytesread, err
-		}
-		retval[i] = v.Interface()
+// Returns the capacity to allocate for an array or map of the given
+// length.
+func preallocLen(length uint) int {
+	if length > MAX_PREALLOC_ELEMS {
+		return MAX_PREALLOC_ELEMS
 	}
-	return reflect.ValueOf(retval), nbytesread, nil
+	return int(length)
 }
 
-func unpackArrayReflected(reader io.Reader, nelems uint) (v reflect.Value, n int, err error) {
+func (dec *Decoder) unpackArray(nelems uint) (v reflect.Value, n int, err error) {
+	if e := dec.enter(); e != nil {
+		return reflect.Value{}, 0, e
+	}
+	defer dec.leave()
 	var i uint
 	var nbytesread int
-	retval := make([]reflect.Value, nelems)
+	retval := make([]interface{}, 0, preallocLen(nelems))
 
 	for i = 0; i < nelems; i++ {
-		v, n, err = UnpackReflected(reader)
+		dec.pushIndex(int(i))
+		v, n, err = dec.unpack(false)
 		nbytesread += n
 		if err != nil {
 			return reflect.Value{}, nbytesread, err
 		}
-		retval[i] = v
+		dec.pop()
+		retval = append(retval, valueInterface(v))
 	}
 	return reflect.ValueOf(retval), nbytesread, nil
 }
 
-func unpackMap(reader io.Reader, nelems uint) (v reflect.Value, n int, err error) {
+func (dec *Decoder) unpackMap(nelems uint) (v reflect.Value, n int, err error) {
+	if e := dec.enter(); e != nil {
+		return reflect.Value{}, 0, e
+	}
+	defer dec.leave()
 	var i uint
 	var nbytesread int
 	var k reflect.Value
 	retval := make(map[interface{}]interface{})
 
 	for i = 0; i < nelems; i++ {
-		k, n, err = Unpack(reader)
+		k, n, err = dec.unpack(false)
 		nbytesread += n
 		if err != nil {
 			return reflect.Value{}, nbytesread, err
 		}
-		v, n, err = Unpack(reader)
-		nbytesread += n
+		key, err := mapKey(k)
 		if err != nil {
 			return reflect.Value{}, nbytesread, err
 		}
-		ktyp := k.Type()
-		if ktyp.Kind() == reflect.Slice && ktyp.Elem().Kind() == reflect.Uint8 {
-			retval[string(k.Interface().([]uint8))] = v.Interface()
-		} else {
-			retval[k.Interface()] = v.Interface()
+		dec.pushKey(k)
+		v, n, err = dec.unpack(false)
+		nbytesread += n
+		if err != nil {
+			return reflect.Value{}, nbytesread, err
 		}
+		dec.pop()
+		retval[key] = valueInterface(v)
 	}
-	return reflect.ValueOf(retval), nbytesread, nil
+	v, err = dec.mapValue(retval)
+	return v, nbytesread, err
 }
 
-func unpackMapReflected(reader io.Reader, nelems uint) (v reflect.Value, n int, err error) {
-	var i uint
-	var nbytesread int
-	var k reflect.Value
-	retval := make(map[interface{}]reflect.Value)
+// Returns an unpacked value as a key of an unpacked map, with raw bytes
+// converted to strings.
+func mapKey(k reflect.Value) (interface{}, error) {
+	key := valueInterface(k)
+	if b, ok := key.([]byte); ok {
+		return string(b), nil
+	}
+	if key != nil && !k.Type().Comparable() {
+		return nil, ErrUnhashableKey
+	}
+	return key, nil
+}
 
-	for i = 0; i < nelems; i++ {
-		k, n, err = UnpackReflected(reader)
-		nbytesread += n
-		if err != nil {
-			return reflect.Value{}, nbytesread, err
-		}
-		v, n, err = UnpackReflected(reader)
-		nbytesread += n
-		if err != nil {
-			return reflect.Value{}, nbytesread, err
-		}
-		retval[k] = v
+// Returns an unpacked map in the type selected by the map mode.
+func (dec *Decoder) mapValue(m map[interface{}]interface{}) (reflect.Value, error) {
+	mode := dec.MapMode
+	if dec.Normalize && mode == MAP_ANY_KEYS {
+		mode = MAP_STRING_KEYS
 	}
-	return reflect.ValueOf(retval), nbytesread, nil
+	if mode != MAP_ANY_KEYS {
+		return stringKeyedMap(m, mode == MAP_STRICT_STRING_KEYS)
+	}
+	return reflect.ValueOf(m), nil
+}
+
+// Returns the value held by v, or nil for the invalid value unpacked from
+// nil.
+func valueInterface(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	return v.Interface()
 }
 
 // Get the four lowest bits
@@ -176,42 +253,91 @@ func lowfive(u8 uint8) uint {
 	return uint(u8 & 0x1f)
 }
 
-func unpack(reader io.Reader, reflected bool) (v reflect.Value, n int, err error) {
-	var retval reflect.Value
-	var nbytesread int
+// Converts a scalar produced by unpack to the type used in normalized
+// mode.  Integers that fit become int64, larger ones uint64.  Values
+// produced by extension codecs are left alone.
+func normalize(v reflect.Value) reflect.Value {
+	if !v.IsValid() {
+		return v
+	}
+	switch _v := v.Interface().(type) {
+	case int8, int16, int32, int64:
+		return reflect.ValueOf(v.Int())
+	case uint8, uint16, uint32, uint64:
+		if v.Uint() > math.MaxInt64 {
+			return reflect.ValueOf(v.Uint())
+		}
+		return reflect.ValueOf(int64(v.Uint()))
+	case float32:
+		return reflect.ValueOf(v.Float())
+	case []byte:
+		return reflect.ValueOf(string(_v))
+	}
+	return v
+}
+
+// Converts a map to map[string]interface{} if all of its keys are strings.
+// Otherwise returns the map as is, or ErrNonStringKey when strict is set.
+func stringKeyedMap(m map[interface{}]interface{}, strict bool) (v reflect.Value, err error) {
+	retval := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		s, ok := k.(string)
+		if !ok {
+			if strict {
+				return reflect.Value{}, ErrNonStringKey
+			}
+			return reflect.ValueOf(m), nil
+		}
+		retval[s] = v
+	}
+	return reflect.ValueOf(retval), nil
+}
 
-	c, e := readByte(reader)
+func (dec *Decoder) unpack(asNode bool) (v reflect.Value, n int, err error) {
+	if e := dec.checkContext(); e != nil {
+		return reflect.Value{}, 0, e
+	}
+	c, e := readByte(dec.reader)
 	if e != nil {
 		return reflect.Value{}, 0, e
 	}
-	nbytesread++
+	dec.code = c
+	v, n, err = dec.unpackCode(c, asNode)
+	return v, 1 + n, err
+}
+
+// Unpacks the rest of a value whose first byte c has already been read.
+// The returned count does not include c.
+func (dec *Decoder) unpackCode(c byte, asNode bool) (v reflect.Value, n int, err error) {
+	var retval reflect.Value
+	var nbytesread int
+	var e error
+	reader := dec.reader
+
 	if c < FIXMAP || c >= NEGFIXNUM {
 		retval = reflect.ValueOf(int8(c))
 	} else if c >= FIXMAP && c <= FIXMAPMAX {
-		if reflected {
-			retval, n, e = unpackMapReflected(reader, lownibble(c))
+		if asNode {
+			retval, n, e = dec.unpackMapNode(lownibble(c))
 		} else {
-			retval, n, e = unpackMap(reader, lownibble(c))
+			retval, n, e = dec.unpackMap(lownibble(c))
 		}
 		nbytesread += n
 		if e != nil {
 			return reflect.Value{}, nbytesread, e
 		}
-		nbytesread += n
 	} else if c >= FIXARRAY && c <= FIXARRAYMAX {
-		if reflected {
-			retval, n, e = unpackArrayReflected(reader, lownibble(c))
+		if asNode {
+			retval, n, e = dec.unpackArrayNode(lownibble(c))
 		} else {
-			retval, n, e = unpackArray(reader, lownibble(c))
+			retval, n, e = dec.unpackArray(lownibble(c))
 		}
 		nbytesread += n
 		if e != nil {
 			return reflect.Value{}, nbytesread, e
 		}
-		nbytesread += n
 	} else if c >= FIXRAW && c <= FIXRAWMAX {
-		data := make([]byte, lowfive(c))
-		n, e := reader.Read(data)
+		data, n, e := readBytes(reader, uint64(lowfive(c)))
 		nbytesread += n
 		if e != nil {
 			return reflect.Value{}, nbytesread, e
@@ -240,12 +366,12 @@ func unpack(reader io.Reader, reflected bool) (v reflect.Value, n int, err error
 			}
 			retval = reflect.ValueOf(*(*float64)(unsafe.Pointer(&data)))
 		case UINT8:
-			data, e := readByte(reader)
+			data, n, e := readUint8(reader)
+			nbytesread += n
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
 			}
 			retval = reflect.ValueOf(uint8(data))
-			nbytesread++
 		case UINT16:
 			data, n, e := readUint16(reader)
 			nbytesread += n
@@ -268,12 +394,12 @@ func unpack(reader io.Reader, reflected bool) (v reflect.Value, n int, err error
 			}
 			retval = reflect.ValueOf(data)
 		case INT8:
-			data, e := readByte(reader)
+			data, n, e := readUint8(reader)
+			nbytesread += n
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
 			}
 			retval = reflect.ValueOf(int8(data))
-			nbytesread++
 		case INT16:
 			data, n, e := readInt16(reader)
 			nbytesread += n
@@ -301,8 +427,7 @@ func unpack(reader io.Reader, reflected bool) (v reflect.Value, n int, err error
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
 			}
-			data := make([]byte, nbytestoread)
-			n, e = reader.Read(data)
+			data, n, e := readBytes(reader, uint64(nbytestoread))
 			nbytesread += n
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
@@ -314,8 +439,7 @@ func unpack(reader io.Reader, reflected bool) (v reflect.Value, n int, err error
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
 			}
-			data := make(Bytes, nbytestoread)
-			n, e = reader.Read(data)
+			data, n, e := readBytes(reader, uint64(nbytestoread))
 			nbytesread += n
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
@@ -327,10 +451,10 @@ func unpack(reader io.Reader, reflected bool) (v reflect.Value, n int, err error
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
 			}
-			if reflected {
-				retval, n, e = unpackArrayReflected(reader, uint(nelemstoread))
+			if asNode {
+				retval, n, e = dec.unpackArrayNode(uint(nelemstoread))
 			} else {
-				retval, n, e = unpackArray(reader, uint(nelemstoread))
+				retval, n, e = dec.unpackArray(uint(nelemstoread))
 			}
 			nbytesread += n
 			if e != nil {
@@ -342,10 +466,10 @@ func unpack(reader io.Reader, reflected bool) (v reflect.Value, n int, err error
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
 			}
-			if reflected {
-				retval, n, e = unpackArrayReflected(reader, uint(nelemstoread))
+			if asNode {
+				retval, n, e = dec.unpackArrayNode(uint(nelemstoread))
 			} else {
-				retval, n, e = unpackArray(reader, uint(nelemstoread))
+				retval, n, e = dec.unpackArray(uint(nelemstoread))
 			}
 			nbytesread += n
 			if e != nil {
@@ -357,10 +481,10 @@ func unpack(reader io.Reader, reflected bool) (v reflect.Value, n int, err error
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
 			}
-			if reflected {
-				retval, n, e = unpackMapReflected(reader, uint(nelemstoread))
+			if asNode {
+				retval, n, e = dec.unpackMapNode(uint(nelemstoread))
 			} else {
-				retval, n, e = unpackMap(reader, uint(nelemstoread))
+				retval, n, e = dec.unpackMap(uint(nelemstoread))
 			}
 			nbytesread += n
 			if e != nil {
@@ -372,30 +496,293 @@ func unpack(reader io.Reader, reflected bool) (v reflect.Value, n int, err error
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
 			}
-			if reflected {
-				retval, n, e = unpackMapReflected(reader, uint(nelemstoread))
+			if asNode {
+				retval, n, e = dec.unpackMapNode(uint(nelemstoread))
 			} else {
-				retval, n, e = unpackMap(reader, uint(nelemstoread))
+				retval, n, e = dec.unpackMap(uint(nelemstoread))
+			}
+			nbytesread += n
+			if e != nil {
+				return reflect.Value{}, nbytesread, e
 			}
+		case FIXEXT1, FIXEXT2, FIXEXT4, FIXEXT8, FIXEXT16:
+			retval, n, e = dec.unpackExt(1 << (c - FIXEXT1))
+			nbytesread += n
+			if e != nil {
+				return reflect.Value{}, nbytesread, e
+			}
+		case EXT8:
+			length, n, e := readUint8(reader)
+			nbytesread += n
+			if e != nil {
+				return reflect.Value{}, nbytesread, e
+			}
+			retval, n, e = dec.unpackExt(uint(length))
+			nbytesread += n
+			if e != nil {
+				return reflect.Value{}, nbytesread, e
+			}
+		case EXT16:
+			length, n, e := readUint16(reader)
+			nbytesread += n
+			if e != nil {
+				return reflect.Value{}, nbytesread, e
+			}
+			retval, n, e = dec.unpackExt(uint(length))
+			nbytesread += n
+			if e != nil {
+				return reflect.Value{}, nbytesread, e
+			}
+		case EXT32:
+			length, n, e := readUint32(reader)
+			nbytesread += n
+			if e != nil {
+				return reflect.Value{}, nbytesread, e
+			}
+			retval, n, e = dec.unpackExt(uint(length))
 			nbytesread += n
 			if e != nil {
 				return reflect.Value{}, nbytesread, e
 			}
 		default:
-			panic("unsupported code: " + strconv.Itoa(int(c)))
+			return reflect.Value{}, nbytesread, ErrUnsupportedCode
 		}
 	}
+	if asNode && isExtCode(c) && retval.IsValid() {
+		// Values of extension codecs are ext nodes whatever their Go type
+		retval = reflect.ValueOf(&Node{kind: EXT_NODE, value: retval})
+	}
+	if dec.Normalize && !asNode {
+		retval = normalize(retval)
+	}
 	return retval, nbytesread, nil
 }
 
+// A Decoder reads and unpacks values from an input stream.
+type Decoder struct {
+	reader        io.Reader
+	ctx           context.Context
+	counter       *countingReader
+	contextReader *contextReader
+
+	// State for DecodeError
+	path []pathElem
+	code byte
+	typ  reflect.Type
+	// The packed keys of the maps being skipped, which the path refers to
+	keys keyRecorder
+	// The number of arrays and maps the current value is nested in
+	depth int
+
+	// When set, Unpack returns integers as int64 (uint64 for values
+	// beyond the int64 range), floats as float64, raw bytes as string,
+	// arrays as []interface{} and maps as map[string]interface{} when
+	// all of their keys are strings, so that the Go type of a value does
+	// not depend on the wire format chosen for it.
+	Normalize bool
+
+	// Selects the Go type of unpacked maps, including those nested in
+	// arrays and other maps.  Normalize implies MAP_STRING_KEYS unless a
+	// stricter mode is set.
+	MapMode MapMode
+
+	// The maximum number of arrays and maps a value may be nested in,
+	// with values nested deeper failing with ErrMaxDepth.  Zero means
+	// DEFAULT_MAX_DEPTH.
+	MaxDepth int
+}
+
+// Returns a new decoder that reads from the specified reader.
+func NewDecoder(reader io.Reader) *Decoder {
+	counter := &countingReader{reader: reader}
+	return &Decoder{reader: counter, counter: counter}
+}
+
+// Reads a value from the decoder's reader, unpack and returns it.
+func (dec *Decoder) Unpack() (v reflect.Value, n int, err error) {
+	start := dec.begin()
+	v, n, err = dec.unpack(false)
+	return v, n, dec.wrapError(start, err)
+}
+
 // Reads a value from the reader, unpack and returns it.
 func Unpack(reader io.Reader) (v reflect.Value, n int, err error) {
-	return unpack(reader, false)
+	return NewDecoder(reader).Unpack()
+}
+
+// Reads a value from the decoder's reader and discards it without
+// unpacking its contents.
+func (dec *Decoder) Skip() (n int, err error) {
+	start := dec.begin()
+	n, err = dec.skip()
+	return n, dec.wrapError(start, err)
+}
+
+// Reads a value from the reader and discards it without unpacking its
+// contents.
+func Skip(reader io.Reader) (n int, err error) {
+	return NewDecoder(reader).Skip()
+}
+
+func (dec *Decoder) skip() (n int, err error) {
+	if e := dec.checkContext(); e != nil {
+		return 0, e
+	}
+	c, e := readByte(dec.reader)
+	if e != nil {
+		return 0, e
+	}
+	dec.code = c
+	n, err = dec.skipCode(c)
+	return 1 + n, err
+}
+
+// Skips the rest of a value whose first byte c has already been read.
+func (dec *Decoder) skipCode(c byte) (n int, err error) {
+	var nbytes uint64 // bytes following the header
+	var nelems uint64 // values following the header
+	var nbytesread int
+	reader := dec.reader
+
+	if c < FIXMAP || c >= NEGFIXNUM {
+		return 0, nil
+	} else if c >= FIXMAP && c <= FIXMAPMAX {
+		nelems = 2 * uint64(lownibble(c))
+	} else if c >= FIXARRAY && c <= FIXARRAYMAX {
+		nelems = uint64(lownibble(c))
+	} else if c >= FIXRAW && c <= FIXRAWMAX {
+		nbytes = uint64(lowfive(c))
+	} else {
+		switch c {
+		case NIL, FALSE, TRUE:
+		case UINT8, INT8:
+			nbytes = 1
+		case UINT16, INT16:
+			nbytes = 2
+		case FLOAT, UINT32, INT32:
+			nbytes = 4
+		case DOUBLE, UINT64, INT64:
+			nbytes = 8
+		case FIXEXT1, FIXEXT2, FIXEXT4, FIXEXT8, FIXEXT16:
+			nbytes = 1 + 1<<(c-FIXEXT1)
+		case EXT8:
+			length, n, e := readUint8(reader)
+			nbytesread += n
+			if e != nil {
+				return nbytesread, e
+			}
+			nbytes = 1 + uint64(length)
+		case RAW16, ARRAY16, MAP16, EXT16:
+			length, n, e := readUint16(reader)
+			nbytesread += n
+			if e != nil {
+				return nbytesread, e
+			}
+			switch c {
+			case RAW16:
+				nbytes = uint64(length)
+			case ARRAY16:
+				nelems = uint64(length)
+			case MAP16:
+				nelems = 2 * uint64(length)
+			case EXT16:
+				nbytes = 1 + uint64(length)
+			}
+		case RAW32, ARRAY32, MAP32, EXT32:
+			length, n, e := readUint32(reader)
+			nbytesread += n
+			if e != nil {
+				return nbytesread, e
+			}
+			switch c {
+			case RAW32:
+				nbytes = uint64(length)
+			case ARRAY32:
+				nelems = uint64(length)
+			case MAP32:
+				nelems = 2 * uint64(length)
+			case EXT32:
+				nbytes = 1 + uint64(length)
+			}
+		default:
+			return nbytesread, ErrUnsupportedCode
+		}
+	}
+	if nbytes > 0 {
+		_n, e := io.CopyN(io.Discard, reader, int64(nbytes))
+		nbytesread += int(_n)
+		if e != nil {
+			return nbytesread, e
+		}
+	}
+	// Map keys are recorded as they are skipped, and only unpacked for the
+	// path of a decode error
+	isMap := isMapCode(c)
+	if isMap || isArrayCode(c) {
+		if e := dec.enter(); e != nil {
+			return nbytesread, e
+		}
+		defer dec.leave()
+	}
+	for i := 0; uint64(i) < nelems; i++ {
+		if isMap && i%2 == 0 {
+			start := len(dec.keys.buf)
+			reader := dec.reader
+			if reader != &dec.keys {
+				// Keys within keys are recorded by the outermost one
+				dec.keys.reader = reader
+				dec.reader = &dec.keys
+			}
+			n, e := dec.skip()
+			dec.reader = reader
+			nbytesread += n
+			if e != nil {
+				return nbytesread, e
+			}
+			dec.path = append(dec.path, pathElem{packed: dec.keys.buf[start:], isKey: true})
+			continue
+		}
+		if !isMap {
+			dec.pushIndex(i)
+		}
+		n, e := dec.skip()
+		nbytesread += n
+		if e != nil {
+			return nbytesread, e
+		}
+		if isMap && dec.reader != &dec.keys {
+			dec.keys.buf = dec.keys.buf[:len(dec.keys.buf)-len(dec.path[len(dec.path)-1].packed)]
+		}
+		dec.pop()
+	}
+	return nbytesread, nil
+}
+
+// Enters an array or map, failing with ErrMaxDepth if that nests it too
+// deeply.  Every successful call is paired with leave.
+func (dec *Decoder) enter() error {
+	max := dec.MaxDepth
+	if max <= 0 {
+		max = DEFAULT_MAX_DEPTH
+	}
+	if dec.depth >= max {
+		return ErrMaxDepth
+	}
+	dec.depth++
+	return nil
+}
+
+func (dec *Decoder) leave() {
+	dec.depth--
 }
 
-// Reads unpack a value from the reader, unpack and returns it.  When the
-// value is an array or map, leaves the elements wrapped by corresponding
-// wrapper objects defined in reflect package.
-func UnpackReflected(reader io.Reader) (v reflect.Value, n int, err error) {
-	return unpack(reader, true)
+// Reads the rest of a value whose first byte c has already been read and
+// returns all of its bytes, including c.
+func (dec *Decoder) readRawCode(c byte) (data []byte, n int, err error) {
+	buf := bytes.NewBuffer(Bytes{c})
+	reader := dec.reader
+	dec.reader = io.TeeReader(reader, buf)
+	n, err = dec.skipCode(c)
+	dec.reader = reader
+	return buf.Bytes(), n, err
 }